@@ -0,0 +1,412 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+var errUnrequestedOption = errors.New("unrequested option")
+
+// Option sets an option on a request made by a Client.
+type Option func(options map[string]string)
+
+// WithBlksize requests a payload size of n bytes per data packet (RFC 2348).
+func WithBlksize(n int) Option {
+	return func(options map[string]string) {
+		options["blksize"] = strconv.Itoa(n)
+	}
+}
+
+// WithTimeout requests the server to use a timeout of d before it
+// retransmits, rounded down to whole seconds (RFC 2349). If the server
+// accepts, the client uses the same timeout.
+func WithTimeout(d time.Duration) Option {
+	return func(options map[string]string) {
+		options["timeout"] = strconv.Itoa(int(d / time.Second))
+	}
+}
+
+// WithTsize announces the size of the file to the server (RFC 2349). For a
+// write request, this lets the server reject files that are too large before
+// any data is transferred.
+func WithTsize(n int64) Option {
+	return func(options map[string]string) {
+		options["tsize"] = strconv.FormatInt(n, 10)
+	}
+}
+
+// Client defines parameters for making TFTP requests.
+type Client struct {
+	// Timeout is the time before a retransmit takes place if no other timeout
+	// is negotiated. If zero, the default of 3 seconds is used.
+	Timeout time.Duration
+
+	// Retries is the number of times a packet is retransmitted when the server
+	// doesn't reply before the timeout expires. If zero, a packet is sent only
+	// once. If negative, the default of 3 is used.
+	Retries int
+
+	// Backoff, if not nil, determines the time before each retransmission of
+	// a packet. If nil, the timeout is used for every attempt.
+	Backoff Backoff
+
+	// Logger, if not nil, receives the events of transfers, such as
+	// retransmissions, and errors that don't otherwise end up anywhere, such
+	// as failing to answer a packet from an unknown transfer ID.
+	Logger Logger
+}
+
+// NewClient returns a Client with default parameters.
+func NewClient() *Client {
+	return &Client{
+		Retries: defaultRetries,
+	}
+}
+
+// clientConn is the socket of a client session. The transfer ID of the server
+// is not known until it replies to the request from the socket it serves the
+// transfer from (RFC 1350). The first well-formed reply from the host the
+// request was sent to, which is an OACK, DATA, ACK or ERROR packet,
+// establishes the transfer ID. From then on, packets from any other port are
+// answered with an "unknown transfer ID" error and otherwise ignored.
+type clientConn struct {
+	net.PacketConn
+
+	addr *net.UDPAddr // The address of the server.
+	tid  bool         // Whether addr includes the transfer ID of the server.
+	buf  []byte
+	b    bytes.Buffer
+
+	logger Logger // Told about failures to answer packets from other ports, if not nil.
+}
+
+func (c *clientConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *clientConn) read(timeout time.Duration) (packet, error) {
+	err := c.PacketConn.SetReadDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(c.buf)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				return nil, ErrTimeout
+			}
+			return nil, err
+		}
+
+		uaddr, ok := addr.(*net.UDPAddr)
+		if !ok || !uaddr.IP.Equal(c.addr.IP) {
+			continue
+		}
+
+		if !c.tid {
+			// Neither a malformed packet nor a request is a reply, so
+			// neither establishes the transfer ID.
+			p, err := readPacket(c.buf[:n], addr)
+			if err != nil {
+				continue
+			}
+
+			switch p.(type) {
+			case *packetRRQ, *packetWRQ:
+				continue
+			}
+
+			c.addr, c.tid = uaddr, true
+			return p, nil
+		}
+
+		if uaddr.Port != c.addr.Port {
+			w := &packetWriterImpl{PacketConn: c.PacketConn, addr: addr}
+			err = w.write(&packetERROR{
+				errorCode:    tftpErrUnknownTransferID.Code,
+				errorMessage: tftpErrUnknownTransferID.Message,
+			})
+			if err != nil && c.logger != nil {
+				c.logger.Log(Event{Type: EventError, Peer: addr, Err: err})
+			}
+			continue
+		}
+
+		return readPacket(c.buf[:n], addr)
+	}
+}
+
+func (c *clientConn) write(x packet) error {
+	c.b.Reset()
+
+	err := packetToWire(x, &c.b)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.PacketConn.WriteTo(c.b.Bytes(), c.addr)
+	return err
+}
+
+// newSession returns a session for a request to the server at addr, along
+// with the socket it uses. If addr has no port, port 69 is used.
+func (cl *Client) newSession(ctx context.Context, addr, filename string) (*session, *clientConn, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "69")
+	}
+
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn, err := net.ListenPacket(udpNetwork(raddr.IP), ":0")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c := &clientConn{
+		PacketConn: conn,
+		addr:       raddr,
+		buf:        make([]byte, 65536),
+		logger:     cl.Logger,
+	}
+
+	s := &session{
+		packetReader: c,
+		packetWriter: c,
+
+		ctx:        ctx,
+		c:          c,
+		filename:   filename,
+		blksize:    defaultBlksize,
+		timeout:    defaultTimeout,
+		tsize:      -1,
+		windowsize: 1,
+		retries:    cl.Retries,
+		backoff:    cl.Backoff,
+		logger:     cl.Logger,
+		clock:      realClock{},
+	}
+
+	if cl.Timeout > 0 {
+		s.timeout = cl.Timeout
+	}
+
+	if s.retries < 0 {
+		s.retries = defaultRetries
+	}
+
+	return s, c, nil
+}
+
+// requestOptions returns the options set by opts.
+func requestOptions(opts []Option) map[string]string {
+	options := make(map[string]string)
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	return options
+}
+
+// acceptOACK applies the options acknowledged by the server, given the
+// options that were requested.
+func (s *session) acceptOACK(requested, acked map[string]string) error {
+	for k, v := range acked {
+		r, ok := requested[k]
+		if !ok {
+			return errUnrequestedOption
+		}
+
+		switch k {
+		case "blksize":
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				return err
+			}
+
+			// The server may not acknowledge a larger size than requested.
+			max, _ := strconv.Atoi(r)
+			if i < 8 || i > max {
+				return fmt.Errorf("invalid blksize %d", i)
+			}
+
+			s.blksize = i
+		case "timeout":
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				return err
+			}
+
+			if i < 1 || i > 255 {
+				return fmt.Errorf("invalid timeout %d", i)
+			}
+
+			s.timeout = time.Duration(i) * time.Second
+		case "tsize":
+			i, err := strconv.ParseUint(v, 10, 63)
+			if err != nil {
+				return err
+			}
+
+			s.tsize = int64(i)
+		}
+	}
+
+	return nil
+}
+
+// Get downloads the file filename from the server at addr. If the request is
+// accepted, it returns a ReadCloser that streams the contents of the file.
+// Every DATA packet is acknowledged as it is read, so the transfer is paced by
+// the caller. Closing the ReadCloser early aborts the transfer.
+//
+// If the server replies with an error packet, the returned error is an *Error.
+// Errors that occur after the request was accepted are returned by Read.
+func (cl *Client) Get(ctx context.Context, addr, filename string, opts ...Option) (io.ReadCloser, error) {
+	s, c, err := cl.newSession(ctx, addr, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	options := requestOptions(opts)
+	req := &packetRRQ{packetXRQ{filename: filename, mode: modeOCTET, options: options}}
+
+	// The server replies with an OACK if it accepted any option, or with the
+	// first DATA packet otherwise.
+	px, err := s.writeAndWaitForPacket(req, func(p packet) bool {
+		switch p := p.(type) {
+		case *packetOACK:
+			return len(options) > 0
+		case *packetDATA:
+			return p.blockNr == 1
+		}
+		return false
+	})
+
+	var reply packet
+	if p, ok := px.(*packetOACK); ok {
+		err = s.acceptOACK(options, p.options)
+		if err != nil {
+			err = s.abort(tftpErrOptionNegotiation, err)
+		}
+		px, reply = nil, &packetACK{blockNr: 0}
+	}
+
+	if err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		err := s.download(px, reply, pw)
+		_ = c.Close()
+		_ = pw.CloseWithError(err)
+	}()
+
+	return pr, nil
+}
+
+// download receives DATA packets and writes their payload to w. If px is not
+// nil, it is the first DATA packet. Otherwise, reply is sent to ask for it.
+func (s *session) download(px packet, reply packet, w io.Writer) error {
+	var err error
+
+	for blockNr := uint16(1); ; blockNr = s.nextBlockNr(blockNr) {
+		if px == nil {
+			px, err = s.writeAndWaitForPacket(reply, dataValidator(blockNr, 0, false))
+			if err != nil {
+				return err
+			}
+		}
+
+		pdata := px.(*packetDATA)
+		px = nil
+
+		_, err = w.Write(pdata.data)
+		if err != nil {
+			return s.abort(tftpErrNotDefined, err)
+		}
+
+		s.bytes += int64(len(pdata.data))
+		s.blocks++
+		reply = &packetACK{blockNr: blockNr}
+
+		// A DATA packet with less than "blksize" bytes signals the end of the
+		// transfer.
+		if len(pdata.data) < s.blksize {
+			return s.write(reply)
+		}
+	}
+}
+
+// Put uploads the contents of r to the file filename on the server at addr.
+// The file is sent in DATA packets of the negotiated size, each of which is
+// retransmitted until the server acknowledges it. Put returns once the final
+// DATA packet has been acknowledged.
+//
+// If the server replies with an error packet, the returned error is an *Error.
+func (cl *Client) Put(ctx context.Context, addr, filename string, r io.Reader, opts ...Option) error {
+	s, c, err := cl.newSession(ctx, addr, filename)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		// This is called from an anonymous function to make errcheck happy.
+		_ = c.Close()
+	}()
+
+	options := requestOptions(opts)
+	req := &packetWRQ{packetXRQ{filename: filename, mode: modeOCTET, options: options}}
+
+	// The server replies with an OACK if it accepted any option, or with ACK 0
+	// otherwise.
+	px, err := s.writeAndWaitForPacket(req, func(p packet) bool {
+		switch p := p.(type) {
+		case *packetOACK:
+			return len(options) > 0
+		case *packetACK:
+			return p.blockNr == 0
+		}
+		return false
+	})
+	if err != nil {
+		return err
+	}
+
+	if p, ok := px.(*packetOACK); ok {
+		err = s.acceptOACK(options, p.options)
+		if err != nil {
+			return s.abort(tftpErrOptionNegotiation, err)
+		}
+	}
+
+	_, err = s.send(r)
+	return err
+}
@@ -0,0 +1,285 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientGet(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 300)
+
+	h := NewMemHandler()
+	h.SetFile("file", data)
+
+	for _, opts := range [][]Option{
+		nil,
+		{WithBlksize(1000)},
+		{WithBlksize(1000), WithTimeout(time.Second)},
+		{WithTsize(0)},
+	} {
+		l := listenTest(t, h)
+
+		rc, err := NewClient().Get(context.Background(), l.LocalAddr().String(), "file", opts...)
+		if assert.Nil(t, err) {
+			b, err := ioutil.ReadAll(rc)
+			assert.Nil(t, err)
+			assert.Equal(t, data, b)
+			assert.Nil(t, rc.Close())
+		}
+
+		l.Close()
+	}
+}
+
+func TestClientGetDisableOptions(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 300)
+
+	h := NewMemHandler()
+	h.SetFile("file", data)
+
+	srv := NewServer(h)
+	srv.DisableOptions = true
+
+	l, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		_ = srv.Serve(l)
+	}()
+
+	// Without an OACK, the client falls back to the defaults.
+	opts := []Option{WithBlksize(1000), WithTimeout(time.Second), WithTsize(0)}
+	rc, err := NewClient().Get(context.Background(), l.LocalAddr().String(), "file", opts...)
+	if assert.Nil(t, err) {
+		b, err := ioutil.ReadAll(rc)
+		assert.Nil(t, err)
+		assert.Equal(t, data, b)
+		assert.Nil(t, rc.Close())
+	}
+}
+
+func TestClientGetEmpty(t *testing.T) {
+	l := listenTest(t, bufHandler{})
+	defer l.Close()
+
+	rc, err := NewClient().Get(context.Background(), l.LocalAddr().String(), "file")
+	if assert.Nil(t, err) {
+		b, err := ioutil.ReadAll(rc)
+		assert.Nil(t, err)
+		assert.Empty(t, b)
+	}
+}
+
+func TestClientGetError(t *testing.T) {
+	h := addrHandler{addr: make(chan net.Addr, 1)}
+	l := listenTest(t, h)
+	defer l.Close()
+
+	_, err := NewClient().Get(context.Background(), l.LocalAddr().String(), "file")
+	assert.Equal(t, &Error{Code: 1, Message: "file does not exist"}, err)
+
+	var terr *Error
+	if assert.True(t, errors.As(err, &terr)) {
+		assert.Equal(t, CodeFileNotFound, terr.Code)
+	}
+}
+
+func TestClientGetErrorAfterAccept(t *testing.T) {
+	h := HandlerFuncs{
+		Read: func(ctx context.Context, peer net.Addr, filename string) (ReadCloser, error) {
+			r := io.MultiReader(bytes.NewReader(make([]byte, 512)), iotest.ErrReader(errors.New("broken")))
+			return ioutil.NopCloser(r), nil
+		},
+	}
+	l := listenTest(t, h)
+	defer l.Close()
+
+	// The error packet sent by the server after the first block is returned
+	// by Read.
+	rc, err := NewClient().Get(context.Background(), l.LocalAddr().String(), "file")
+	if assert.Nil(t, err) {
+		_, err = ioutil.ReadAll(rc)
+
+		var terr *Error
+		if assert.True(t, errors.As(err, &terr)) {
+			assert.Equal(t, CodeNotDefined, terr.Code)
+		}
+		rc.Close()
+	}
+}
+
+func TestClientGetTimeout(t *testing.T) {
+	// Nothing replies on this socket.
+	l, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	cl := &Client{Timeout: 100 * time.Millisecond}
+	_, err = cl.Get(context.Background(), l.LocalAddr().String(), "file")
+	assert.Equal(t, &RetriesExhaustedError{Retries: 0}, err)
+	assert.True(t, errors.Is(err, ErrTimeout))
+}
+
+func TestClientTransferID(t *testing.T) {
+	l := newTestClient(t, nil)
+	defer l.Close()
+
+	type result struct {
+		data []byte
+		err  error
+	}
+
+	results := make(chan result, 1)
+	go func() {
+		cl := &Client{Timeout: time.Second, Retries: 1}
+		rc, err := cl.Get(context.Background(), l.LocalAddr().String(), "file", WithBlksize(8))
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+
+		data, err := ioutil.ReadAll(rc)
+		results <- result{data: data, err: err}
+	}()
+
+	px, peer := l.read()
+	assert.IsType(t, &packetRRQ{}, px)
+
+	// The session is served from a new socket.
+	s := newTestClient(t, peer)
+	defer s.Close()
+	stray := newTestClient(t, peer)
+	defer stray.Close()
+
+	// A malformed packet doesn't establish the transfer ID.
+	if _, err := stray.WriteTo([]byte{0x0, 0x9}, peer); err != nil {
+		t.Fatal(err)
+	}
+
+	// The OACK establishes the transfer ID, and is acknowledged.
+	s.write(&packetOACK{options: map[string]string{"blksize": "8"}})
+	px, _ = s.read()
+	assert.Equal(t, &packetACK{blockNr: 0}, px)
+
+	// Packets from other ports are rejected without disturbing the transfer.
+	stray.write(&packetDATA{blockNr: 1, data: []byte("stray")})
+	px, _ = stray.read()
+	assert.Equal(t, &packetERROR{errorCode: 5, errorMessage: "Unknown transfer ID."}, px)
+
+	s.write(&packetDATA{blockNr: 1, data: []byte("data")})
+	px, _ = s.read()
+	assert.Equal(t, &packetACK{blockNr: 1}, px)
+
+	r := <-results
+	assert.Nil(t, r.err)
+	assert.Equal(t, "data", string(r.data))
+}
+
+// lockedBuffer is a bytes.Buffer that can be written by a server while a test
+// reads it.
+type lockedBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Bytes()
+}
+
+func TestClientPut(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 300)
+
+	for _, opts := range [][]Option{
+		nil,
+		{WithBlksize(1000)},
+		{WithBlksize(1000), WithTimeout(time.Second), WithTsize(int64(len(data)))},
+	} {
+		var buf lockedBuffer
+		l := listenTest(t, bufHandler{w: &buf})
+
+		err := NewClient().Put(context.Background(), l.LocalAddr().String(), "file", bytes.NewReader(data), opts...)
+		assert.Nil(t, err)
+		assert.Equal(t, data, buf.Bytes())
+
+		l.Close()
+	}
+}
+
+func TestClientPutError(t *testing.T) {
+	h := addrHandler{addr: make(chan net.Addr, 1)}
+	l := listenTest(t, h)
+	defer l.Close()
+
+	err := NewClient().Put(context.Background(), l.LocalAddr().String(), "file", bytes.NewReader(nil))
+	assert.Equal(t, &Error{Code: 2, Message: "permission denied"}, err)
+
+	var terr *Error
+	if assert.True(t, errors.As(err, &terr)) {
+		assert.Equal(t, CodeAccessViolation, terr.Code)
+	}
+}
+
+func TestClientUnknownTransferIDWriteError(t *testing.T) {
+	var events []Event
+	conn := &strayConn{
+		stray: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1001},
+		peer:  &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1002},
+	}
+	c := &clientConn{
+		PacketConn: conn,
+		addr:       conn.peer.(*net.UDPAddr),
+		tid:        true,
+		buf:        make([]byte, 65536),
+		logger: LoggerFunc(func(e Event) {
+			events = append(events, e)
+		}),
+	}
+
+	px, err := c.read(time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, &packetACK{blockNr: 1}, px)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, EventError, events[0].Type)
+		assert.Equal(t, conn.stray, events[0].Peer)
+		assert.EqualError(t, events[0].Err, "write failed")
+	}
+}
@@ -0,0 +1,62 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"context"
+	"time"
+)
+
+// clock tells the time and waits for it to pass. Sessions measure time
+// through a clock rather than the time package, so that tests can control the
+// passage of time.
+type clock interface {
+	Now() time.Time
+
+	// Sleep waits for d to pass. It returns early with the error of ctx if
+	// ctx is done first.
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+// realClock is the clock of the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// timeSource returns the clock of srv, which is the real clock unless a test
+// set another.
+func (srv *Server) timeSource() clock {
+	if srv.clock == nil {
+		return realClock{}
+	}
+
+	return srv.clock
+}
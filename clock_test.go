@@ -0,0 +1,252 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock is a clock that only moves when it is told to, or when a session
+// sleeps.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(ctx context.Context, d time.Duration) error {
+	c.Advance(d)
+	return ctx.Err()
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestClockRetransmitAfterInvalidPackets(t *testing.T) {
+	clock := newFakeClock()
+	h := newHandlerContextWith(func(srv *Server) {
+		srv.clock = clock
+	})
+
+	h.SetReadCloser(&rcBuffer{bytes.NewBuffer([]byte{0x1})})
+	h.snd <- &packetRRQ{packetXRQ{filename: "file"}}
+	assert.Equal(t, &packetDATA{blockNr: 1, data: []byte{0x1}}, <-h.rcv)
+
+	// Invalid packets don't extend the timeout. Once it has passed, DATA 1
+	// is retransmitted, even though no read timed out.
+	for i := 0; i < 3; i++ {
+		h.snd <- func() (packet, error) {
+			clock.Advance(time.Second)
+			return &packetACK{blockNr: 0}, nil
+		}
+	}
+	assert.Equal(t, &packetDATA{blockNr: 1, data: []byte{0x1}}, <-h.rcv)
+
+	h.snd <- &packetACK{blockNr: 1}
+	close(h.snd)
+
+	_, ok := <-h.rcv
+	assert.False(t, ok)
+
+	// After the request, every read waits for the remainder of the timeout.
+	want := []time.Duration{3 * time.Second, 2 * time.Second, time.Second, 3 * time.Second}
+	assert.Equal(t, want, h.timeouts[1:5])
+}
+
+func TestClockIdleTimeoutWindow(t *testing.T) {
+	clock := newFakeClock()
+	h := newHandlerContextWith(func(srv *Server) {
+		srv.clock = clock
+		srv.IdleTimeout = 5 * time.Second
+	})
+
+	after := func(d time.Duration, p packet) func() (packet, error) {
+		return func() (packet, error) {
+			clock.Advance(d)
+			if p == nil {
+				return nil, ErrTimeout
+			}
+			return p, nil
+		}
+	}
+
+	window := func(blockNrs ...uint16) {
+		for _, blockNr := range blockNrs {
+			assert.Equal(t, blockNr, (<-h.rcv).(*packetDATA).blockNr)
+		}
+	}
+
+	h.SetReadCloser(&rcBuffer{bytes.NewBuffer(make([]byte, 40))})
+	h.Negotiate(t, map[string]string{"blksize": "8", "windowsize": "4", "timeout": "10"})
+
+	// An ACK for part of the window advances the lowest unacknowledged
+	// block, which is progress.
+	window(1, 2, 3, 4)
+	h.snd <- after(4*time.Second, &packetACK{blockNr: 2})
+	window(3, 4, 5, 6)
+	h.snd <- after(4*time.Second, &packetACK{blockNr: 4})
+	window(5, 6)
+
+	// A duplicate ACK is not, so the stuck window is aborted once it has
+	// been idle for 5 seconds, well before its timeout of 10 seconds.
+	h.snd <- after(4*time.Second, &packetACK{blockNr: 4})
+	h.snd <- after(time.Second, nil)
+	assert.Equal(t, &packetERROR{errorCode: 0, errorMessage: "idle timeout"}, <-h.rcv)
+
+	_, ok := <-h.rcv
+	assert.False(t, ok)
+}
+
+func TestClockIdleTimeoutRateLimit(t *testing.T) {
+	clock := newFakeClock()
+	h := newHandlerContextWith(func(srv *Server) {
+		srv.clock = clock
+		srv.IdleTimeout = 2 * time.Second
+		srv.RateLimit = 8
+	})
+
+	h.SetReadCloser(&rcBuffer{bytes.NewBuffer(make([]byte, 24))})
+	h.Negotiate(t, map[string]string{"blksize": "8", "windowsize": "4"})
+
+	// Pacing the window takes longer than the idle timeout, but the session
+	// isn't idle while it waits for the rate limit.
+	for blockNr := uint16(1); blockNr <= 4; blockNr++ {
+		assert.Equal(t, blockNr, (<-h.rcv).(*packetDATA).blockNr)
+	}
+	h.snd <- &packetACK{blockNr: 4}
+	close(h.snd)
+
+	_, ok := <-h.rcv
+	assert.False(t, ok)
+}
+
+func TestClockRateLimitDuration(t *testing.T) {
+	stats := make(chan Stats, 1)
+	h := newHandlerContextWith(func(srv *Server) {
+		srv.clock = newFakeClock()
+		srv.RateLimit = 512
+		srv.Stats = func(st Stats) {
+			stats <- st
+		}
+	})
+
+	h.SetReadCloser(&rcBuffer{bytes.NewBuffer(make([]byte, 2*512))})
+	h.snd <- &packetRRQ{packetXRQ{filename: "file"}}
+	for blockNr := uint16(1); blockNr <= 3; blockNr++ {
+		<-h.rcv
+		h.snd <- &packetACK{blockNr: blockNr}
+	}
+	close(h.snd)
+
+	// The second and third DATA packet are each paced by a second of sleep,
+	// which is all the time that passes.
+	assert.Equal(t, 2*time.Second, (<-stats).Duration)
+}
+
+func TestClockMaxRetransmitInterval(t *testing.T) {
+	for _, test := range []struct {
+		timeout  string // The negotiated timeout.
+		timeouts []time.Duration
+	}{
+		{timeout: "1", timeouts: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}},
+		// The negotiated timeout is not shortened.
+		{timeout: "8", timeouts: []time.Duration{8 * time.Second, 8 * time.Second, 8 * time.Second, 8 * time.Second}},
+	} {
+		h := newHandlerContextWith(func(srv *Server) {
+			srv.clock = newFakeClock()
+			srv.Backoff = ExponentialBackoff(time.Minute)
+			srv.MaxRetransmitInterval = 5 * time.Second
+		})
+
+		h.SetReadCloser(&rcBuffer{bytes.NewBuffer([]byte{0x1})})
+		h.Negotiate(t, map[string]string{"timeout": test.timeout})
+
+		for i := 0; i < 4; i++ {
+			_ = <-h.rcv
+			h.snd <- ErrTimeout
+		}
+
+		_, ok := <-h.rcv
+		assert.False(t, ok)
+
+		// The first reads are those of the request and of the ACK for the
+		// OACK.
+		assert.Equal(t, test.timeouts, h.timeouts[len(h.timeouts)-4:])
+	}
+}
+
+func TestClockIdleTimeout(t *testing.T) {
+	clock := newFakeClock()
+	h := newHandlerContextWith(func(srv *Server) {
+		srv.clock = clock
+		srv.IdleTimeout = 5 * time.Second
+		srv.Retries = 10
+	})
+
+	// after returns a reply to the session that arrives after d.
+	after := func(d time.Duration, p packet) func() (packet, error) {
+		return func() (packet, error) {
+			clock.Advance(d)
+			if p == nil {
+				return nil, ErrTimeout
+			}
+			return p, nil
+		}
+	}
+
+	h.SetReadCloser(&rcBuffer{bytes.NewBuffer(make([]byte, 20))})
+	h.Negotiate(t, map[string]string{"blksize": "8"})
+
+	// Every ACK is progress, so the session outlives the idle timeout.
+	for blockNr := uint16(1); blockNr <= 2; blockNr++ {
+		assert.Equal(t, blockNr, (<-h.rcv).(*packetDATA).blockNr)
+		h.snd <- after(4*time.Second, &packetACK{blockNr: blockNr})
+	}
+
+	// DATA 3 is retransmitted after the timeout of 3 seconds, but then the
+	// session is aborted once it has been idle for 5 seconds, with retries
+	// left.
+	assert.Equal(t, uint16(3), (<-h.rcv).(*packetDATA).blockNr)
+	h.snd <- after(3*time.Second, nil)
+	assert.Equal(t, uint16(3), (<-h.rcv).(*packetDATA).blockNr)
+	h.snd <- after(2*time.Second, nil)
+	assert.Equal(t, &packetERROR{errorCode: 0, errorMessage: "idle timeout"}, <-h.rcv)
+
+	_, ok := <-h.rcv
+	assert.False(t, ok)
+
+	// The wait for a reply to the retransmission is cut short.
+	assert.Equal(t, 2*time.Second, h.timeouts[len(h.timeouts)-1])
+}
@@ -0,0 +1,107 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"bytes"
+	"net"
+	"time"
+)
+
+// ServeConn serves a single session over the connection c, and returns the
+// error the session failed with, if any. The first datagram read from c is
+// the request, and the entire transfer is exchanged over c. This allows
+// layering TFTP on a transport other than plain UDP, such as DTLS, by passing
+// a connection of that transport.
+//
+// The connection must be message-oriented: every Write sends one datagram,
+// and every Read returns one datagram. Read must honor the deadline set by
+// SetReadDeadline, and report an expired deadline with a net.Error whose
+// Timeout method returns true. Since c is already specific to the peer,
+// transfer IDs are not checked, and MaxConcurrentSessions doesn't apply.
+// ServeConn does not close c.
+//
+// After Shutdown, ServeConn returns ErrServerClosed.
+func (srv *Server) ServeConn(c net.Conn) error {
+	srv.mu.Lock()
+	if srv.inShutdown {
+		srv.mu.Unlock()
+		return ErrServerClosed
+	}
+	srv.sessions.Add(1)
+	srv.mu.Unlock()
+
+	defer srv.sessions.Done()
+
+	t := &connTransport{Conn: c, buf: make([]byte, 65536), trace: srv.PacketTrace}
+	return srv.serve(c, t, t)
+}
+
+// connTransport reads and writes packets as datagrams of a connection.
+type connTransport struct {
+	net.Conn
+
+	buf   []byte
+	b     bytes.Buffer
+	trace func(dir PacketDirection, peer net.Addr, b []byte)
+}
+
+// read reads a packet. A timeout of zero means there is no deadline, which
+// is how the request that starts a session is read.
+func (t *connTransport) read(timeout time.Duration) (packet, error) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	err := t.Conn.SetReadDeadline(deadline)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := t.Conn.Read(t.buf)
+	if err != nil {
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			return nil, ErrTimeout
+		}
+		return nil, err
+	}
+
+	if t.trace != nil {
+		t.trace(PacketReceived, t.Conn.RemoteAddr(), t.buf[:n])
+	}
+	return readPacket(t.buf[:n], t.Conn.RemoteAddr())
+}
+
+func (t *connTransport) maxDatagram() (int, bool) {
+	return sendBufferSize(t.Conn)
+}
+
+func (t *connTransport) write(x packet) error {
+	t.b.Reset()
+
+	err := packetToWire(x, &t.b)
+	if err != nil {
+		return err
+	}
+
+	_, err = t.Conn.Write(t.b.Bytes())
+	if err == nil && t.trace != nil {
+		t.trace(PacketSent, t.Conn.RemoteAddr(), t.b.Bytes())
+	}
+	return err
+}
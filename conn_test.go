@@ -0,0 +1,157 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// pipePeer exchanges packets with a server over one end of a net.Pipe.
+type pipePeer struct {
+	net.Conn
+
+	t *testing.T
+}
+
+func (p pipePeer) write(x packet) {
+	var b bytes.Buffer
+	if err := packetToWire(x, &b); err != nil {
+		p.t.Fatal(err)
+	}
+
+	if _, err := p.Write(b.Bytes()); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+func (p pipePeer) read() packet {
+	buf := make([]byte, 65536)
+	if err := p.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		p.t.Fatal(err)
+	}
+
+	n, err := p.Read(buf)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+
+	x, err := packetFromWire(bytes.NewBuffer(buf[:n]))
+	if err != nil {
+		p.t.Fatal(err)
+	}
+
+	return x
+}
+
+func TestServeConn(t *testing.T) {
+	h := NewMemHandler()
+	h.SetFile("file", []byte("0123456789"))
+
+	srv := NewServer(h)
+	srv.DefaultTimeout = 100 * time.Millisecond
+
+	c, s := net.Pipe()
+	defer c.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.ServeConn(s)
+	}()
+
+	p := pipePeer{Conn: c, t: t}
+	p.write(&packetRRQ{packetXRQ{filename: "file", mode: modeOCTET, options: map[string]string{"blksize": "8"}}})
+	assert.Equal(t, &packetOACK{options: map[string]string{"blksize": "8"}}, p.read())
+	p.write(&packetACK{blockNr: 0})
+	assert.Equal(t, &packetDATA{blockNr: 1, data: []byte("01234567")}, p.read())
+	p.write(&packetACK{blockNr: 1})
+	assert.Equal(t, &packetDATA{blockNr: 2, data: []byte("89")}, p.read())
+	p.write(&packetACK{blockNr: 2})
+
+	// The session ends once dallying times out.
+	assert.Nil(t, <-errs)
+}
+
+func TestServeConnClosed(t *testing.T) {
+	srv := NewServer(NewMemHandler())
+	assert.Nil(t, srv.Shutdown(context.Background()))
+
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	assert.Equal(t, ErrServerClosed, srv.ServeConn(s))
+}
+
+func TestServeConnClampBlksize(t *testing.T) {
+	h := NewMemHandler()
+	h.SetFile("file", []byte("0123456789"))
+
+	events := make(chan Event, 16)
+	srv := NewServer(h)
+	srv.Logger = LoggerFunc(func(e Event) {
+		events <- e
+	})
+
+	c := newTestClient(t, nil)
+	defer c.Close()
+
+	s, err := net.DialUDP("udp4", nil, c.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c.addr = s.LocalAddr()
+
+	if err := s.SetWriteBuffer(4096); err != nil {
+		t.Fatal(err)
+	}
+	n, ok := sendBufferSize(s)
+	if !ok {
+		t.Skip("send buffer size not known on this platform")
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.ServeConn(s)
+	}()
+
+	// The block size is lowered so that a block fits in the send buffer.
+	blksize := strconv.Itoa(n - 4)
+	c.write(&packetRRQ{packetXRQ{filename: "file", mode: modeOCTET, options: map[string]string{"blksize": "65464"}}})
+	px, _ := c.read()
+	assert.Equal(t, &packetOACK{options: map[string]string{"blksize": blksize}}, px)
+	c.write(&packetERROR{errorCode: 0, errorMessage: "done"})
+	assert.NotNil(t, <-errs)
+
+	close(events)
+	var clamped bool
+	for e := range events {
+		if e.Type == EventClamp {
+			clamped = true
+			assert.Equal(t, map[string]string{"blksize": blksize}, e.Options)
+			assert.NotNil(t, e.Err)
+		}
+	}
+	assert.True(t, clamped)
+}
@@ -0,0 +1,34 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"net"
+)
+
+// canDrain tells whether drainSocket is supported on this platform. Without
+// it, sockets are not pooled, since they could never be reused.
+const canDrain = false
+
+// drainSocket discards the packets that are waiting to be read from conn,
+// without blocking. On this platform, that isn't possible, so sockets are not
+// reused.
+func drainSocket(conn net.PacketConn) bool {
+	return false
+}
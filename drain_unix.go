@@ -0,0 +1,62 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"net"
+	"syscall"
+)
+
+// canDrain tells whether drainSocket is supported on this platform.
+const canDrain = true
+
+// drainSocket discards the packets that are waiting to be read from conn,
+// without blocking. It returns false if conn cannot be drained, in which case
+// it must not be reused.
+func drainSocket(conn net.PacketConn) bool {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return false
+	}
+
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	// The socket is non-blocking, so a read fails with EAGAIN once there is
+	// nothing left to read. Errors from ICMP messages about packets sent by
+	// the previous session are discarded along with the packets.
+	var buf [1]byte
+	drained := false
+	err = rc.Read(func(fd uintptr) bool {
+		for {
+			_, _, err := syscall.Recvfrom(int(fd), buf[:], 0)
+			switch err {
+			case nil, syscall.EINTR, syscall.ECONNREFUSED:
+				continue
+			case syscall.EAGAIN:
+				drained = true
+			}
+			return true
+		}
+	})
+
+	return err == nil && drained
+}
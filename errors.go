@@ -0,0 +1,110 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"fmt"
+	"net"
+)
+
+// The errors a session ends with, as reported through Logger and Stats and
+// returned by a Client, are one of the types below, or an error returned by
+// the Handler or the network. Use errors.As and errors.Is to tell them apart.
+
+// The error codes of TFTP error packets (RFC 1350, RFC 2347), as found in
+// Error and TransferError.
+const (
+	CodeNotDefined        uint16 = 0
+	CodeFileNotFound      uint16 = 1
+	CodeAccessViolation   uint16 = 2
+	CodeDiskFull          uint16 = 3
+	CodeIllegalOperation  uint16 = 4
+	CodeUnknownTransferID uint16 = 5
+	CodeFileAlreadyExists uint16 = 6
+	CodeNoSuchUser        uint16 = 7
+	CodeOptionNegotiation uint16 = 8
+)
+
+// Error is an error packet received from the peer, which ends the transfer.
+// Code is one of the error codes above, or another code if the peer sent
+// one, and Message is the peer's description of the error.
+type Error struct {
+	Code    uint16
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("tftp error %d: %s", e.Code, e.Message)
+}
+
+// peerError returns the error reported by error packet p.
+func peerError(p *packetERROR) error {
+	return &Error{Code: p.errorCode, Message: p.errorMessage}
+}
+
+// TransferError is the error a transfer was aborted with. The error packet
+// with Code and Message was sent to the peer, unless sending it failed with
+// WriteErr, which suggests that the socket is no longer usable. Err is the
+// cause, whose text is the Message unless Server.ErrorMessage replaced it.
+type TransferError struct {
+	Code     uint16
+	Message  string
+	Err      error
+	WriteErr error
+}
+
+func (e *TransferError) Error() string {
+	if e.WriteErr != nil {
+		return fmt.Sprintf("transfer aborted with error %d: %v (sending error packet: %v)", e.Code, e.Err, e.WriteErr)
+	}
+
+	return fmt.Sprintf("transfer aborted with error %d: %v", e.Code, e.Err)
+}
+
+func (e *TransferError) Unwrap() error {
+	return e.Err
+}
+
+// MalformedPacketError is returned when a packet cannot be deserialized. Raw
+// holds the packet as it was received from Addr, for diagnostics.
+type MalformedPacketError struct {
+	Raw  []byte
+	Addr net.Addr
+	Err  error
+}
+
+func (e *MalformedPacketError) Error() string {
+	return fmt.Sprintf("malformed packet from %v: %v", e.Addr, e.Err)
+}
+
+func (e *MalformedPacketError) Unwrap() error {
+	return e.Err
+}
+
+// RetriesExhaustedError is returned when the peer didn't reply to a packet,
+// after it was retransmitted Retries times. It wraps ErrTimeout.
+type RetriesExhaustedError struct {
+	Retries int
+}
+
+func (e *RetriesExhaustedError) Error() string {
+	return fmt.Sprintf("timeout after %d retries", e.Retries)
+}
+
+func (e *RetriesExhaustedError) Unwrap() error {
+	return ErrTimeout
+}
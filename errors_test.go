@@ -0,0 +1,178 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransferError(t *testing.T) {
+	var err error = &TransferError{Code: 1, Message: "file does not exist", Err: os.ErrNotExist}
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+	assert.Equal(t, "transfer aborted with error 1: file does not exist", err.Error())
+
+	var terr *TransferError
+	assert.True(t, errors.As(err, &terr))
+	assert.Equal(t, uint16(1), terr.Code)
+}
+
+// failingWriter is a packetWriter for a socket that no longer works.
+type failingWriter struct {
+	err error
+}
+
+func (w failingWriter) write(p packet) error {
+	return w.err
+}
+
+func TestTransferErrorWriteErr(t *testing.T) {
+	errSend := errors.New("network is down")
+	events := make(chan Event, 16)
+
+	srv := NewServer(NewMemHandler())
+	srv.Logger = LoggerFunc(func(e Event) {
+		events <- e
+	})
+
+	r := &handlerContext{snd: make(chan interface{}, 1)}
+	r.snd <- &packetRRQ{packetXRQ{filename: "missing"}}
+	err := srv.serve(nil, r, failingWriter{errSend})
+
+	var terr *TransferError
+	if assert.True(t, errors.As(err, &terr)) {
+		assert.Equal(t, uint16(1), terr.Code)
+		assert.Equal(t, errSend, terr.WriteErr)
+		assert.Equal(t, "transfer aborted with error 1: file does not exist (sending error packet: network is down)", err.Error())
+	}
+
+	// The failure to send the error packet is logged.
+	close(events)
+	var logged bool
+	for e := range events {
+		if e.Type == EventError && e.Err == errSend {
+			logged = true
+		}
+	}
+	assert.True(t, logged)
+}
+
+func TestMalformedPacketError(t *testing.T) {
+	cause := errors.New("invalid opcode")
+	var err error = &MalformedPacketError{
+		Raw:  []byte{0x0, 0x9},
+		Addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234},
+		Err:  cause,
+	}
+	assert.True(t, errors.Is(err, cause))
+	assert.Equal(t, "malformed packet from 127.0.0.1:1234: invalid opcode", err.Error())
+}
+
+func TestRetriesExhaustedError(t *testing.T) {
+	var err error = &RetriesExhaustedError{Retries: 3}
+	assert.True(t, errors.Is(err, ErrTimeout))
+	assert.Equal(t, "timeout after 3 retries", err.Error())
+}
+
+func TestSessionErrors(t *testing.T) {
+	var tests = []struct {
+		fn   func(h *handlerContext)
+		code uint16 // The code of the *TransferError the session ends with.
+		is   error
+	}{
+		{
+			// Deserialization failure
+			fn: func(h *handlerContext) {
+				h.snd <- errOpcode
+			},
+			code: 0,
+			is:   errOpcode,
+		},
+		{
+			fn: func(h *handlerContext) {
+				h.snd <- &packetACK{}
+			},
+			code: 4,
+			is:   errNotRequest,
+		},
+		{
+			fn: func(h *handlerContext) {
+				h.readFunc = func(_ net.Addr, _ string) (ReadCloser, error) {
+					return nil, os.ErrPermission
+				}
+				h.snd <- &packetRRQ{packetXRQ{filename: "file"}}
+			},
+			code: 2,
+			is:   os.ErrPermission,
+		},
+	}
+
+	for _, test := range tests {
+		stats := make(chan Stats, 1)
+		h := newHandlerContextWith(func(srv *Server) {
+			srv.Stats = func(st Stats) {
+				stats <- st
+			}
+		})
+
+		test.fn(h)
+		_ = <-h.rcv
+
+		err := (<-stats).Err
+		assert.True(t, errors.Is(err, test.is))
+
+		var terr *TransferError
+		if assert.True(t, errors.As(err, &terr)) {
+			assert.Equal(t, test.code, terr.Code)
+		}
+	}
+}
+
+func TestErrorMessage(t *testing.T) {
+	stats := make(chan Stats, 1)
+	h := newHandlerContextWith(func(srv *Server) {
+		srv.ErrorMessage = func(code uint16, err error) string {
+			if code == 2 {
+				return "access denied"
+			}
+			return err.Error()
+		}
+		srv.Stats = func(st Stats) {
+			stats <- st
+		}
+	})
+
+	perr := &os.PathError{Op: "open", Path: "/srv/tftp/secret/file", Err: os.ErrPermission}
+	h.readFunc = func(_ net.Addr, _ string) (ReadCloser, error) {
+		return nil, perr
+	}
+	h.snd <- &packetRRQ{packetXRQ{filename: "file"}}
+
+	// The peer is told the message, without the path.
+	assert.Equal(t, &packetERROR{errorCode: 2, errorMessage: "access denied"}, <-h.rcv)
+
+	// The session still ends with the error itself.
+	var terr *TransferError
+	if assert.True(t, errors.As((<-stats).Err, &terr)) {
+		assert.Equal(t, "access denied", terr.Message)
+		assert.Equal(t, perr, terr.Err)
+	}
+}
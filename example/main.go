@@ -17,34 +17,51 @@ limitations under the License.
 package main
 
 import (
+	"flag"
 	"log"
+	"net"
 	"os"
-	"path"
 
 	"github.com/vmware/gotftp"
 )
 
-type Handler struct {
-	Path string
-}
-
-func (h Handler) ReadFile(c gotftp.Conn, filename string) (gotftp.ReadCloser, error) {
-	log.Printf("Request from %s to read %s", c.RemoteAddr(), filename)
-	return os.OpenFile(path.Join(h.Path, filename), os.O_RDONLY, 0)
-}
-
-func (h Handler) WriteFile(c gotftp.Conn, filename string) (gotftp.WriteCloser, error) {
-	log.Printf("Request from %s to write %s", c.RemoteAddr(), filename)
-	return os.OpenFile(path.Join(h.Path, filename), os.O_WRONLY, 0644)
-}
-
 func main() {
+	uid := flag.Int("uid", -1, "user ID to switch to once port 69 is bound, if not negative")
+	gid := flag.Int("gid", -1, "group ID to switch to once port 69 is bound, if not negative")
+	flag.Parse()
+
 	pwd, err := os.Getwd()
 	if err != nil {
 		panic(err)
 	}
 
-	h := Handler{Path: pwd}
-	err = gotftp.ListenAndServe(h)
+	srv := gotftp.NewServer(gotftp.FileServer(pwd))
+	srv.Logger = gotftp.LoggerFunc(func(e gotftp.Event) {
+		switch e.Type {
+		case gotftp.EventRequest:
+			op := "read"
+			if e.Write {
+				op = "write"
+			}
+			log.Printf("Request from %s to %s %s", e.Peer, op, e.Filename)
+		case gotftp.EventComplete:
+			if e.Err != nil {
+				log.Printf("Transfer of %s for %s failed: %v", e.Filename, e.Peer, e.Err)
+			}
+		}
+	})
+
+	// Port 69 can only be bound by root. If asked to, the server continues
+	// as another user once it is, since sessions are served from
+	// unprivileged ports. That user needs access to the directory served.
+	srv.Listening = func(l net.PacketConn) error {
+		log.Printf("Listening on %s", l.LocalAddr())
+		if *uid < 0 && *gid < 0 {
+			return nil
+		}
+		return dropPrivileges(*uid, *gid)
+	}
+
+	err = srv.ListenAndServe()
 	panic(err)
 }
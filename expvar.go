@@ -0,0 +1,103 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"errors"
+	"expvar"
+	"strconv"
+)
+
+// serverVars are the counters of the sessions of a Server, as published by
+// PublishVars. expvar updates them atomically, so that sessions can share
+// them without locking.
+type serverVars struct {
+	sessions expvar.Int
+	active   expvar.Int
+	bytes    expvar.Int
+	timeouts expvar.Int
+	errors   expvar.Map
+}
+
+// PublishVars publishes counters of the sessions of the server through the
+// expvar package, as a map with the given name, which shows up under
+// /debug/vars of an HTTP server that serves expvar.Handler or imports expvar.
+// The map holds:
+//
+//	sessions  the number of sessions that were started
+//	active    the number of sessions in progress
+//	bytes     the number of data bytes transferred
+//	timeouts  the number of sessions that ended because the peer didn't
+//	          reply, including IdleTimeout
+//	errors    the number of sessions that ended with an error packet sent
+//	          to the peer, by TFTP error code
+//
+// Only sessions that start after PublishVars are counted. Nothing is
+// published unless PublishVars is called. Like expvar.Publish, it panics if
+// name is already in use.
+func (srv *Server) PublishVars(name string) {
+	v := &serverVars{}
+	v.errors.Init()
+
+	m := expvar.NewMap(name)
+	m.Set("sessions", &v.sessions)
+	m.Set("active", &v.active)
+	m.Set("bytes", &v.bytes)
+	m.Set("timeouts", &v.timeouts)
+	m.Set("errors", &v.errors)
+
+	srv.mu.Lock()
+	srv.vars = v
+	srv.mu.Unlock()
+}
+
+// expvars returns the counters published by PublishVars, or nil.
+func (srv *Server) expvars() *serverVars {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.vars
+}
+
+// begin counts a session that started.
+func (v *serverVars) begin() {
+	if v == nil {
+		return
+	}
+
+	v.sessions.Add(1)
+	v.active.Add(1)
+}
+
+// end counts a session that ended with err after transferring n bytes.
+func (v *serverVars) end(n int64, err error) {
+	if v == nil {
+		return
+	}
+
+	v.active.Add(-1)
+	v.bytes.Add(n)
+
+	var rerr *RetriesExhaustedError
+	if errors.As(err, &rerr) || errors.Is(err, errIdle) {
+		v.timeouts.Add(1)
+	}
+
+	var terr *TransferError
+	if errors.As(err, &terr) {
+		v.errors.Add(strconv.Itoa(int(terr.Code)), 1)
+	}
+}
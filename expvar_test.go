@@ -0,0 +1,79 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"bytes"
+	"expvar"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishVars(t *testing.T) {
+	var vars *serverVars
+	h := newHandlerContextWith(func(srv *Server) {
+		srv.PublishVars("gotftp_test")
+		vars = srv.vars
+	})
+	m := expvar.Get("gotftp_test").(*expvar.Map)
+
+	// A completed read request
+	h.SetReadCloser(&rcBuffer{bytes.NewBuffer([]byte("0123456789"))})
+	h.snd <- &packetRRQ{packetXRQ{filename: "file"}}
+	<-h.rcv
+	assert.Equal(t, "1", m.Get("active").String())
+	h.snd <- &packetACK{blockNr: 1}
+	h.snd <- ErrTimeout
+	_, ok := <-h.rcv
+	assert.False(t, ok)
+
+	// A file that doesn't exist
+	h = newHandlerContextWith(func(srv *Server) {
+		srv.vars = vars
+	})
+	h.readFunc = func(_ net.Addr, _ string) (ReadCloser, error) {
+		return nil, os.ErrNotExist
+	}
+	h.snd <- &packetRRQ{packetXRQ{filename: "missing"}}
+	<-h.rcv
+	_, ok = <-h.rcv
+	assert.False(t, ok)
+
+	// A peer that stops replying
+	h = newHandlerContextWith(func(srv *Server) {
+		srv.vars = vars
+		srv.Retries = 0
+	})
+	h.snd <- &packetWRQ{packetXRQ{filename: "file"}}
+	<-h.rcv
+	h.snd <- ErrTimeout
+	_, ok = <-h.rcv
+	assert.False(t, ok)
+
+	assert.Equal(t, "3", m.Get("sessions").String())
+	assert.Equal(t, "0", m.Get("active").String())
+	assert.Equal(t, "10", m.Get("bytes").String())
+	assert.Equal(t, "1", m.Get("timeouts").String())
+	assert.Equal(t, `{"1": 1}`, m.Get("errors").String())
+
+	assert.Panics(t, func() {
+		NewServer(NewMemHandler()).PublishVars("gotftp_test")
+	})
+}
@@ -0,0 +1,216 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileHandler is a Handler that serves read and write requests for files in
+// the directory tree rooted at Root.
+//
+// Filenames are interpreted relative to Root. Requests for absolute paths, for
+// paths that escape Root through "..", and for paths that resolve to a
+// location outside of Root through a symbolic link are denied with
+// os.ErrPermission.
+//
+// Files are written to a temporary file in the destination directory, which
+// replaces the destination only once the transfer completes. A failed write
+// request does not leave a partial file behind. The temporary file is synced
+// to disk before the final block is acknowledged (see Syncer), so the peer
+// waits for the fsync and is only told of success once the file is durable.
+type FileHandler struct {
+	Root string
+
+	// AllowOverwrite allows write requests to replace existing files. If
+	// false, such requests are denied with os.ErrExist, which is reported to
+	// the peer as "file already exists".
+	AllowOverwrite bool
+}
+
+// FileServer returns a FileHandler for the directory tree rooted at root,
+// which allows existing files to be overwritten.
+func FileServer(root string) *FileHandler {
+	return &FileHandler{Root: root, AllowOverwrite: true}
+}
+
+// fileError maps err to the error values that are translated to TFTP error
+// codes, so that the error packet sent to the peer is meaningful.
+func fileError(err error) error {
+	switch {
+	case os.IsNotExist(err):
+		return os.ErrNotExist
+	case os.IsPermission(err):
+		return os.ErrPermission
+	case os.IsExist(err):
+		return os.ErrExist
+	}
+
+	return err
+}
+
+// within returns whether path p is equal to or below directory root. Both
+// paths must be clean.
+func within(root, p string) bool {
+	if p == root {
+		return true
+	}
+
+	if !strings.HasSuffix(root, string(filepath.Separator)) {
+		root += string(filepath.Separator)
+	}
+
+	return strings.HasPrefix(p, root)
+}
+
+// resolve returns the path of filename below the root, with symbolic links
+// resolved. The last element of the path need not exist, so that new files
+// can be created.
+func (f *FileHandler) resolve(filename string) (string, error) {
+	name := filepath.FromSlash(filename)
+	if name == "" || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", os.ErrPermission
+	}
+
+	root, err := filepath.Abs(f.Root)
+	if err != nil {
+		return "", err
+	}
+
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", fileError(err)
+	}
+
+	// Join cleans the result, which collapses any ".." elements.
+	p := filepath.Join(root, name)
+	if p == root || !within(root, p) {
+		return "", os.ErrPermission
+	}
+
+	// Resolve the symbolic links in the directory, and in the file itself if
+	// it exists.
+	dir, err := filepath.EvalSymlinks(filepath.Dir(p))
+	if err != nil {
+		return "", fileError(err)
+	}
+
+	p = filepath.Join(dir, filepath.Base(p))
+	if fi, err := os.Lstat(p); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		p, err = filepath.EvalSymlinks(p)
+		if err != nil {
+			return "", fileError(err)
+		}
+	}
+
+	if !within(root, p) {
+		return "", os.ErrPermission
+	}
+
+	return p, nil
+}
+
+func (f *FileHandler) ReadFile(ctx context.Context, peer net.Addr, filename string) (ReadCloser, error) {
+	p, err := f.resolve(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(p)
+	if err != nil {
+		return nil, fileError(err)
+	}
+
+	// Directories cannot be transferred.
+	fi, err := file.Stat()
+	if err != nil || fi.IsDir() {
+		_ = file.Close()
+		return nil, os.ErrNotExist
+	}
+
+	return file, nil
+}
+
+func (f *FileHandler) WriteFile(ctx context.Context, peer net.Addr, filename string) (WriteCloser, error) {
+	p, err := f.resolve(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	// The file is checked for up front, so that the peer is told before any
+	// data is transferred. It is checked again when the file is put in place.
+	if !f.AllowOverwrite {
+		if _, err := os.Lstat(p); err == nil {
+			return nil, os.ErrExist
+		}
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(p), "."+filepath.Base(p)+".")
+	if err != nil {
+		return nil, fileError(err)
+	}
+
+	return &pendingFile{File: file, path: p, overwrite: f.AllowOverwrite}, nil
+}
+
+// pendingFile is a temporary file that is moved to path when it is closed,
+// or removed when it is aborted.
+type pendingFile struct {
+	*os.File
+	path      string
+	overwrite bool // Whether an existing file at path is replaced.
+}
+
+func (f *pendingFile) Close() error {
+	err := f.File.Close()
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = f.move()
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	return nil
+}
+
+// move moves the temporary file to path. Without overwrite, it is linked
+// instead of renamed, which fails if a file was created at path in the
+// meantime.
+func (f *pendingFile) move() error {
+	if f.overwrite {
+		return os.Rename(f.Name(), f.path)
+	}
+
+	if err := os.Link(f.Name(), f.path); err != nil {
+		return fileError(err)
+	}
+
+	return os.Remove(f.Name())
+}
+
+func (f *pendingFile) Abort(err error) error {
+	_ = f.File.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,186 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestFileServer returns a FileServer for a temporary directory that
+// contains a file, a subdirectory and symbolic links to a file inside and
+// outside of the directory.
+func newTestFileServer(t *testing.T) (Handler, string) {
+	tmp, err := ioutil.TempDir("", "gotftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := filepath.Join(tmp, "root")
+	for _, dir := range []string{root, filepath.Join(root, "dir")} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, data := range map[string]string{
+		filepath.Join(tmp, "secret"):      "secret",
+		filepath.Join(root, "file"):       "file",
+		filepath.Join(root, "dir", "sub"): "sub",
+	} {
+		if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	links := map[string]string{
+		filepath.Join(root, "inside"):  "file",
+		filepath.Join(root, "outside"): filepath.Join(tmp, "secret"),
+		filepath.Join(root, "escape"):  tmp,
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return FileServer(root), tmp
+}
+
+func TestFileServerReadFile(t *testing.T) {
+	h, tmp := newTestFileServer(t)
+	defer os.RemoveAll(tmp)
+
+	var tests = []struct {
+		filename string
+		data     string
+		err      error
+	}{
+		{filename: "file", data: "file"},
+		{filename: "dir/sub", data: "sub"},
+		{filename: "dir/../file", data: "file"},
+		{filename: "inside", data: "file"},
+		{filename: "missing", err: os.ErrNotExist},
+		{filename: "dir", err: os.ErrNotExist},
+		{filename: "../secret", err: os.ErrPermission},
+		{filename: "dir/../../secret", err: os.ErrPermission},
+		{filename: "/etc/passwd", err: os.ErrPermission},
+		{filename: "outside", err: os.ErrPermission},
+		{filename: "escape/secret", err: os.ErrPermission},
+		{filename: "", err: os.ErrPermission},
+	}
+
+	for _, test := range tests {
+		rc, err := h.ReadFile(context.Background(), ZeroConn.RemoteAddr(), test.filename)
+		if !assert.Equal(t, test.err, err, test.filename) || err != nil {
+			continue
+		}
+
+		data, err := ioutil.ReadAll(rc)
+		assert.Nil(t, err)
+		assert.Equal(t, test.data, string(data), test.filename)
+		assert.Nil(t, rc.Close())
+	}
+}
+
+func TestFileServerWriteFile(t *testing.T) {
+	h, tmp := newTestFileServer(t)
+	defer os.RemoveAll(tmp)
+
+	wc, err := h.WriteFile(context.Background(), ZeroConn.RemoteAddr(), "dir/new")
+	if assert.Nil(t, err) {
+		_, err = wc.Write([]byte("new"))
+		assert.Nil(t, err)
+		assert.Nil(t, wc.Close())
+
+		data, err := ioutil.ReadFile(filepath.Join(tmp, "root", "dir", "new"))
+		assert.Nil(t, err)
+		assert.Equal(t, "new", string(data))
+	}
+
+	// An aborted write leaves neither the file nor a temporary file behind.
+	wc, err = h.WriteFile(context.Background(), ZeroConn.RemoteAddr(), "dir/aborted")
+	if assert.Nil(t, err) {
+		_, err = wc.Write([]byte("partial"))
+		assert.Nil(t, err)
+		assert.Nil(t, wc.(Aborter).Abort(ErrTimeout))
+
+		entries, err := ioutil.ReadDir(filepath.Join(tmp, "root", "dir"))
+		assert.Nil(t, err)
+
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		assert.Equal(t, []string{"new", "sub"}, names)
+	}
+
+	for _, filename := range []string{"../new", "/tmp/new", "outside", "escape/new"} {
+		_, err := h.WriteFile(context.Background(), ZeroConn.RemoteAddr(), filename)
+		assert.Equal(t, os.ErrPermission, err, filename)
+	}
+
+	// Nothing was written outside of the root.
+	data, err := ioutil.ReadFile(filepath.Join(tmp, "secret"))
+	assert.Nil(t, err)
+	assert.Equal(t, "secret", string(data))
+
+	_, err = os.Stat(filepath.Join(tmp, "new"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFileServerNoOverwrite(t *testing.T) {
+	h, tmp := newTestFileServer(t)
+	defer os.RemoveAll(tmp)
+
+	h.(*FileHandler).AllowOverwrite = false
+
+	_, err := h.WriteFile(context.Background(), ZeroConn.RemoteAddr(), "file")
+	assert.Equal(t, os.ErrExist, err)
+
+	// A file that is created while the transfer is in progress is not
+	// overwritten either.
+	wc, err := h.WriteFile(context.Background(), ZeroConn.RemoteAddr(), "new")
+	if assert.Nil(t, err) {
+		_, err = wc.Write([]byte("new"))
+		assert.Nil(t, err)
+
+		p := filepath.Join(tmp, "root", "new")
+		assert.Nil(t, ioutil.WriteFile(p, []byte("other"), 0644))
+		assert.Equal(t, os.ErrExist, wc.Close())
+
+		data, err := ioutil.ReadFile(p)
+		assert.Nil(t, err)
+		assert.Equal(t, "other", string(data))
+	}
+
+	wc, err = h.WriteFile(context.Background(), ZeroConn.RemoteAddr(), "dir/new")
+	if assert.Nil(t, err) {
+		_, err = wc.Write([]byte("new"))
+		assert.Nil(t, err)
+		assert.Nil(t, wc.Close())
+
+		data, err := ioutil.ReadFile(filepath.Join(tmp, "root", "dir", "new"))
+		assert.Nil(t, err)
+		assert.Equal(t, "new", string(data))
+	}
+}
@@ -0,0 +1,60 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"context"
+	"io/fs"
+	"net"
+	"os"
+)
+
+type fsHandler struct {
+	fsys fs.FS
+}
+
+// FS returns a read-only Handler that serves read requests from the file
+// system fsys, such as an embed.FS or the result of os.DirFS. Filenames must
+// be valid fs.FS paths, so they are unrooted and slash-separated. Write
+// requests are denied with os.ErrPermission.
+func FS(fsys fs.FS) Handler {
+	return fsHandler{fsys: fsys}
+}
+
+func (h fsHandler) ReadFile(ctx context.Context, peer net.Addr, filename string) (ReadCloser, error) {
+	if !fs.ValidPath(filename) {
+		return nil, os.ErrNotExist
+	}
+
+	f, err := h.fsys.Open(filename)
+	if err != nil {
+		return nil, fileError(err)
+	}
+
+	// Directories cannot be transferred.
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		_ = f.Close()
+		return nil, os.ErrNotExist
+	}
+
+	return f, nil
+}
+
+func (h fsHandler) WriteFile(ctx context.Context, peer net.Addr, filename string) (WriteCloser, error) {
+	return nil, os.ErrPermission
+}
@@ -0,0 +1,89 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFSReadFile(t *testing.T) {
+	h := FS(fstest.MapFS{
+		"file":    {Data: []byte("file")},
+		"dir/sub": {Data: []byte("sub")},
+	})
+
+	var tests = []struct {
+		filename string
+		data     string
+		err      error
+	}{
+		{filename: "file", data: "file"},
+		{filename: "dir/sub", data: "sub"},
+		{filename: "missing", err: os.ErrNotExist},
+		{filename: "dir", err: os.ErrNotExist},
+		{filename: ".", err: os.ErrNotExist},
+		{filename: "../file", err: os.ErrNotExist},
+		{filename: "/file", err: os.ErrNotExist},
+		{filename: "dir/../file", err: os.ErrNotExist},
+		{filename: "", err: os.ErrNotExist},
+	}
+
+	for _, test := range tests {
+		rc, err := h.ReadFile(context.Background(), ZeroConn.RemoteAddr(), test.filename)
+		if !assert.Equal(t, test.err, err, test.filename) || err != nil {
+			continue
+		}
+
+		data, err := ioutil.ReadAll(rc)
+		assert.Nil(t, err)
+		assert.Equal(t, test.data, string(data), test.filename)
+		assert.Nil(t, rc.Close())
+	}
+}
+
+func TestFSWriteFile(t *testing.T) {
+	h := FS(fstest.MapFS{"file": {Data: []byte("file")}})
+
+	_, err := h.WriteFile(context.Background(), ZeroConn.RemoteAddr(), "file")
+	assert.Equal(t, os.ErrPermission, err)
+}
+
+func TestFSTsize(t *testing.T) {
+	h := newHandlerContext()
+	rc, err := FS(fstest.MapFS{"file": {Data: []byte("0123456789")}}).
+		ReadFile(context.Background(), ZeroConn.RemoteAddr(), "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Files of an fstest.MapFS are seekable, so their size is known.
+	h.SetReadCloser(rc)
+	h.Negotiate(t, map[string]string{"tsize": "10"})
+
+	pdata := <-h.rcv
+	assert.Equal(t, &packetDATA{blockNr: 1, data: []byte("0123456789")}, pdata)
+	h.snd <- &packetACK{blockNr: 1}
+
+	// End dallying after the final ACK.
+	h.snd <- ErrTimeout
+}
@@ -0,0 +1,74 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"net"
+	"os"
+)
+
+// Gunzip returns middleware that serves the decompressed contents of
+// filename+".gz" for a read request of filename that doesn't exist, so that
+// files can be stored compressed. The file is decompressed as it is sent.
+// Since its decompressed size is not known up front, the tsize option is not
+// reported for it. A request that names the compressed file is served as is,
+// and write requests are passed through.
+func Gunzip(h Handler) Handler {
+	return HandlerFuncs{
+		Read: func(ctx context.Context, peer net.Addr, filename string) (ReadCloser, error) {
+			rc, err := h.ReadFile(ctx, peer, filename)
+			if !errors.Is(err, os.ErrNotExist) {
+				return rc, err
+			}
+
+			gzrc, gzerr := h.ReadFile(ctx, peer, filename+".gz")
+			if gzerr != nil {
+				// The error for the requested file is the relevant one.
+				return nil, err
+			}
+
+			zr, gzerr := gzip.NewReader(gzrc)
+			if gzerr != nil {
+				_ = gzrc.Close()
+				return nil, gzerr
+			}
+
+			return &gzipReader{Reader: zr, rc: gzrc}, nil
+		},
+		Write: h.WriteFile,
+	}
+}
+
+// gzipReader is the ReadCloser for a file served by Gunzip. It deliberately
+// hides the io.Seeker and Sizer of the compressed file, which would report
+// the compressed size.
+type gzipReader struct {
+	*gzip.Reader
+	rc ReadCloser
+}
+
+func (r *gzipReader) Close() error {
+	err := r.Reader.Close()
+	if cerr := r.rc.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
@@ -0,0 +1,89 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func gzipData(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestGunzip(t *testing.T) {
+	image := bytes.Repeat([]byte("firmware"), 1000)
+	compressed := gzipData(t, image)
+
+	h := Chain(FS(fstest.MapFS{
+		"image.gz": {Data: compressed},
+		"plain":    {Data: []byte("plain")},
+		"plain.gz": {Data: gzipData(t, []byte("other"))},
+		"bad.gz":   {Data: []byte("this is not a gzip file")},
+	}), Gunzip)
+
+	var tests = []struct {
+		filename string
+		data     []byte
+		size     bool // Whether the size of the ReadCloser is known.
+	}{
+		{filename: "image", data: image},
+		{filename: "image.gz", data: compressed, size: true},
+		// An existing file takes precedence over its compressed version.
+		{filename: "plain", data: []byte("plain"), size: true},
+	}
+
+	for _, test := range tests {
+		rc, err := h.ReadFile(context.Background(), nil, test.filename)
+		if !assert.Nil(t, err, test.filename) {
+			continue
+		}
+
+		_, ok := size(rc)
+		assert.Equal(t, test.size, ok, test.filename)
+
+		data, err := ioutil.ReadAll(rc)
+		assert.Nil(t, err)
+		assert.Equal(t, test.data, data, test.filename)
+		assert.Nil(t, rc.Close())
+	}
+
+	_, err := h.ReadFile(context.Background(), nil, "missing")
+	assert.Equal(t, os.ErrNotExist, err)
+
+	_, err = h.ReadFile(context.Background(), nil, "bad")
+	assert.Equal(t, gzip.ErrHeader, err)
+
+	_, err = h.WriteFile(context.Background(), nil, "image")
+	assert.Equal(t, os.ErrPermission, err)
+}
@@ -17,24 +17,130 @@ limitations under the License.
 package gotftp
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"hash"
 	"io"
+	"math/rand"
 	"net"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 )
 
 // ReadCloser is what the Handler needs to implement to serve TFTP read requests.
+//
+// A ReadCloser can optionally implement io.Seeker, in which case the size of
+// the file is reported through the tsize option (RFC 2349). The transfer
+// starts at the current offset of the ReadCloser, so a Handler can resume an
+// interrupted download by seeking to the offset where it stopped, as reported
+// by Stats.Offset. Without io.Seeker, the file is read from where the
+// ReadCloser is, and tsize is only reported if the ReadCloser implements
+// Sizer.
 type ReadCloser interface {
 	io.ReadCloser
 }
 
+// Sizer can optionally be implemented by a ReadCloser that knows how many
+// bytes it will return without being an io.Seeker, such as the body of an
+// HTTP response with a Content-Length. The size is reported through the
+// tsize option (RFC 2349), and takes precedence over the size determined
+// through io.Seeker. If Size returns an error, tsize is not reported.
+type Sizer interface {
+	Size() (int64, error)
+}
+
+// BlockReader can optionally be implemented by a ReadCloser that holds the
+// file in memory, such as a memory-mapped file, to send its blocks without
+// copying them into a buffer first. ReadBlock returns the n bytes of the file
+// at offset off, or fewer at the end of the file, which may be none. The
+// returned slice is sent as is, so it must remain valid and unchanged until
+// the ReadCloser is closed. The transfer starts at the offset of the
+// ReadCloser as it would without BlockReader, and Read is not called.
+type BlockReader interface {
+	ReadBlock(off int64, n int) ([]byte, error)
+}
+
+// ContentKeyer can optionally be implemented by a ReadCloser to identify its
+// content for the multicast option (RFC 2090). Read requests for the same
+// filename only share a multicast group if ContentKey returns the same key
+// for their ReadClosers. Without ContentKeyer, they share a group if their
+// files have the same size and, for a ReadCloser with a Stat method such as
+// an *os.File, the same modification time.
+type ContentKeyer interface {
+	ContentKey() string
+}
+
 // WriteCloser is what the Handler needs to implement to serve TFTP write requests.
 type WriteCloser interface {
 	io.WriteCloser
 }
 
+// Allocator can optionally be implemented by a WriteCloser to be told the
+// size of the file the peer is about to write, as announced through the tsize
+// option (RFC 2349). It is called before any data is transferred. Returning
+// an error rejects the transfer with a "disk full" error.
+type Allocator interface {
+	Allocate(size int64) error
+}
+
+// Aborter can optionally be implemented by a WriteCloser to be told that a
+// write request did not complete, for example because the peer stopped
+// responding or sent an error. Abort is called instead of Close, with the
+// error that ended the transfer, so that the partially written file can be
+// discarded. A WriteCloser that does not implement Aborter is closed.
+type Aborter interface {
+	Abort(err error) error
+}
+
+// Flusher can optionally be implemented by a WriteCloser that buffers what is
+// written to it, such as one wrapping a bufio.Writer. Flush is called once the
+// final block of a write request was written, before it is acknowledged, so
+// that the peer is only told that the transfer succeeded once the buffer made
+// it to the file. An error fails the transfer with a "disk full or allocation
+// exceeded" error, and the WriteCloser is aborted rather than closed.
+type Flusher interface {
+	Flush() error
+}
+
+// Syncer can optionally be implemented by a WriteCloser that can commit what
+// was written to it to stable storage, such as an *os.File. Sync is called
+// like Flush, after it, and an error fails the transfer in the same way.
+type Syncer interface {
+	Sync() error
+}
+
+// NegotiatedOptions are the parameters of a transfer, as negotiated with the
+// peer or set by default.
+type NegotiatedOptions struct {
+	Blksize    int           // The payload size per data packet.
+	Timeout    time.Duration // The time before a retransmit takes place.
+	Windowsize int           // The number of data packets sent before waiting for an ACK.
+	Tsize      int64         // The transfer size, or -1 if unknown.
+}
+
+// OptionsReceiver can optionally be implemented by a ReadCloser or
+// WriteCloser to be told the parameters of the transfer. SetOptions is called
+// before any data is transferred, and after the peer acknowledged the options
+// of a read request. It is called whether or not options were negotiated.
+type OptionsReceiver interface {
+	SetOptions(o NegotiatedOptions)
+}
+
+// OptionsNegotiator can optionally be implemented by a Handler to have the
+// final say over the options of a request (RFC 2347). NegotiateOptions is
+// called after ReadFile or WriteFile with the options the server is about to
+// acknowledge, after bounds were applied, and returns the subset to
+// acknowledge. Values cannot be changed; an option that is left out is
+// declined, so that its default applies. Returning an error rejects the
+// request with an "option negotiation" error. It is also called for requests
+// without options, so that a Handler can require an option to be present.
+type OptionsNegotiator interface {
+	NegotiateOptions(ctx context.Context, peer net.Addr, filename string, write bool, options map[string]string) (map[string]string, error)
+}
+
 // Conn provides context about the current "connection".
 type Conn interface {
 	LocalAddr() net.Addr
@@ -43,27 +149,170 @@ type Conn interface {
 
 // Handler is the interface a consumer of this library needs to implement to be
 // able to serve TFTP requests.
+//
+// The context passed to ReadFile and WriteFile is cancelled when the session
+// ends, either because the transfer completed, failed, or because the server
+// was shut down. It also carries the Conn of the session, see ConnFromContext.
+//
+// Filenames have no defined encoding in TFTP. The filename passed to ReadFile
+// and WriteFile holds the bytes of the request as is, without decoding them,
+// so it need not be valid UTF-8; converting it to a []byte recovers them
+// exactly. A Handler for a file system with another encoding, such as
+// Latin-1, can map them accordingly. See also RequestFilename. A request with
+// an empty filename is rejected as an "access violation" (2) without calling
+// the Handler, so the filename is never "".
+//
+// An error returned by ReadFile or WriteFile is reported to the peer with
+// the TFTP error code that matches it according to errors.Is: os.ErrNotExist
+// as "file not found" (1), os.ErrPermission as "access violation" (2) and
+// os.ErrExist as "file already exists" (6). Any other error is reported as
+// "not defined" (0), as is a nil ReadCloser or WriteCloser without an error.
+// The message of the error packet is the text of the error. A WriteFile that
+// can't tell whether the file can be written yet may defer the error to
+// Write, where any error is reported as "disk full or allocation exceeded"
+// (3) and aborts the transfer.
 type Handler interface {
-	ReadFile(c Conn, filename string) (ReadCloser, error)
-	WriteFile(c Conn, filename string) (WriteCloser, error)
+	ReadFile(ctx context.Context, peer net.Addr, filename string) (ReadCloser, error)
+	WriteFile(ctx context.Context, peer net.Addr, filename string) (WriteCloser, error)
+}
+
+type contextKey struct {
+	name string
+}
+
+// connContextKey is the context key for the Conn of a session.
+var connContextKey = contextKey{"conn"}
+
+// ConnFromContext returns the Conn of the session that ctx belongs to.
+func ConnFromContext(ctx context.Context) (Conn, bool) {
+	c, ok := ctx.Value(connContextKey).(Conn)
+	return c, ok
+}
+
+// filenameContextKey is the context key for the filename of the request that
+// started a session.
+var filenameContextKey = contextKey{"filename"}
+
+// RequestFilename returns the filename of the request that started the session
+// ctx belongs to, as the raw bytes the peer sent, before they were passed to
+// Server.RewriteFilename. The bytes are not decoded in any way.
+func RequestFilename(ctx context.Context) ([]byte, bool) {
+	filename, ok := ctx.Value(filenameContextKey).(string)
+	if !ok {
+		return nil, false
+	}
+
+	return []byte(filename), true
+}
+
+// PeerAddrFromContext returns the address of the peer of the session that ctx
+// belongs to.
+func PeerAddrFromContext(ctx context.Context) (net.Addr, bool) {
+	c, ok := ConnFromContext(ctx)
+	if !ok {
+		return nil, false
+	}
+
+	return c.RemoteAddr(), true
 }
 
 // ErrTimeout is returned by the packetReader when it times out reading a packet.
+// A session that times out ends with a *RetriesExhaustedError, for which
+// errors.Is(err, ErrTimeout) reports true.
 var ErrTimeout = errors.New("timeout")
 
+// Backoff returns the time to wait for a reply to a packet before it is
+// retransmitted, given the negotiated timeout and the number of times the
+// packet has been retransmitted so far. The count starts at 0 for every new
+// packet.
+type Backoff func(timeout time.Duration, retry int) time.Duration
+
+// ExponentialBackoff returns a Backoff that doubles the timeout with every
+// retransmission of a packet, up to a maximum of max.
+func ExponentialBackoff(max time.Duration) Backoff {
+	return func(timeout time.Duration, retry int) time.Duration {
+		for ; retry > 0 && timeout < max; retry-- {
+			timeout *= 2
+		}
+
+		if timeout > max {
+			timeout = max
+		}
+
+		return timeout
+	}
+}
+
+// Jitter returns a Backoff that randomly lengthens or shortens the time
+// returned by b by up to fraction of it, so that peers that lose packets at
+// the same time don't retransmit in lockstep. If b is nil, the negotiated
+// timeout is randomized. The random numbers are drawn from src, which may be
+// seeded to make the jitter deterministic. If src is nil, a source seeded
+// with the current time is used.
+func Jitter(b Backoff, fraction float64, src rand.Source) Backoff {
+	if src == nil {
+		src = rand.NewSource(time.Now().UnixNano())
+	}
+
+	// A rand.Rand is not safe for concurrent use, but the Backoff is shared
+	// by all sessions.
+	var mu sync.Mutex
+	r := rand.New(src)
+
+	return func(timeout time.Duration, retry int) time.Duration {
+		if b != nil {
+			timeout = b(timeout, retry)
+		}
+
+		mu.Lock()
+		f := 2*r.Float64() - 1
+		mu.Unlock()
+
+		return timeout + time.Duration(f*fraction*float64(timeout))
+	}
+}
+
+var (
+	errModeMail   = errors.New("mail mode not supported")
+	errRollover   = errors.New("invalid rollover")
+	errNotRequest = errors.New("not a request")
+	errBlockSize  = errors.New("block larger than blksize")
+	errFileSize   = errors.New("file too large")
+	errNoReads    = errors.New("read requests not allowed")
+	errNoWrites   = errors.New("write requests not allowed")
+	errIdle       = errors.New("idle timeout")
+	errFutureACK  = errors.New("ACK for a block that was not sent")
+	errNoFile     = errors.New("no file")
+	errNoFilename = errors.New("no filename")
+)
+
 // packetReader is the interface that describes the function used for reading
 // packets. The read function returns an error when it times out (ErrTimeout)
-// or cannot deserialize a packet. In the latter case, the error is propagates
-// from the routines responsible for deserialization.
+// or cannot deserialize a packet. In the latter case, the error is a
+// *MalformedPacketError that wraps the error of the routines responsible for
+// deserialization.
 type packetReader interface {
 	read(time.Duration) (x packet, err error)
 }
 
 // packetWriter is the interface that describes the function used for writing packets.
+//
+// A *packetDATA passed to write is left untouched until the peer has
+// acknowledged it, since it may have to be retransmitted. After that, both the
+// packet and its payload buffer are reused for a later block, which changes
+// its blockNr and data. A packetWriter that holds on to a DATA packet for
+// longer, for example to log it, must copy the fields it needs.
 type packetWriter interface {
 	write(x packet) error
 }
 
+// datagramSizer can optionally be implemented by a packetWriter whose socket
+// limits the size of the datagrams it can send. maxDatagram returns the limit
+// in bytes, if it is known.
+type datagramSizer interface {
+	maxDatagram() (int, bool)
+}
+
 // packetValidator is type of the function that gets called from the function
 // that writes a packet and waits for an acknowledgement from its peer.
 type packetValidator func(p packet) bool
@@ -74,66 +323,296 @@ type session struct {
 	packetReader
 	packetWriter
 
-	h       Handler
-	c       Conn
-	blksize int // The payload size per data packet.
-	timeout int // The number of seconds before a retransmit takes place.
+	ctx           context.Context
+	h             Handler
+	c             Conn
+	logger        Logger
+	report        func(Stats)
+	acceptBlksize func(requested int) (accepted int, ok bool)
+	maxBlksize    int           // The ceiling for a negotiated blksize, if positive.
+	minTimeout    time.Duration // The floor for a negotiated timeout, if positive.
+	maxTimeout    time.Duration // The ceiling for a negotiated timeout, if positive.
+	maxWriteSize  int64         // The maximum size of a written file, if positive.
+	filename      string        // The filename of the request.
+	wrq           bool          // Whether the request is a write request.
+	bytes         int64         // The number of bytes transferred.
+	offset        int64         // The offset in the file where the transfer started.
+	blocks        int           // The number of data packets transferred.
+	retransmits   int           // The number of times a packet was retransmitted.
+	blksize       int           // The payload size per data packet.
+	timeout       time.Duration // The time before a retransmit takes place.
+	tsize         int64         // The transfer size from the tsize option, or -1 if unknown.
+	total         int64         // The size of the file as reported to progress, or -1 if unknown.
+	windowsize    int           // The number of data packets sent before waiting for an ACK.
+	prefetch      int           // The number of blocks buffered when reading.
+	retries       int           // The number of times a packet is retransmitted.
+	rollover      uint16        // The block number following block number 65535.
+	srv           *Server
+	multicast     bool // Whether the peer requested the multicast option.
+	backoff       Backoff
+	limiters      []*rateLimiter // The rate limits that DATA packets are paced by, the aggregate one last.
+	progress      *progress
+	clock         clock
+	idleTimeout   time.Duration // The maximum time without progress, if positive.
+	maxInterval   time.Duration // The maximum time between retransmissions, if positive.
+	tracer        Tracer
+	endSession    func(Span) // Ends the span of the session.
+	endPhase      func(Span) // Ends the span of the current phase, if any.
+	phaseName     string     // The name of the current phase.
+	progressed    time.Time  // The time the transfer last progressed.
+	seek          *offsetRequest
+	skip          int64      // The number of bytes skipped through SetOffset.
+	digest        hash.Hash  // The hash of the data transferred, if enabled.
+	netascii      bool       // Whether data is converted, in which case it's hashed by the converter.
+	pipeline      bool       // Whether the peer may pipeline another read request.
+	next          *packetRRQ // The read request that was pipelined, if any.
+	vars          *serverVars
+}
+
+// serve serves the session that starts with the request read from r, and
+// returns the error it failed with, if any. A session that ends with a
+// pipelined read request is followed by a session for that request, over the
+// same reader and writer.
+func (srv *Server) serve(c Conn, r packetReader, w packetWriter) error {
+	next, err := srv.serveSession(c, r, w)
+	for next != nil {
+		next, err = srv.serveSession(c, &pipelinedReader{packetReader: r, req: next}, w)
+	}
+
+	return err
 }
 
-func serve(c Conn, r packetReader, w packetWriter, h Handler) {
+// serveSession serves a single session, and returns the read request that
+// was pipelined after it, if any.
+func (srv *Server) serveSession(c Conn, r packetReader, w packetWriter) (*packetRRQ, error) {
+	if c == nil {
+		c = ZeroConn
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if srv.MaxTransferDuration > 0 {
+		ctx, cancel = context.WithTimeout(srv.baseContext(), srv.MaxTransferDuration)
+	} else {
+		ctx, cancel = context.WithCancel(srv.baseContext())
+	}
+	defer cancel()
+
+	clock := srv.timeSource()
+
+	limiter := newRateLimiter(srv.RateLimit)
+	progress := &progress{}
+	seek := &offsetRequest{}
+	ctx = context.WithValue(ctx, connContextKey, c)
+	ctx = context.WithValue(ctx, rateLimiterContextKey, limiter)
+	ctx = context.WithValue(ctx, progressContextKey, progress)
+	ctx = context.WithValue(ctx, offsetContextKey, seek)
+
 	s := &session{
 		packetReader: r,
 		packetWriter: w,
 
-		h:       h,
-		c:       c,
-		blksize: 512,
-		timeout: 3,
+		ctx:           ctx,
+		h:             srv.Handler,
+		c:             c,
+		logger:        srv.Logger,
+		report:        srv.Stats,
+		acceptBlksize: srv.AcceptBlksize,
+		maxBlksize:    srv.MaxBlksize,
+		minTimeout:    srv.MinTimeout,
+		maxTimeout:    srv.MaxTimeout,
+		maxWriteSize:  srv.MaxWriteSize,
+		srv:           srv,
+		backoff:       srv.Backoff,
+		limiters:      []*rateLimiter{limiter, srv.aggregateLimiter()},
+		progress:      progress,
+		seek:          seek,
+		clock:         clock,
+		idleTimeout:   srv.IdleTimeout,
+		maxInterval:   srv.MaxRetransmitInterval,
+		tracer:        srv.Tracer,
+		vars:          srv.expvars(),
+		progressed:    clock.Now(),
+		blksize:       srv.blksize(),
+		timeout:       srv.timeout(),
+		tsize:         -1,
+		total:         -1,
+		windowsize:    1,
+		prefetch:      srv.PrefetchDepth,
+		retries:       srv.Retries,
+	}
+
+	if s.retries < 0 {
+		s.retries = defaultRetries
+	}
+
+	if srv.Hash != nil {
+		s.digest = srv.Hash()
+	}
+
+	err := s.serve()
+	return s.next, err
+}
+
+// log sends event e to the Logger, if there is one.
+func (s *session) log(e Event) {
+	if s.logger == nil {
+		return
 	}
 
-	s.serve()
+	e.Peer = s.c.RemoteAddr()
+	e.Filename = s.filename
+	e.Write = s.wrq
+	s.logger.Log(e)
 }
 
+// writeError sends an error packet to the peer. Since the session is about to
+// end, a failure to do so is logged rather than handled by the caller.
 func (s *session) writeError(err tftpError, message string) error {
 	p := packetERROR{
 		errorCode:    err.Code,
 		errorMessage: message,
 	}
 
-	return s.write(&p)
+	werr := s.packetWriter.write(&p)
+	if werr != nil {
+		s.log(Event{Type: EventError, Err: werr})
+	}
+
+	return werr
+}
+
+// errorMessage returns the message of the error packet that reports err to
+// the peer with code.
+func (s *session) errorMessage(code tftpError, err error) string {
+	if s.srv != nil && s.srv.ErrorMessage != nil {
+		return s.srv.ErrorMessage(code.Code, err)
+	}
+
+	return err.Error()
+}
+
+// abort sends an error packet with code and the message of err to the peer,
+// and returns the *TransferError that the session ends with.
+func (s *session) abort(code tftpError, err error) error {
+	msg := s.errorMessage(code, err)
+	werr := s.writeError(code, msg)
+	return &TransferError{Code: code.Code, Message: msg, Err: err, WriteErr: werr}
 }
 
 // writeAndWaitForPacket sends the packet p to our peer and waits for it to
 // reply with a packet that can be validated by the packet validator v.
 //
 // If no valid reply if received before the configured timeout expires, packet
-// p will be sent again. The packet will be sent for a maximum of 3 times.
+// p will be sent again. The packet will be retransmitted for a maximum of
+// "retries" times.
 //
-// When a non-timeout error occurs when reading a reply, this function sends an
-// error packet with the error message back to the peer.
+// When a non-timeout error occurs when reading a reply, or when the context of
+// the session is cancelled, this function sends an error packet with the error
+// message back to the peer.
 func (s *session) writeAndWaitForPacket(p packet, v packetValidator) (packet, error) {
+	return s.writeWindowAndWaitForPacket([]packet{p}, v)
+}
+
+// writeWindowAndWaitForPacket is like writeAndWaitForPacket, but sends every
+// packet in ps before waiting for a reply. When the timeout expires, all
+// packets in ps are sent again.
+func (s *session) writeWindowAndWaitForPacket(ps []packet, v packetValidator) (packet, error) {
+	return s.exchange(ps, true, v)
+}
+
+// waitForPacket is like writeAndWaitForPacket, but p is only sent once the
+// timeout expires, since the peer is expected to send more packets first.
+func (s *session) waitForPacket(p packet, v packetValidator) (packet, error) {
+	return s.exchange([]packet{p}, false, v)
+}
+
+// exchange implements writeWindowAndWaitForPacket and waitForPacket. The
+// packets in ps are sent before the first attempt only if send is true.
+func (s *session) exchange(ps []packet, send bool, v packetValidator) (packet, error) {
 	var err error
 
-	for i := 0; i < 3; i++ {
-		err = s.write(p)
-		if err != nil {
-			return nil, err
+	for i := 0; i <= s.retries; i++ {
+		if err = s.ctx.Err(); err != nil {
+			return nil, s.abort(tftpErrNotDefined, err)
 		}
 
-		now := time.Now()
-		end := now.Add(time.Duration(s.timeout) * time.Second)
-		for ; now.Before(end); now = time.Now() {
-			timeout := end.Sub(now)
+		// The clock is read once per attempt, and only read again before the
+		// wait if pacing slept. The time it takes to write the packets is
+		// negligible next to the timeout.
+		now := s.clock.Now()
+		if s.idleTimeout > 0 && !now.Before(s.progressed.Add(s.idleTimeout)) {
+			return nil, s.abort(tftpErrNotDefined, errIdle)
+		}
 
-			p, err := s.read(timeout)
-			if err == ErrTimeout {
+		if i > 0 {
+			s.retransmits++
+			s.log(Event{Type: EventRetransmit})
+		}
+
+		paced := false
+		for _, p := range ps {
+			if i == 0 && !send {
 				break
 			}
 
+			// DATA packets are paced before the timeout starts, so that the
+			// time spent waiting for the rate limits doesn't count against it.
+			// Nor does it count as idle, since the peer can't make progress
+			// on a window that hasn't been sent yet.
+			if data, ok := p.(*packetDATA); ok {
+				d, err := s.pace(len(data.data))
+				if err != nil {
+					return nil, s.abort(tftpErrNotDefined, err)
+				}
+				if d > 0 {
+					s.progressed = s.progressed.Add(d)
+					paced = true
+				}
+			}
+
+			err = s.write(p)
 			if err != nil {
-				_ = s.writeError(tftpErrNotDefined, err.Error())
 				return nil, err
 			}
+		}
+
+		timeout := s.timeout
+		if s.backoff != nil {
+			timeout = s.backoff(timeout, i)
+			if max := s.maxInterval; max > 0 && timeout > max {
+				timeout = max
+				if timeout < s.timeout {
+					timeout = s.timeout
+				}
+			}
+		}
+
+		// The wait ends early when the session has been idle for too long.
+		if paced {
+			now = s.clock.Now()
+		}
+		end := now.Add(timeout)
+		if idle := s.progressed.Add(s.idleTimeout); s.idleTimeout > 0 && idle.Before(end) {
+			end = idle
+		}
+		for ; now.Before(end); now = s.clock.Now() {
+			p, err := s.read(end.Sub(now))
+			if err == ErrTimeout {
+				break
+			}
+
+			if err != nil {
+				return nil, s.abort(tftpErrNotDefined, err)
+			}
+
+			// The peer gave up on the transfer, so there is no point in
+			// retransmitting. An error packet is not answered (RFC 1350).
+			// This includes a peer that rejects an OACK with an "option
+			// negotiation" error (RFC 2347).
+			if perr, ok := p.(*packetERROR); ok {
+				return nil, peerError(perr)
+			}
 
 			// Check validity of packet
 			if v(p) {
@@ -142,70 +621,461 @@ func (s *session) writeAndWaitForPacket(p packet, v packetValidator) (packet, er
 		}
 	}
 
-	return nil, ErrTimeout
+	s.log(Event{Type: EventTimeout})
+	return nil, &RetriesExhaustedError{Retries: s.retries}
+}
+
+func (s *session) serve() error {
+	start := s.clock.Now()
+	s.vars.begin()
+	s.trace()
+	err := s.serveRequest()
+	s.endTrace(err)
+	s.vars.end(s.bytes, err)
+	s.log(Event{Type: EventComplete, Bytes: s.bytes, Err: err})
+
+	if s.report != nil {
+		s.report(s.stats(start, err))
+	}
+
+	if s.srv != nil && s.srv.OnClose != nil {
+		s.srv.OnClose(s.c.RemoteAddr(), s.filename, err)
+	}
+
+	return err
 }
 
-func (s *session) serve() {
+// serveRequest serves the request that started the session. It returns the
+// reason the session failed, if it did.
+func (s *session) serveRequest() error {
+	s.phase(SpanRequest)
+	if s.srv != nil && !s.srv.allowPeer(s.c.RemoteAddr()) {
+		return s.abort(tftpErrAccessViolation, errPeerDenied)
+	}
+
 	p, err := s.read(0)
 	if err != nil {
-		_ = s.writeError(tftpErrNotDefined, err.Error())
-		return
+		// The peer is told what is wrong with a malformed request, such as
+		// an unknown mode, a missing NUL terminator or an overlong filename,
+		// without repeating its own address back to it.
+		var merr *MalformedPacketError
+		if errors.As(err, &merr) {
+			code := tftpErrIllegalOperation
+			msg := s.errorMessage(code, merr.Err)
+			werr := s.writeError(code, msg)
+			return &TransferError{Code: code.Code, Message: msg, Err: err, WriteErr: werr}
+		}
+
+		return s.abort(tftpErrNotDefined, err)
 	}
 
 	switch px := p.(type) {
 	case *packetRRQ:
-		s.serveRRQ(px)
+		s.filename = px.filename
+		s.ctx = context.WithValue(s.ctx, filenameContextKey, px.filename)
+		s.log(Event{Type: EventRequest})
+		if err = s.checkRequest(&px.packetXRQ, s.srv != nil && s.srv.WriteOnly, errNoReads); err != nil {
+			return err
+		}
+		return s.serveRRQ(px)
 	case *packetWRQ:
-		s.serveWRQ(px)
+		s.filename, s.wrq = px.filename, true
+		s.ctx = context.WithValue(s.ctx, filenameContextKey, px.filename)
+		s.log(Event{Type: EventRequest})
+		if err = s.checkRequest(&px.packetXRQ, s.srv != nil && s.srv.ReadOnly, errNoWrites); err != nil {
+			return err
+		}
+		return s.serveWRQ(px)
 	default:
-		_ = s.writeError(tftpErrIllegalOperation, "")
+		return s.abort(tftpErrIllegalOperation, errNotRequest)
+	}
+}
+
+// checkRequest rejects request x before the Handler is called, if the server
+// doesn't serve it. If denied is true, requests of its kind are not served at
+// all, which is reported as deniedErr.
+func (s *session) checkRequest(x *packetXRQ, denied bool, deniedErr error) error {
+	// Mail mode is obsolete (RFC 1350) and not supported.
+	if x.mode == modeMAIL {
+		return s.abort(tftpErrIllegalOperation, errModeMail)
+	}
+	if denied {
+		return s.abort(tftpErrAccessViolation, deniedErr)
+	}
+	if x.filename == "" {
+		return s.abort(tftpErrAccessViolation, errNoFilename)
 	}
+	if err := s.checkOptions(x.options); err != nil {
+		return s.abort(tftpErrOptionNegotiation, err)
+	}
+
+	return nil
+}
+
+// checkOptions returns an error if the options o of the request exceed the
+// limits of the server. It is called before the Handler, so that a request
+// that is rejected for its options doesn't open a file. Without option
+// support, the options are ignored rather than checked.
+func (s *session) checkOptions(o map[string]string) error {
+	if s.srv != nil && s.srv.DisableOptions {
+		return nil
+	}
+
+	return s.srv.checkOptions(o)
+}
+
+// optionFunc negotiates an option of a request, given the value the peer
+// requested, and returns the value to acknowledge. If ok is false, the option
+// is omitted from the OACK, although it may still take effect, as tsize does.
+// An error rejects the request with an "option negotiation" error.
+type optionFunc func(s *session, requested string) (accepted string, ok bool, err error)
+
+// builtinOptions are the options that the server implements, in the order
+// they are negotiated. Options that override others come after them.
+var builtinOptions = []struct {
+	name      string
+	negotiate optionFunc
+}{
+	{"blksize", negotiateBlksize},
+	{"timeout", negotiateTimeout},
+	{"utimeout", negotiateUtimeout},
+	{"windowsize", negotiateWindowsize},
+	{"rollover", negotiateRollover},
+	{"tsize", negotiateTsize},
+	{"multicast", negotiateMulticast},
+	{"pipeline", negotiatePipeline},
+}
+
+// builtinOption returns whether the server implements option name.
+func builtinOption(name string) bool {
+	for _, opt := range builtinOptions {
+		if opt.name == name {
+			return true
+		}
+	}
+
+	return false
 }
 
 func (s *session) negotiate(o map[string]string) (map[string]string, error) {
 	oack := make(map[string]string)
 
-	blksize, ok := o["blksize"]
-	if ok {
-		i, err := strconv.Atoi(blksize)
+	// Without option support, every option is declined and no OACK is sent.
+	if s.srv != nil && s.srv.DisableOptions {
+		return oack, nil
+	}
+
+	// Unknown options are omitted from the OACK (RFC 2347), unless the server
+	// is configured to reject them.
+	if s.srv != nil && s.srv.StrictOptions {
+		for name := range o {
+			if !builtinOption(name) && s.srv.customOption(name) == nil {
+				return nil, fmt.Errorf("unknown option %q", name)
+			}
+		}
+	}
+
+	for _, opt := range builtinOptions {
+		requested, ok := o[opt.name]
+		if !ok {
+			continue
+		}
+
+		accepted, ok, err := opt.negotiate(s, requested)
 		if err != nil {
 			return nil, err
 		}
+		if ok {
+			oack[opt.name] = accepted
+		}
+	}
 
-		// Lower and upper bound from RFC 2348.
-		if i < 8 {
-			s.blksize = 8
-		} else if i > 65464 {
-			s.blksize = 65464
-		} else {
-			s.blksize = i
+	if err := s.negotiateCustom(o, oack); err != nil {
+		return nil, err
+	}
+
+	return oack, nil
+}
+
+func negotiateBlksize(s *session, requested string) (string, bool, error) {
+	i, err := strconv.Atoi(requested)
+	if err != nil {
+		return "", false, err
+	}
+
+	// The accepted size may not be larger than the requested size. A
+	// declined option is omitted from the OACK, so that the default block
+	// size is used.
+	if s.acceptBlksize != nil {
+		j, accept := s.acceptBlksize(i)
+		if !accept {
+			return "", false, nil
+		}
+		if j < i {
+			i = j
 		}
+	}
 
-		oack["blksize"] = strconv.Itoa(s.blksize)
+	// Upper bound from RFC 2348, lowered to the configured ceiling.
+	max := 65464
+	if s.maxBlksize > 0 && s.maxBlksize < max {
+		max = s.maxBlksize
+	}
+	if i > max {
+		i = max
 	}
 
-	timeout, ok := o["timeout"]
-	if ok {
-		i, err := strconv.Atoi(timeout)
-		if err != nil {
-			return nil, err
+	// A DATA packet must fit in a datagram that the socket can send, which
+	// some systems limit to the size of the send buffer, such as macOS with
+	// 9216 bytes by default. Otherwise, the transfer would only fail once the
+	// first block is sent.
+	if d, ok := s.packetWriter.(datagramSizer); ok {
+		if n, ok := d.maxDatagram(); ok && i+4 > n {
+			s.log(Event{
+				Type:    EventClamp,
+				Options: map[string]string{"blksize": strconv.Itoa(n - 4)},
+				Err:     fmt.Errorf("blksize %d exceeds the send buffer of %d bytes", i, n),
+			})
+			i = n - 4
 		}
+	}
 
-		// Lower and upper bound from RFC 2349.
-		if i < 1 {
-			s.timeout = 1
-		} else if i > 255 {
-			s.timeout = 255
-		} else {
-			s.timeout = i
+	// Lower bound from RFC 2348.
+	if i < 8 {
+		i = 8
+	}
+
+	s.blksize = i
+	return strconv.Itoa(s.blksize), true, nil
+}
+
+func negotiateTimeout(s *session, requested string) (string, bool, error) {
+	i, err := strconv.Atoi(requested)
+	if err != nil {
+		return "", false, err
+	}
+
+	// Lower and upper bound from RFC 2349.
+	i = s.clampTimeout(i, time.Second, 1, 255)
+
+	s.timeout = time.Duration(i) * time.Second
+	return strconv.Itoa(i), true, nil
+}
+
+// The utimeout option is not standardized, but implemented by clients that
+// need a timeout of less than a second. It is expressed in microseconds, and
+// takes precedence over the timeout option.
+func negotiateUtimeout(s *session, requested string) (string, bool, error) {
+	i, err := strconv.Atoi(requested)
+	if err != nil {
+		return "", false, err
+	}
+
+	// Lower and upper bound of 10 milliseconds and 255 seconds.
+	i = s.clampTimeout(i, time.Microsecond, 10000, 255000000)
+
+	s.timeout = time.Duration(i) * time.Microsecond
+	return strconv.Itoa(i), true, nil
+}
+
+// clampTimeout clamps timeout i, in units of unit, to the bounds configured for
+// the server, and then to the bounds lo and hi of the option.
+func (s *session) clampTimeout(i int, unit time.Duration, lo, hi int) int {
+	if s.minTimeout > 0 {
+		if min := int((s.minTimeout + unit - 1) / unit); i < min {
+			i = min
+		}
+	}
+
+	if s.maxTimeout > 0 {
+		if max := int(s.maxTimeout / unit); i > max {
+			i = max
+		}
+	}
+
+	if i < lo {
+		i = lo
+	} else if i > hi {
+		i = hi
+	}
+
+	return i
+}
+
+func negotiateWindowsize(s *session, requested string) (string, bool, error) {
+	i, err := strconv.Atoi(requested)
+	if err != nil {
+		return "", false, err
+	}
+
+	// Lower and upper bound from RFC 7440.
+	if i < 1 {
+		s.windowsize = 1
+	} else if i > 65535 {
+		s.windowsize = 65535
+	} else {
+		s.windowsize = i
+	}
+
+	return strconv.Itoa(s.windowsize), true, nil
+}
+
+// The rollover option is not standardized, but widely implemented.
+func negotiateRollover(s *session, requested string) (string, bool, error) {
+	switch requested {
+	case "0":
+		s.rollover = 0
+	case "1":
+		s.rollover = 1
+	default:
+		return "", false, errRollover
+	}
+
+	return requested, true, nil
+}
+
+// Whether or not tsize is included in the OACK is up to the caller, since the
+// value to return depends on the direction of the transfer.
+func negotiateTsize(s *session, requested string) (string, bool, error) {
+	i, err := strconv.ParseUint(requested, 10, 63)
+	if err != nil {
+		return "", false, err
+	}
+
+	s.tsize = int64(i)
+	return "", false, nil
+}
+
+// Whether the multicast option (RFC 2090) can be accepted depends on the file,
+// so it is up to the caller to include it in the OACK.
+func negotiateMulticast(s *session, requested string) (string, bool, error) {
+	if s.srv != nil && s.srv.MulticastAddr != nil {
+		s.multicast = true
+	}
+
+	return "", false, nil
+}
+
+// setOptions passes the parameters of the transfer to v, if it implements
+// OptionsReceiver.
+func (s *session) setOptions(v interface{}) {
+	if r, ok := v.(OptionsReceiver); ok {
+		r.SetOptions(NegotiatedOptions{
+			Blksize:    s.blksize,
+			Timeout:    s.timeout,
+			Windowsize: s.windowsize,
+			Tsize:      s.tsize,
+		})
+	}
+}
+
+// negotiateHandler passes options to the Handler, if it implements
+// OptionsNegotiator, and returns the options it accepted. The options it
+// declined are reverted to their defaults.
+func (s *session) negotiateHandler(options map[string]string) (map[string]string, error) {
+	n, ok := s.h.(OptionsNegotiator)
+	if !ok {
+		return options, nil
+	}
+
+	accepted, err := n.NegotiateOptions(s.ctx, s.c.RemoteAddr(), s.filename, s.wrq, options)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only options that were offered can be accepted, with the offered value.
+	oack := make(map[string]string)
+	for name, value := range options {
+		if _, ok := accepted[name]; ok {
+			oack[name] = value
+		}
+	}
+
+	if _, ok := oack["blksize"]; !ok {
+		s.blksize = s.srv.blksize()
+	}
+
+	// The timeout option applies if only utimeout was declined.
+	if _, ok := oack["utimeout"]; !ok {
+		s.timeout = s.srv.timeout()
+		if timeout, ok := oack["timeout"]; ok {
+			i, _ := strconv.Atoi(timeout)
+			s.timeout = time.Duration(i) * time.Second
 		}
+	}
+
+	if _, ok := oack["windowsize"]; !ok {
+		s.windowsize = 1
+	}
+
+	if _, ok := oack["rollover"]; !ok {
+		s.rollover = 0
+	}
 
-		oack["timeout"] = strconv.Itoa(s.timeout)
+	if _, ok := oack["tsize"]; !ok {
+		s.tsize = -1
+	}
+
+	if _, ok := oack["pipeline"]; !ok {
+		s.pipeline = false
 	}
 
 	return oack, nil
 }
 
+// declineOptions reverts the options of the session to the defaults of a
+// request without options (RFC 1350), for a peer that ignored the OACK.
+func (s *session) declineOptions() {
+	s.blksize = defaultBlksize
+	s.timeout = s.srv.timeout()
+	s.windowsize = 1
+	s.rollover = 0
+	s.tsize = -1
+	s.pipeline = false
+}
+
+// size returns the number of bytes that can still be read from r, if r
+// implements Sizer or io.Seeker. The offset of r is left unchanged.
+func size(r io.Reader) (int64, bool) {
+	if sizer, ok := r.(Sizer); ok {
+		n, err := sizer.Size()
+		return n, err == nil
+	}
+
+	seeker, ok := r.(io.Seeker)
+	if !ok {
+		return 0, false
+	}
+
+	cur, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, false
+	}
+
+	end, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, false
+	}
+
+	_, err = seeker.Seek(cur, io.SeekStart)
+	if err != nil {
+		return 0, false
+	}
+
+	return end - cur, true
+}
+
+// nextBlockNr returns the block number following blockNr. Block numbers wrap
+// around from 65535 to 0, or to 1 if negotiated through the rollover option,
+// so that files of any size can be transferred.
+func (s *session) nextBlockNr(blockNr uint16) uint16 {
+	if blockNr == 65535 {
+		return s.rollover
+	}
+
+	return blockNr + 1
+}
+
 func ackValidator(blockNr uint16) packetValidator {
 	return func(p packet) bool {
 		ack, ok := p.(*packetACK)
@@ -213,75 +1083,567 @@ func ackValidator(blockNr uint16) packetValidator {
 	}
 }
 
-func (s *session) serveRRQ(p *packetRRQ) {
-	rc, err := s.h.ReadFile(s.c, p.filename)
+// futureACK returns whether packet p acknowledges a block following the last
+// DATA packet in window, which the peer cannot have received. Only block
+// numbers up to half the range of block numbers ahead count as following, so
+// that a stale ACK from before a wraparound is not mistaken for one.
+func futureACK(window []*packetDATA, p packet) bool {
+	ack, ok := p.(*packetACK)
+	if !ok || len(window) == 0 {
+		return false
+	}
+
+	d := ack.blockNr - window[len(window)-1].blockNr
+	return d > 0 && d < 1<<15
+}
+
+// windowIndex returns the index of the DATA packet in window that is
+// acknowledged by packet p, or -1 if p doesn't acknowledge any of them. Block
+// numbers are compared as is, so that a window may span a wraparound.
+func windowIndex(window []*packetDATA, p packet) int {
+	ack, ok := p.(*packetACK)
+	if !ok {
+		return -1
+	}
+
+	for i, data := range window {
+		if data.blockNr == ack.blockNr {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// handlerError returns the TFTP error that reports err, as returned by
+// ReadFile or WriteFile, to the peer. See Handler.
+func handlerError(err error) tftpError {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return tftpErrNotFound
+	case errors.Is(err, os.ErrPermission):
+		return tftpErrAccessViolation
+	case errors.Is(err, os.ErrExist):
+		return tftpErrFileAlreadyExists
+	default:
+		return tftpErrNotDefined
+	}
+}
+
+// rewriteFilename returns the filename to pass to the Handler for the
+// requested filename, as determined by the RewriteFilename hook of the Server.
+func (s *session) rewriteFilename(filename string) (string, error) {
+	if s.srv == nil || s.srv.RewriteFilename == nil {
+		return filename, nil
+	}
+
+	filename, err := s.srv.RewriteFilename(s.c.RemoteAddr(), filename)
+	if err != nil {
+		return "", err
+	}
+
+	s.filename = filename
+	return filename, nil
+}
+
+func (s *session) serveRRQ(p *packetRRQ) error {
+	s.phase(SpanNegotiate)
+	filename, err := s.rewriteFilename(p.filename)
+	if err != nil {
+		return s.abort(tftpErrAccessViolation, err)
+	}
+
+	rc, err := s.h.ReadFile(s.ctx, s.c.RemoteAddr(), filename)
 	if err != nil {
-		switch err {
-		case os.ErrNotExist:
-			_ = s.writeError(tftpErrNotFound, err.Error())
-		case os.ErrPermission:
-			_ = s.writeError(tftpErrAccessViolation, err.Error())
-		default:
-			_ = s.writeError(tftpErrNotDefined, err.Error())
+		return s.abort(handlerError(err), err)
+	}
+	if rc == nil {
+		return s.abort(tftpErrNotDefined, errNoFile)
+	}
+
+	// A ReadCloser that was positioned by the Handler is sent from its
+	// current offset.
+	if seeker, ok := rc.(io.Seeker); ok {
+		if n, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			s.offset = n
 		}
-		return
+	}
+
+	// Conversion hides the optional interfaces of the ReadCloser.
+	receiver := rc
+
+	// The size of the converted data is not known up front, which means tsize
+	// is not reported in netascii mode.
+	if p.mode == modeNETASCII {
+		r := newNetasciiReader(rc)
+		if s.digest != nil {
+			r.hashTo(s.digest)
+		}
+		rc, s.netascii = r, true
 	}
 
 	defer func() {
-		// This is called from an anonymous function to make errcheck happy.
-		_ = rc.Close()
+		if err := rc.Close(); err != nil {
+			s.log(Event{Type: EventError, Err: err})
+		}
 	}()
 
+	options := make(map[string]string)
 	if len(p.options) > 0 {
-		options, err := s.negotiate(p.options)
+		options, err = s.negotiate(p.options)
 		if err != nil {
-			_ = s.writeError(tftpErrOptionNegotiation, err.Error())
-			return
+			return s.abort(tftpErrOptionNegotiation, err)
 		}
 
+		// The peer sends a tsize of 0 and expects the size of the file in return.
+		// If the size cannot be determined, the option is omitted from the OACK.
+		if s.tsize >= 0 {
+			s.tsize = -1
+			if n, ok := size(rc); ok {
+				s.tsize = n
+				options["tsize"] = strconv.FormatInt(n, 10)
+			}
+		}
+	}
+
+	options, err = s.negotiateHandler(options)
+	if err != nil {
+		return s.abort(tftpErrOptionNegotiation, err)
+	}
+
+	if err = s.seekOffset(rc, options); err != nil {
+		return s.abort(tftpErrOptionNegotiation, err)
+	}
+
+	// A multicast transfer needs random access to the file, since a new
+	// master client may ask for any block. Otherwise, the option is declined
+	// and the file is sent to the peer alone.
+	if s.multicast && s.skip == 0 {
+		if r, ok := rc.(io.ReaderAt); ok {
+			if n, ok := size(rc); ok {
+				s.pipeline = false
+				delete(options, "pipeline")
+				s.phase(SpanTransfer)
+				return s.serveMulticast(r, n, options)
+			}
+		}
+	}
+
+	if len(p.options) > 0 {
+		s.log(Event{Type: EventNegotiate, Options: options})
+	}
+
+	// Only send an OACK if at least one option was accepted (RFC 2347). The
+	// handshake is then RRQ, OACK, ACK 0, DATA 1, where the peer must
+	// acknowledge the OACK before DATA may be sent, which costs one round trip
+	// over a request without options. DATA 1 is sent as soon as ACK 0
+	// arrives. Without an OACK, DATA 1 is the reply to the RRQ.
+	if len(options) > 0 {
 		p := &packetOACK{options: options}
 		_, err = s.writeAndWaitForPacket(p, ackValidator(0))
 		if err != nil {
-			return
+			var rerr *RetriesExhaustedError
+			if !errors.As(err, &rerr) || s.srv == nil || !s.srv.LenientOACK || s.skip > 0 {
+				return err
+			}
+
+			// The peer may not understand the OACK, and wait for DATA 1 as
+			// if it hadn't requested any options.
+			s.log(Event{Type: EventError, Err: err})
+			s.declineOptions()
 		}
 	}
 
-	// Proceed to send the file
-	var buf = make([]byte, s.blksize)
+	s.setOptions(receiver)
+
+	// The size is reported to the ProgressFunc even if tsize was not
+	// negotiated, if it can be determined.
+	s.total = s.tsize
+	if n, ok := size(rc); ok && s.total < 0 {
+		s.total = n
+	}
+
+	s.phase(SpanTransfer)
+	last, err := s.send(rc)
+	if err != nil {
+		return err
+	}
+
+	s.dally(last, ackValidator(last.blockNr))
+	return nil
+}
+
+// send sends the contents of r as DATA packets and returns the final DATA
+// packet once it has been acknowledged. Up to "windowsize" DATA packets are
+// sent before waiting for an ACK (RFC 7440). An ACK for a block in the middle
+// of the window slides the window, after which sending resumes with the block
+// following the acknowledged one.
+func (s *session) send(r io.Reader) (*packetDATA, error) {
+	var window []*packetDATA // DATA packets that have not yet been acknowledged.
+	var free []*packetDATA   // DATA packets that have been acknowledged.
+	var last *packetDATA     // The DATA packet that was acknowledged last.
+	var ps []packet          // The window, as passed to writeWindowAndWaitForPacket.
 	var n int
 	var readErr, writeErr error
-	for blockNr := uint16(1); readErr == nil; blockNr++ {
-		// The semantics of ReadAtLeast are as follows:
-		//
-		// If == "blksize" bytes are read into buf, it will return with err == nil.
-		// If < "blksize" bytes are read into buf and an error occurs reading new
-		// bytes, it will return the number of bytes read and this error. If this
-		// error is io.EOF, it is rewritten to io.ErrUnexpectedEOF if > 0 bytes
-		// were already read.
-		n, readErr = io.ReadAtLeast(rc, buf, s.blksize)
-		switch readErr {
-		case nil:
-			// All is good.
-		case io.EOF, io.ErrUnexpectedEOF:
-			// Treat them as one and the same.
-			readErr = io.EOF
-		default:
-			_ = s.writeError(tftpErrNotDefined, readErr.Error())
-			return
+
+	// A BlockReader hands out its blocks as they are, so they are neither
+	// copied nor read ahead.
+	br, _ := r.(BlockReader)
+	off := s.offset
+
+	// Blocks are read ahead in the background, if so configured. The reader
+	// is stopped before returning, since the caller closes r.
+	if s.prefetch > 1 && br == nil {
+		p := newPrefetchReader(r, s.blksize, s.prefetch-1)
+		defer p.Close()
+		r = p
+	}
+
+	// The packets, buffers and validator are reused from one window to the
+	// next, so that sending a file doesn't allocate per block. An ACK for a
+	// block in the window is valid, and so is an ACK for a block that was
+	// not sent yet, which ends the transfer. Any other ACK is a duplicate of
+	// an earlier one, which is ignored.
+	v := func(p packet) bool {
+		return windowIndex(window, p) >= 0 || futureACK(window, p)
+	}
+
+	for blockNr := s.firstBlockNr(); readErr == nil || len(window) > 0; {
+		for ; readErr == nil && len(window) < s.windowsize; blockNr = s.nextBlockNr(blockNr) {
+			var p *packetDATA
+			if len(free) > 0 {
+				p, free = free[len(free)-1], free[:len(free)-1]
+			} else if br != nil {
+				p = &packetDATA{}
+			} else {
+				p = &packetDATA{data: make([]byte, s.blksize)}
+			}
+
+			if br != nil {
+				n, readErr = readBlock(br, p, off, s.blksize)
+				off += int64(n)
+			} else {
+				// The semantics of ReadAtLeast are as follows:
+				//
+				// If == "blksize" bytes are read into buf, it will return with err == nil.
+				// If < "blksize" bytes are read into buf and an error occurs reading new
+				// bytes, it will return the number of bytes read and this error. If this
+				// error is io.EOF, it is rewritten to io.ErrUnexpectedEOF if > 0 bytes
+				// were already read.
+				//
+				// An io.EOF that comes with the final "blksize" bytes is dropped, so
+				// a file that is a multiple of "blksize" ends with an empty block
+				// once the next read returns io.EOF again.
+				n, readErr = io.ReadAtLeast(r, p.data[:cap(p.data)], s.blksize)
+			}
+
+			switch readErr {
+			case nil, io.EOF, io.ErrUnexpectedEOF:
+				// All is good.
+			default:
+				return nil, s.abort(tftpErrNotDefined, readErr)
+			}
+
+			// The final block is the first one with less than "blksize"
+			// bytes, which is empty if the file is a multiple of "blksize"
+			// (RFC 1350). It is told by its length alone, so a full block
+			// is never final, even if io.EOF was reported along with it.
+			if n < s.blksize {
+				readErr = io.EOF
+			} else {
+				readErr = nil
+			}
+
+			p.blockNr = blockNr
+			p.data = p.data[:n]
+			window = append(window, p)
 		}
 
-		p := &packetDATA{
-			blockNr: blockNr,
-			data:    buf[:n],
+		// After an ACK for a block inside the window, the window continues
+		// with the block that follows it, so only the blocks the peer dropped
+		// are sent again, along with new ones to fill it up. Blocks up to the
+		// ACK are never resent, as the peer has them (RFC 7440).
+		ps = ps[:0]
+		for _, p := range window {
+			ps = append(ps, p)
 		}
 
-		_, writeErr = s.writeAndWaitForPacket(p, ackValidator(blockNr))
+		var px packet
+		px, writeErr = s.writeWindowAndWaitForPacket(ps, v)
 		if writeErr != nil {
+			return nil, writeErr
+		}
+
+		i := windowIndex(window, px)
+		if i < 0 {
+			return nil, s.abort(tftpErrIllegalOperation, errFutureACK)
+		}
+
+		// Release the acknowledged DATA packets, which are no longer
+		// retransmitted (see packetWriter). The final DATA packet is never
+		// reused, since nothing is read after it.
+		for _, p := range window[:i+1] {
+			s.transferred(p.data)
+			free = append(free, p)
+		}
+
+		// The transfer progresses whenever the lowest unacknowledged block
+		// advances, be it by a whole window or by part of one, so that a
+		// stuck window is aborted after IdleTimeout however large it is.
+		if s.idleTimeout > 0 {
+			s.progressed = s.clock.Now()
+		}
+		s.reportProgress()
+
+		last = window[i]
+		window = window[:copy(window, window[i+1:])]
+	}
+
+	return last, nil
+}
+
+// readBlock reads the block of size blksize at offset off of br into DATA
+// packet p. Like io.ReadAtLeast, it returns io.EOF if the block is short,
+// which makes it the final block.
+func readBlock(br BlockReader, p *packetDATA, off int64, blksize int) (int, error) {
+	data, err := br.ReadBlock(off, blksize)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+
+	if len(data) > blksize {
+		return 0, errBlockSize
+	}
+
+	p.data = data
+	if len(data) < blksize {
+		return len(data), io.EOF
+	}
+
+	return len(data), nil
+}
+
+// dally waits for one timeout period after a transfer has completed, and
+// sends packet p again in response to every duplicate of the final packet of
+// the transfer, as validated by the packet validator v. This gives a peer
+// that didn't see the end of the transfer a chance to complete it.
+func (s *session) dally(p packet, v packetValidator) {
+	now := s.clock.Now()
+	end := now.Add(s.timeout)
+	for ; now.Before(end); now = s.clock.Now() {
+		px, err := s.read(end.Sub(now))
+		if err != nil {
+			return
+		}
+
+		// A pipelined read request ends the session, so that the next one
+		// can serve it.
+		if rrq, ok := px.(*packetRRQ); ok && s.pipeline {
+			s.next = rrq
 			return
 		}
+
+		if v(px) {
+			if err = s.packetWriter.write(p); err != nil {
+				s.log(Event{Type: EventError, Err: err})
+				return
+			}
+		}
+	}
+}
+
+// dataValidator returns a validator for DATA packet blockNr. If written is
+// true, duplicates of the DATA packet that was written last are valid too.
+func dataValidator(blockNr, last uint16, written bool) packetValidator {
+	return func(p packet) bool {
+		data, ok := p.(*packetDATA)
+		return ok && (data.blockNr == blockNr || written && data.blockNr == last)
 	}
 }
 
-func (s *session) serveWRQ(p *packetWRQ) {
-	_ = s.writeError(tftpErrNotDefined, "not supported")
+// anyDataValidator accepts every DATA packet, so that a gap in a window of
+// DATA packets can be detected.
+func anyDataValidator(p packet) bool {
+	_, ok := p.(*packetDATA)
+	return ok
+}
+
+// commit flushes and syncs wc, if it implements Flusher and Syncer, once the
+// final block of a write request was written to it.
+func commit(wc WriteCloser) error {
+	if f, ok := wc.(Flusher); ok {
+		if err := f.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if sy, ok := wc.(Syncer); ok {
+		return sy.Sync()
+	}
+
+	return nil
+}
+
+func (s *session) serveWRQ(p *packetWRQ) (err error) {
+	s.phase(SpanNegotiate)
+	filename, err := s.rewriteFilename(p.filename)
+	if err != nil {
+		return s.abort(tftpErrAccessViolation, err)
+	}
+
+	wc, err := s.h.WriteFile(s.ctx, s.c.RemoteAddr(), filename)
+	if err != nil {
+		return s.abort(handlerError(err), err)
+	}
+	if wc == nil {
+		return s.abort(tftpErrNotDefined, errNoFile)
+	}
+
+	defer func() {
+		var cerr error
+		if a, ok := wc.(Aborter); ok && err != nil {
+			cerr = a.Abort(err)
+		} else {
+			cerr = wc.Close()
+		}
+		if cerr != nil {
+			s.log(Event{Type: EventError, Err: cerr})
+		}
+	}()
+
+	// The first DATA packet is solicited by either an OACK (if options were
+	// negotiated) or an ACK for block 0.
+	var reply packet = &packetACK{blockNr: 0}
+	options := make(map[string]string)
+	if len(p.options) > 0 {
+		options, err = s.negotiate(p.options)
+		if err != nil {
+			return s.abort(tftpErrOptionNegotiation, err)
+		}
+
+		// The peer sends the size of the file it is about to write, which is
+		// echoed back after giving the WriteCloser a chance to reject it.
+		if s.tsize >= 0 {
+			if s.maxWriteSize > 0 && s.tsize > s.maxWriteSize {
+				return s.abort(tftpErrDiskFull, errFileSize)
+			}
+
+			if a, ok := wc.(Allocator); ok {
+				err = a.Allocate(s.tsize)
+				if err != nil {
+					return s.abort(tftpErrDiskFull, err)
+				}
+			}
+
+			options["tsize"] = strconv.FormatInt(s.tsize, 10)
+		}
+	}
+
+	options, err = s.negotiateHandler(options)
+	if err != nil {
+		return s.abort(tftpErrOptionNegotiation, err)
+	}
+
+	if len(p.options) > 0 {
+		s.log(Event{Type: EventNegotiate, Options: options})
+	}
+
+	// Only send an OACK if at least one option was accepted (RFC 2347).
+	if len(options) > 0 {
+		reply = &packetOACK{options: options}
+	}
+
+	s.setOptions(wc)
+	s.total = s.tsize
+
+	// Conversion is set up after negotiation, so that an Allocator is told the
+	// size as announced by the peer.
+	if p.mode == modeNETASCII {
+		w := newNetasciiWriter(wc)
+		w.hash = s.digest
+		wc, s.netascii = w, true
+	}
+
+	s.phase(SpanTransfer)
+
+	// Proceed to receive the file. The peer sends up to "windowsize" DATA
+	// packets before it waits for an ACK (RFC 7440), which acknowledges the
+	// highest block received in order. When the timeout expires, the ACK is
+	// sent again so that the peer resumes after that block.
+	var last uint16  // The number of the DATA packet that was written last.
+	var written bool // Whether last is valid.
+	var pending int  // The number of blocks written since reply was sent.
+	send := true     // Whether reply is sent before waiting for a block.
+	for blockNr := uint16(1); ; {
+		v := dataValidator(blockNr, last, written)
+		if s.windowsize > 1 {
+			v = anyDataValidator
+		}
+
+		var px packet
+		if send {
+			px, err = s.writeAndWaitForPacket(reply, v)
+		} else {
+			px, err = s.waitForPacket(reply, v)
+		}
+		if err != nil {
+			return err
+		}
+		send = false
+
+		// A block can never be larger than the negotiated size.
+		pdata := px.(*packetDATA)
+		if len(pdata.data) > s.blksize {
+			return s.abort(tftpErrIllegalOperation, errBlockSize)
+		}
+
+		// A duplicate of the DATA packet that was written last means that its
+		// ACK was lost or delayed. The ACK is sent again, but the data must not
+		// be written again. Any other block out of order means that a block
+		// was lost, which is answered with an ACK for the last block received
+		// in order, so that the peer retransmits from there. The rest of the
+		// peer's window is on its way and ignored, so that the ACK is only sent
+		// once for every gap.
+		if pdata.blockNr != blockNr {
+			if written && pdata.blockNr == last || pending > 0 {
+				send, pending = true, 0
+			}
+			continue
+		}
+
+		// The announced size is not trusted, so the limit is enforced on the
+		// data as it is received.
+		data := pdata.data
+		if s.maxWriteSize > 0 && s.bytes+int64(len(data)) > s.maxWriteSize {
+			return s.abort(tftpErrDiskFull, errFileSize)
+		}
+
+		_, err = wc.Write(data)
+		if err != nil {
+			return s.abort(tftpErrDiskFull, err)
+		}
+
+		s.transferred(data)
+		s.progressed = s.clock.Now()
+		s.reportProgress()
+		last, written = blockNr, true
+		reply = &packetACK{blockNr: blockNr}
+		blockNr = s.nextBlockNr(blockNr)
+
+		// A DATA packet with less than "blksize" bytes signals the end of the
+		// transfer. The final ACK is not retransmitted; if it gets lost, the
+		// peer will time out waiting for it.
+		if len(data) < s.blksize {
+			if err = commit(wc); err != nil {
+				return s.abort(tftpErrDiskFull, err)
+			}
+			return s.packetWriter.write(reply)
+		}
+
+		// The last block of a window is acknowledged.
+		pending++
+		if pending == s.windowsize {
+			send, pending = true, 0
+		}
+	}
 }
@@ -18,9 +18,14 @@ package gotftp
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
+	"math/rand"
+	"net"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
 	"testing/iotest"
 	"time"
@@ -36,6 +41,14 @@ func (r *rcBuffer) Close() error {
 	return nil
 }
 
+type rcSeeker struct {
+	io.ReadSeeker
+}
+
+func (r *rcSeeker) Close() error {
+	return nil
+}
+
 type wcBuffer struct {
 	io.Writer
 }
@@ -48,17 +61,29 @@ type handlerContext struct {
 	snd chan interface{}
 	rcv chan packet
 
-	readFunc  func(c Conn, filename string) (ReadCloser, error)
-	writeFunc func(c Conn, filename string) (WriteCloser, error)
+	ctx       context.Context // The context passed to the Handler.
+	timeouts  []time.Duration // The timeouts passed to read.
+	readFunc  func(peer net.Addr, filename string) (ReadCloser, error)
+	writeFunc func(peer net.Addr, filename string) (WriteCloser, error)
 }
 
 func newHandlerContext() *handlerContext {
+	return newHandlerContextWith(func(_ *Server) {})
+}
+
+// newHandlerContextWith returns a handlerContext for a Server that is
+// configured by the function fn.
+func newHandlerContextWith(fn func(*Server)) *handlerContext {
 	h := &handlerContext{
 		snd: make(chan interface{}, 1),
 		rcv: make(chan packet, 1),
 	}
+
+	srv := NewServer(h)
+	fn(srv)
+
 	go func() {
-		serve(nil, h, h, h)
+		_ = srv.serve(nil, h, h)
 
 		// No more packets can be sent by the server.
 		close(h.rcv)
@@ -68,6 +93,8 @@ func newHandlerContext() *handlerContext {
 
 // To implement packetReader
 func (h *handlerContext) read(timeout time.Duration) (packet, error) {
+	h.timeouts = append(h.timeouts, timeout)
+
 	select {
 	case e, ok := <-h.snd:
 		if !ok {
@@ -79,6 +106,9 @@ func (h *handlerContext) read(timeout time.Duration) (packet, error) {
 			return t, nil
 		case error:
 			return nil, t
+		case func() (packet, error):
+			// Runs on the goroutine of the session, as the packet is read.
+			return t()
 		default:
 			panic("")
 		}
@@ -92,35 +122,37 @@ func (h *handlerContext) write(p packet) error {
 }
 
 // To implement Handler
-func (h *handlerContext) ReadFile(c Conn, filename string) (ReadCloser, error) {
+func (h *handlerContext) ReadFile(ctx context.Context, peer net.Addr, filename string) (ReadCloser, error) {
+	h.ctx = ctx
 	if h.readFunc == nil {
 		return &rcBuffer{&bytes.Buffer{}}, nil
 	}
-	return h.readFunc(c, filename)
+	return h.readFunc(peer, filename)
 }
 
 // To implement Handler
-func (h *handlerContext) WriteFile(c Conn, filename string) (WriteCloser, error) {
+func (h *handlerContext) WriteFile(ctx context.Context, peer net.Addr, filename string) (WriteCloser, error) {
+	h.ctx = ctx
 	if h.writeFunc == nil {
 		return &wcBuffer{&bytes.Buffer{}}, nil
 	}
-	return h.writeFunc(c, filename)
+	return h.writeFunc(peer, filename)
 }
 
 func (h *handlerContext) SetReadCloser(r ReadCloser) {
-	h.readFunc = func(_ Conn, _ string) (ReadCloser, error) {
+	h.readFunc = func(_ net.Addr, _ string) (ReadCloser, error) {
 		return r, nil
 	}
 }
 
 func (h *handlerContext) SetWriteCloser(w WriteCloser) {
-	h.writeFunc = func(_ Conn, _ string) (WriteCloser, error) {
+	h.writeFunc = func(_ net.Addr, _ string) (WriteCloser, error) {
 		return w, nil
 	}
 }
 
 func (h *handlerContext) Negotiate(t *testing.T, o map[string]string) {
-	h.snd <- &packetRRQ{packetXRQ{options: o}}
+	h.snd <- &packetRRQ{packetXRQ{filename: "file", options: o}}
 
 	// Receive and validate OACK
 	poack := <-h.rcv
@@ -136,6 +168,22 @@ func (h *handlerContext) Negotiate(t *testing.T, o map[string]string) {
 	h.snd <- &packetACK{blockNr: 0}
 }
 
+func (h *handlerContext) NegotiateWrite(t *testing.T, o map[string]string) {
+	h.snd <- &packetWRQ{packetXRQ{filename: "file", options: o}}
+
+	// Receive and validate OACK
+	poack := <-h.rcv
+	assert.IsType(t, &packetOACK{}, poack)
+	oack := poack.(*packetOACK)
+
+	// Validate that we got what we asked for
+	for k, v := range o {
+		assert.Equal(t, v, oack.options[k])
+	}
+
+	// The first DATA packet acknowledges the OACK, so there is nothing to send.
+}
+
 func TestMalformedFirstPacket(t *testing.T) {
 	h := newHandlerContext()
 	h.snd <- errOpcode
@@ -159,6 +207,210 @@ func TestUnexpectedFirstPacket(t *testing.T) {
 	assert.Equal(t, p.errorCode, opcode(4))
 }
 
+func TestMailMode(t *testing.T) {
+	for _, p := range []packet{
+		&packetRRQ{packetXRQ{filename: "file", mode: modeMAIL}},
+		&packetWRQ{packetXRQ{filename: "file", mode: modeMAIL}},
+	} {
+		h := newHandlerContext()
+		h.snd <- p
+
+		px := <-h.rcv
+		assert.IsType(t, &packetERROR{}, px)
+
+		perr := px.(*packetERROR)
+		assert.Equal(t, perr.errorCode, uint16(4))
+		assert.Equal(t, perr.errorMessage, "mail mode not supported")
+	}
+}
+
+func TestEmptyFilename(t *testing.T) {
+	for _, p := range []packet{
+		&packetRRQ{packetXRQ{filename: "", mode: modeOCTET}},
+		&packetWRQ{packetXRQ{filename: "", mode: modeOCTET}},
+	} {
+		h := newHandlerContext()
+		called := false
+		h.readFunc = func(peer net.Addr, filename string) (ReadCloser, error) {
+			called = true
+			return nil, os.ErrNotExist
+		}
+		h.writeFunc = func(peer net.Addr, filename string) (WriteCloser, error) {
+			called = true
+			return nil, os.ErrNotExist
+		}
+		h.snd <- p
+
+		assert.Equal(t, &packetERROR{errorCode: 2, errorMessage: "no filename"}, <-h.rcv)
+
+		_, ok := <-h.rcv
+		assert.False(t, ok)
+		assert.False(t, called)
+	}
+}
+
+func TestSessionContext(t *testing.T) {
+	h := newHandlerContext()
+	h.snd <- &packetRRQ{packetXRQ{filename: "file"}}
+
+	pdata := <-h.rcv
+	assert.IsType(t, &packetDATA{}, pdata)
+
+	// The context carries the peer address while the session is running.
+	peer, ok := PeerAddrFromContext(h.ctx)
+	assert.True(t, ok)
+	assert.Equal(t, ZeroConn.RemoteAddr(), peer)
+	assert.Nil(t, h.ctx.Err())
+
+	h.snd <- &packetACK{blockNr: 1}
+
+	// End dallying after the final ACK.
+	h.snd <- ErrTimeout
+
+	// Wait for the session to end.
+	_, ok = <-h.rcv
+	assert.False(t, ok)
+	assert.Equal(t, context.Canceled, h.ctx.Err())
+}
+
+func TestSessionContextShutdown(t *testing.T) {
+	var srv *Server
+	h := newHandlerContextWith(func(s *Server) {
+		srv = s
+	})
+
+	h.SetReadCloser(&rcBuffer{bytes.NewBuffer([]byte{0x1})})
+	h.snd <- &packetRRQ{packetXRQ{filename: "file"}}
+
+	pdata := <-h.rcv
+	assert.IsType(t, &packetDATA{}, pdata)
+
+	// A forced shutdown cancels the context of the session.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, srv.Shutdown(ctx))
+	assert.Equal(t, context.Canceled, h.ctx.Err())
+
+	// The session is aborted instead of retransmitting.
+	h.snd <- ErrTimeout
+	px := <-h.rcv
+	assert.IsType(t, &packetERROR{}, px)
+
+	p := px.(*packetERROR)
+	assert.Equal(t, p.errorCode, uint16(0))
+	assert.Equal(t, p.errorMessage, context.Canceled.Error())
+}
+
+// rcClosed records whether it was closed.
+type rcClosed struct {
+	io.Reader
+	closed bool
+}
+
+func (r *rcClosed) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestMaxTransferDuration(t *testing.T) {
+	h := newHandlerContextWith(func(srv *Server) {
+		srv.MaxTransferDuration = 50 * time.Millisecond
+	})
+
+	rc := &rcClosed{Reader: bytes.NewBuffer(make([]byte, 1024))}
+	h.SetReadCloser(rc)
+	h.snd <- &packetRRQ{packetXRQ{filename: "file"}}
+
+	pdata := <-h.rcv
+	assert.IsType(t, &packetDATA{}, pdata)
+
+	// The peer acknowledges in time for every packet, but the transfer as a
+	// whole takes too long.
+	time.Sleep(100 * time.Millisecond)
+	h.snd <- &packetACK{blockNr: 1}
+
+	px := <-h.rcv
+	assert.Equal(t, &packetERROR{errorCode: 0, errorMessage: context.DeadlineExceeded.Error()}, px)
+	assert.Equal(t, context.DeadlineExceeded, h.ctx.Err())
+
+	_, ok := <-h.rcv
+	assert.False(t, ok)
+	assert.True(t, rc.closed)
+}
+
+func TestRewriteFilename(t *testing.T) {
+	errDenied := errors.New("denied")
+	rewrite := func(peer net.Addr, filename string) (string, error) {
+		if strings.HasSuffix(filename, ".key") {
+			return "", errDenied
+		}
+		return strings.TrimPrefix(filename, "/"), nil
+	}
+
+	for _, p := range []packet{
+		&packetRRQ{packetXRQ{filename: "/boot/file"}},
+		&packetWRQ{packetXRQ{filename: "/boot/file"}},
+	} {
+		h := newHandlerContextWith(func(srv *Server) {
+			srv.RewriteFilename = rewrite
+		})
+
+		filenames := make(chan string, 1)
+		h.readFunc = func(_ net.Addr, filename string) (ReadCloser, error) {
+			filenames <- filename
+			return nil, os.ErrNotExist
+		}
+		h.writeFunc = func(_ net.Addr, filename string) (WriteCloser, error) {
+			filenames <- filename
+			return nil, os.ErrPermission
+		}
+
+		h.snd <- p
+		_ = <-h.rcv
+		assert.Equal(t, "boot/file", <-filenames)
+	}
+
+	// A denied filename never reaches the Handler.
+	h := newHandlerContextWith(func(srv *Server) {
+		srv.RewriteFilename = rewrite
+	})
+
+	h.readFunc = func(_ net.Addr, filename string) (ReadCloser, error) {
+		t.Errorf("ReadFile called for %s", filename)
+		return nil, os.ErrNotExist
+	}
+
+	h.snd <- &packetRRQ{packetXRQ{filename: "server.key"}}
+	assert.Equal(t, &packetERROR{errorCode: 2, errorMessage: "denied"}, <-h.rcv)
+}
+
+func TestRequestFilename(t *testing.T) {
+	h := newHandlerContextWith(func(srv *Server) {
+		srv.RewriteFilename = func(peer net.Addr, filename string) (string, error) {
+			return strings.TrimPrefix(filename, "/"), nil
+		}
+	})
+
+	filenames := make(chan string, 1)
+	h.readFunc = func(_ net.Addr, filename string) (ReadCloser, error) {
+		filenames <- filename
+		return nil, os.ErrNotExist
+	}
+
+	// The Handler is passed the bytes of the rewritten filename, while the
+	// bytes of the request are available through the context.
+	h.snd <- &packetRRQ{packetXRQ{filename: "/caf\xe9\xff"}}
+	_ = <-h.rcv
+	assert.Equal(t, []byte("caf\xe9\xff"), []byte(<-filenames))
+
+	raw, ok := RequestFilename(h.ctx)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("/caf\xe9\xff"), raw)
+
+	_, ok = RequestFilename(context.Background())
+	assert.False(t, ok)
+}
+
 func TestReadFileError(t *testing.T) {
 	var tests = []struct {
 		p            packet
@@ -175,6 +427,16 @@ func TestReadFileError(t *testing.T) {
 			2,
 			os.ErrPermission.Error(),
 		},
+		{
+			&packetRRQ{packetXRQ{filename: "Wrapped"}},
+			1,
+			"open Wrapped: file does not exist",
+		},
+		{
+			&packetRRQ{packetXRQ{filename: "Nil"}},
+			0,
+			errNoFile.Error(),
+		},
 		{
 			&packetRRQ{packetXRQ{filename: "Default"}},
 			0,
@@ -184,12 +446,16 @@ func TestReadFileError(t *testing.T) {
 
 	for _, test := range tests {
 		h := newHandlerContext()
-		h.readFunc = func(_ Conn, filename string) (ReadCloser, error) {
+		h.readFunc = func(_ net.Addr, filename string) (ReadCloser, error) {
 			switch filename {
 			case "NotExists":
 				return nil, os.ErrNotExist
 			case "Permission":
 				return nil, os.ErrPermission
+			case "Wrapped":
+				return nil, &os.PathError{Op: "open", Path: filename, Err: os.ErrNotExist}
+			case "Nil":
+				return nil, nil
 			default:
 				return nil, errors.New("")
 			}
@@ -276,6 +542,86 @@ func TestReadRequestNegotiation(t *testing.T) {
 			proposed: "32",
 			returned: "32",
 		},
+		{
+			opt:      "utimeout",
+			proposed: "xxx", // Not a number
+			returned: "",
+
+			errorCode:    8,
+			errorMessage: "invalid syntax",
+		},
+		{
+			opt:      "utimeout",
+			proposed: "5000",
+			returned: "10000",
+		},
+		{
+			opt:      "utimeout",
+			proposed: "300000000",
+			returned: "255000000",
+		},
+		{
+			opt:      "utimeout",
+			proposed: "250000",
+			returned: "250000",
+		},
+		{
+			opt:      "windowsize",
+			proposed: "xxx", // Not a number
+			returned: "",
+
+			errorCode:    8,
+			errorMessage: "invalid syntax",
+		},
+		{
+			opt:      "windowsize",
+			proposed: "0",
+			returned: "1",
+		},
+		{
+			opt:      "windowsize",
+			proposed: "65536",
+			returned: "65535",
+		},
+		{
+			opt:      "windowsize",
+			proposed: "16",
+			returned: "16",
+		},
+		{
+			opt:      "rollover",
+			proposed: "2", // Not 0 or 1
+			returned: "",
+
+			errorCode:    8,
+			errorMessage: "invalid rollover",
+		},
+		{
+			opt:      "rollover",
+			proposed: "0",
+			returned: "0",
+		},
+		{
+			opt:      "rollover",
+			proposed: "1",
+			returned: "1",
+		},
+		{
+			opt:      "tsize",
+			proposed: "xxx", // Not a number
+			returned: "",
+
+			errorCode:    8,
+			errorMessage: "invalid syntax",
+		},
+		{
+			opt:      "tsize",
+			proposed: "-1", // Negative
+			returned: "",
+
+			errorCode:    8,
+			errorMessage: "invalid syntax",
+		},
 	}
 
 	for _, test := range tests {
@@ -283,6 +629,7 @@ func TestReadRequestNegotiation(t *testing.T) {
 
 		p := &packetRRQ{
 			packetXRQ{
+				filename: "file",
 				options: map[string]string{
 					test.opt: test.proposed,
 				},
@@ -307,70 +654,2020 @@ func TestReadRequestNegotiation(t *testing.T) {
 	}
 }
 
-func TestReadRequestChunks(t *testing.T) {
+func TestReadRequestAcceptBlksize(t *testing.T) {
+	// Only accept block sizes that avoid IP fragmentation.
+	accept := func(requested int) (int, bool) {
+		switch {
+		case requested >= 1468:
+			return 1468, true
+		case requested >= 512:
+			return 512, true
+		}
+		return 0, false
+	}
+
 	var tests = []struct {
-		buf     []byte
-		packets []*packetDATA // DATA packets we expect to receive.
+		proposed string
+		returned string // Empty if the option is declined.
 	}{
-		{
-			// Empty last packet.
-			buf: []byte{0x0, 0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8, 0x9, 0xa, 0xb, 0xc, 0xd, 0xe, 0xf},
-			packets: []*packetDATA{
-				&packetDATA{blockNr: 1, data: []byte{0x0, 0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7}},
-				&packetDATA{blockNr: 2, data: []byte{0x8, 0x9, 0xa, 0xb, 0xc, 0xd, 0xe, 0xf}},
-				&packetDATA{blockNr: 3, data: []byte{}},
-			},
-		},
-		{
-			// Partial last packet.
-			buf: []byte{0x0, 0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8, 0x9, 0xa, 0xb, 0xc, 0xd, 0xe},
-			packets: []*packetDATA{
-				&packetDATA{blockNr: 1, data: []byte{0x0, 0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7}},
-				&packetDATA{blockNr: 2, data: []byte{0x8, 0x9, 0xa, 0xb, 0xc, 0xd, 0xe}},
-			},
-		},
+		{proposed: "65464", returned: "1468"},
+		{proposed: "1468", returned: "1468"},
+		{proposed: "1024", returned: "512"},
+		{proposed: "256", returned: ""},
 	}
 
 	for _, test := range tests {
-		h := newHandlerContext()
-		h.SetReadCloser(&rcBuffer{iotest.OneByteReader(bytes.NewBuffer(test.buf))})
-		h.Negotiate(t, map[string]string{"blksize": "8"})
+		h := newHandlerContextWith(func(srv *Server) {
+			srv.AcceptBlksize = accept
+		})
 
-		for _, expected := range test.packets {
-			pdata := <-h.rcv
-			assert.IsType(t, &packetDATA{}, pdata)
+		h.snd <- &packetRRQ{packetXRQ{filename: "file", options: map[string]string{
+			"blksize": test.proposed,
+			"timeout": "1",
+		}}}
 
-			actual := pdata.(*packetDATA)
-			assert.Equal(t, expected, actual)
-			h.snd <- &packetACK{blockNr: actual.blockNr}
-		}
+		px := <-h.rcv
+		assert.IsType(t, &packetOACK{}, px)
 
-		// There should not be any more packets.
-		p, ok := <-h.rcv
-		assert.False(t, ok)
-		assert.Nil(t, p)
+		value, ok := px.(*packetOACK).options["blksize"]
+		assert.Equal(t, test.returned != "", ok)
+		assert.Equal(t, test.returned, value)
+		h.snd <- &packetACK{blockNr: 0}
 	}
 }
 
-func TestReadRequestRetries(t *testing.T) {
+func TestDefaultBlksize(t *testing.T) {
+	var tests = []struct {
+		defaultBlksize int
+		blksize        int
+	}{
+		{defaultBlksize: 0, blksize: 512},
+		{defaultBlksize: 1024, blksize: 1024},
+		{defaultBlksize: 4, blksize: 8},
+		{defaultBlksize: 100000, blksize: 65464},
+	}
+
+	for _, test := range tests {
+		h := newHandlerContextWith(func(srv *Server) {
+			srv.DefaultBlksize = test.defaultBlksize
+		})
+
+		// The default applies to requests without the blksize option.
+		h.SetReadCloser(&rcBuffer{bytes.NewBuffer(make([]byte, 100000))})
+		h.snd <- &packetRRQ{packetXRQ{filename: "file"}}
+
+		px := <-h.rcv
+		if assert.IsType(t, &packetDATA{}, px) {
+			assert.Equal(t, test.blksize, len(px.(*packetDATA).data))
+		}
+	}
+}
+
+func TestStrictOptions(t *testing.T) {
+	o := map[string]string{"blksize": "8", "unknown": "1"}
+
+	// Unknown options are ignored by default.
 	h := newHandlerContext()
+	h.snd <- &packetRRQ{packetXRQ{filename: "file", options: o}}
+	assert.Equal(t, &packetOACK{options: map[string]string{"blksize": "8"}}, <-h.rcv)
 
-	buf := []byte{0x1}
-	h.SetReadCloser(&rcBuffer{bytes.NewBuffer(buf)})
-	h.Negotiate(t, map[string]string{"blksize": "8"})
+	// In strict mode, they are rejected.
+	h = newHandlerContextWith(func(srv *Server) {
+		srv.StrictOptions = true
+	})
+	h.snd <- &packetRRQ{packetXRQ{filename: "file", options: o}}
 
-	for i := 0; i < 2; i++ {
-		// Throw away packet
-		_ = <-h.rcv
-		// Trigger timeout
-		h.snd <- ErrTimeout
+	px := <-h.rcv
+	assert.IsType(t, &packetERROR{}, px)
+
+	p := px.(*packetERROR)
+	assert.Equal(t, p.errorCode, uint16(8))
+	assert.Equal(t, p.errorMessage, `unknown option "unknown"`)
+
+	// Known options are accepted in strict mode.
+	h = newHandlerContextWith(func(srv *Server) {
+		srv.StrictOptions = true
+	})
+	h.Negotiate(t, map[string]string{"blksize": "8", "timeout": "1", "windowsize": "2"})
+}
+
+func TestMaxOptions(t *testing.T) {
+	flood := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		flood["opt"+strconv.Itoa(i)] = "1"
 	}
 
-	pdata := <-h.rcv
-	assert.IsType(t, &packetDATA{}, pdata)
+	var tests = []struct {
+		fn      func(*Server)
+		options map[string]string
+		err     error
+	}{
+		{func(*Server) {}, flood, errTooManyOptions},
+		{func(*Server) {}, map[string]string{"blksize": strings.Repeat("1", 600)}, errOptionsSize},
+		{func(srv *Server) { srv.MaxOptions = 1 }, map[string]string{"blksize": "8", "timeout": "1"}, errTooManyOptions},
+		{func(srv *Server) { srv.MaxOptionBytes = 16 }, map[string]string{"blksize": "8", "timeout": "1"}, errOptionsSize},
+	}
 
-	data := pdata.(*packetDATA)
-	assert.Equal(t, uint16(1), data.blockNr)
-	assert.Equal(t, buf, data.data)
-	h.snd <- &packetACK{blockNr: data.blockNr}
+	// The request is rejected before the Handler is called.
+	for _, test := range tests {
+		for _, p := range []packet{
+			&packetRRQ{packetXRQ{filename: "file", options: test.options}},
+			&packetWRQ{packetXRQ{filename: "file", options: test.options}},
+		} {
+			h := newHandlerContextWith(test.fn)
+			h.readFunc = func(peer net.Addr, filename string) (ReadCloser, error) {
+				t.Error("ReadFile called")
+				return nil, os.ErrNotExist
+			}
+			h.writeFunc = func(peer net.Addr, filename string) (WriteCloser, error) {
+				t.Error("WriteFile called")
+				return nil, os.ErrNotExist
+			}
+			h.snd <- p
+			assert.Equal(t, &packetERROR{errorCode: 8, errorMessage: test.err.Error()}, <-h.rcv)
+		}
+	}
+
+	// Real requests fit the defaults, and the limits can be lifted.
+	h := newHandlerContext()
+	h.Negotiate(t, map[string]string{"blksize": "1428", "timeout": "1", "windowsize": "8", "rollover": "0"})
+
+	h = newHandlerContextWith(func(srv *Server) {
+		srv.MaxOptions, srv.MaxOptionBytes = -1, -1
+	})
+	flood["blksize"] = "8"
+	h.snd <- &packetRRQ{packetXRQ{filename: "file", options: flood}}
+	assert.Equal(t, &packetOACK{options: map[string]string{"blksize": "8"}}, <-h.rcv)
+}
+
+func TestBuiltinOptions(t *testing.T) {
+	index := make(map[string]int)
+	for i, opt := range builtinOptions {
+		_, dup := index[opt.name]
+		assert.False(t, dup, opt.name)
+		assert.True(t, builtinOption(opt.name))
+		index[opt.name] = i
+	}
+	assert.False(t, builtinOption("offset"))
+
+	// The utimeout option takes precedence over timeout.
+	assert.True(t, index["timeout"] < index["utimeout"])
+
+	s := &session{}
+	accepted, ok, err := negotiateUtimeout(s, "1")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "10000", accepted)
+	assert.Equal(t, 10*time.Millisecond, s.timeout)
+}
+
+func TestReadOnly(t *testing.T) {
+	h := newHandlerContextWith(func(srv *Server) {
+		srv.ReadOnly = true
+	})
+	h.snd <- &packetWRQ{packetXRQ{filename: "file"}}
+	assert.Equal(t, &packetERROR{errorCode: 2, errorMessage: "write requests not allowed"}, <-h.rcv)
+
+	// The Handler is not called.
+	assert.Nil(t, h.ctx)
+
+	// Read requests are served as usual.
+	h = newHandlerContextWith(func(srv *Server) {
+		srv.ReadOnly = true
+	})
+	h.SetReadCloser(&rcBuffer{bytes.NewBuffer([]byte("data"))})
+	h.snd <- &packetRRQ{packetXRQ{filename: "file"}}
+	assert.Equal(t, &packetDATA{blockNr: 1, data: []byte("data")}, <-h.rcv)
+}
+
+func TestWriteOnly(t *testing.T) {
+	h := newHandlerContextWith(func(srv *Server) {
+		srv.WriteOnly = true
+	})
+	h.snd <- &packetRRQ{packetXRQ{filename: "file"}}
+	assert.Equal(t, &packetERROR{errorCode: 2, errorMessage: "read requests not allowed"}, <-h.rcv)
+	assert.Nil(t, h.ctx)
+
+	// Write requests are served as usual.
+	h = newHandlerContextWith(func(srv *Server) {
+		srv.WriteOnly = true
+	})
+	h.SetWriteCloser(&wcBuffer{})
+	h.snd <- &packetWRQ{packetXRQ{filename: "file"}}
+	assert.Equal(t, &packetACK{blockNr: 0}, <-h.rcv)
+}
+
+func TestDisableOptions(t *testing.T) {
+	o := map[string]string{"blksize": "1024", "timeout": "1", "tsize": "0", "garbage": "\x01"}
+	disable := func(srv *Server) {
+		srv.DisableOptions = true
+		srv.DefaultBlksize = 1024
+		srv.StrictOptions = true
+	}
+
+	// A read request is answered with DATA 1 of 512 bytes instead of an OACK.
+	h := newHandlerContextWith(disable)
+	h.SetReadCloser(&rcBuffer{bytes.NewBuffer(make([]byte, 1000))})
+	h.snd <- &packetRRQ{packetXRQ{filename: "file", options: o}}
+
+	px := <-h.rcv
+	if assert.IsType(t, &packetDATA{}, px) {
+		assert.Equal(t, 512, len(px.(*packetDATA).data))
+	}
+
+	h.snd <- &packetACK{blockNr: 1}
+	<-h.rcv
+	h.snd <- &packetACK{blockNr: 2}
+	close(h.snd)
+
+	_, ok := <-h.rcv
+	assert.False(t, ok)
+
+	// The requested timeout of 1 second is ignored.
+	for _, d := range h.timeouts[1:] {
+		assert.True(t, d > time.Second && d <= defaultTimeout)
+	}
+
+	// A write request is answered with ACK 0 instead of an OACK.
+	h = newHandlerContextWith(disable)
+	h.SetWriteCloser(&wcBuffer{})
+	h.snd <- &packetWRQ{packetXRQ{filename: "file", options: o}}
+	assert.Equal(t, &packetACK{blockNr: 0}, <-h.rcv)
+}
+
+func TestOACKRejected(t *testing.T) {
+	for _, req := range []packet{
+		&packetRRQ{packetXRQ{filename: "file", options: map[string]string{"blksize": "8"}}},
+		&packetWRQ{packetXRQ{filename: "file", options: map[string]string{"blksize": "8"}}},
+	} {
+		var events []Event
+		h := newHandlerContextWith(func(srv *Server) {
+			srv.Logger = LoggerFunc(func(e Event) {
+				events = append(events, e)
+			})
+		})
+		h.SetReadCloser(&rcBuffer{bytes.NewBuffer([]byte("data"))})
+
+		h.snd <- req
+		assert.IsType(t, &packetOACK{}, <-h.rcv)
+
+		// A peer that doesn't accept the OACK ends the session right away,
+		// without a retransmission of the OACK or an error packet in reply.
+		h.snd <- &packetERROR{errorCode: 8, errorMessage: "bad blksize"}
+
+		_, ok := <-h.rcv
+		assert.False(t, ok)
+
+		e := events[len(events)-1]
+		assert.Equal(t, EventComplete, e.Type)
+		assert.Equal(t, &Error{Code: CodeOptionNegotiation, Message: "bad blksize"}, e.Err)
+		for _, e := range events {
+			assert.NotEqual(t, EventRetransmit, e.Type)
+		}
+	}
+}
+
+func TestReadRequestMaxBlksize(t *testing.T) {
+	var tests = []struct {
+		proposed string
+		returned string
+	}{
+		{proposed: "65464", returned: "1468"},
+		{proposed: "1469", returned: "1468"},
+		{proposed: "1468", returned: "1468"},
+		{proposed: "1024", returned: "1024"},
+		{proposed: "4", returned: "8"},
+	}
+
+	for _, test := range tests {
+		h := newHandlerContextWith(func(srv *Server) {
+			srv.MaxBlksize = 1468
+		})
+
+		h.snd <- &packetRRQ{packetXRQ{filename: "file", options: map[string]string{
+			"blksize": test.proposed,
+			"timeout": "1",
+		}}}
+
+		px := <-h.rcv
+		assert.IsType(t, &packetOACK{}, px)
+		assert.Equal(t, test.returned, px.(*packetOACK).options["blksize"])
+		h.snd <- &packetACK{blockNr: 0}
+	}
+}
+
+// negotiatingHandler is a handlerContext that implements OptionsNegotiator.
+type negotiatingHandler struct {
+	*handlerContext
+	negotiate func(write bool, options map[string]string) (map[string]string, error)
+}
+
+func (h *negotiatingHandler) NegotiateOptions(ctx context.Context, peer net.Addr, filename string, write bool, options map[string]string) (map[string]string, error) {
+	return h.negotiate(write, options)
+}
+
+func newNegotiatingHandlerContext(fn func(write bool, options map[string]string) (map[string]string, error)) *handlerContext {
+	return newHandlerContextWith(func(srv *Server) {
+		srv.Handler = &negotiatingHandler{handlerContext: srv.Handler.(*handlerContext), negotiate: fn}
+	})
+}
+
+func TestOptionsNegotiatorDecline(t *testing.T) {
+	// The blksize option is declined, so that the default applies.
+	h := newNegotiatingHandlerContext(func(write bool, options map[string]string) (map[string]string, error) {
+		assert.False(t, write)
+		assert.Equal(t, map[string]string{"blksize": "1024", "timeout": "2"}, options)
+		return map[string]string{"timeout": "2", "windowsize": "4"}, nil
+	})
+
+	h.SetReadCloser(&rcBuffer{bytes.NewBuffer(make([]byte, 600))})
+	h.snd <- &packetRRQ{packetXRQ{filename: "file", options: map[string]string{
+		"blksize": "1024",
+		"timeout": "2",
+	}}}
+
+	assert.Equal(t, &packetOACK{options: map[string]string{"timeout": "2"}}, <-h.rcv)
+	h.snd <- &packetACK{blockNr: 0}
+
+	px := <-h.rcv
+	if assert.IsType(t, &packetDATA{}, px) {
+		assert.Equal(t, 512, len(px.(*packetDATA).data))
+	}
+}
+
+func TestOptionsNegotiatorReject(t *testing.T) {
+	// A write request without tsize is rejected.
+	h := newNegotiatingHandlerContext(func(write bool, options map[string]string) (map[string]string, error) {
+		assert.True(t, write)
+		if _, ok := options["tsize"]; !ok {
+			return nil, errors.New("tsize required")
+		}
+		return options, nil
+	})
+
+	h.snd <- &packetWRQ{packetXRQ{filename: "file"}}
+
+	px := <-h.rcv
+	assert.IsType(t, &packetERROR{}, px)
+
+	p := px.(*packetERROR)
+	assert.Equal(t, p.errorCode, uint16(8))
+	assert.Equal(t, p.errorMessage, "tsize required")
+}
+
+type rcOptions struct {
+	rcBuffer
+	options *NegotiatedOptions
+}
+
+func (r *rcOptions) SetOptions(o NegotiatedOptions) {
+	r.options = &o
+}
+
+func TestReadRequestSetOptions(t *testing.T) {
+	h := newHandlerContext()
+
+	r := &rcOptions{rcBuffer: rcBuffer{bytes.NewBuffer([]byte{0x1})}}
+	h.SetReadCloser(r)
+	h.snd <- &packetRRQ{packetXRQ{filename: "file", mode: modeNETASCII, options: map[string]string{
+		"blksize":    "8",
+		"utimeout":   "500000",
+		"windowsize": "2",
+	}}}
+
+	assert.IsType(t, &packetOACK{}, <-h.rcv)
+	assert.Nil(t, r.options)
+	h.snd <- &packetACK{blockNr: 0}
+
+	assert.IsType(t, &packetDATA{}, <-h.rcv)
+	assert.Equal(t, &NegotiatedOptions{
+		Blksize:    8,
+		Timeout:    500 * time.Millisecond,
+		Windowsize: 2,
+		Tsize:      -1,
+	}, r.options)
+}
+
+func TestReadRequestRoundTrips(t *testing.T) {
+	var tests = []struct {
+		options    map[string]string
+		roundTrips int
+	}{
+		// RRQ/DATA 1, ACK 1/DATA 2, ACK 2.
+		{options: nil, roundTrips: 2},
+		// RRQ/OACK, ACK 0/DATA 1, ACK 1/DATA 2, ACK 2.
+		{options: map[string]string{"timeout": "1"}, roundTrips: 3},
+	}
+
+	for _, test := range tests {
+		h := newHandlerContext()
+		h.SetReadCloser(&rcBuffer{bytes.NewBuffer(make([]byte, 1000))})
+		h.snd <- &packetRRQ{packetXRQ{filename: "file", options: test.options}}
+
+		// Every packet from the server is answered right away, until the
+		// final DATA packet.
+		var roundTrips int
+		for {
+			px, ok := <-h.rcv
+			if !assert.True(t, ok) {
+				break
+			}
+			roundTrips++
+
+			switch p := px.(type) {
+			case *packetOACK:
+				h.snd <- &packetACK{blockNr: 0}
+				continue
+			case *packetDATA:
+				// The packet is reused once it is acknowledged.
+				final := len(p.data) < 512
+				h.snd <- &packetACK{blockNr: p.blockNr}
+				if !final {
+					continue
+				}
+			}
+			break
+		}
+
+		assert.Equal(t, test.roundTrips, roundTrips)
+
+		// End dallying after the final ACK.
+		h.snd <- ErrTimeout
+		_, ok := <-h.rcv
+		assert.False(t, ok)
+	}
+}
+
+func TestReadRequestEmptyFile(t *testing.T) {
+	// An empty file is sent as a single empty DATA packet (RFC 1350), with or
+	// without read ahead.
+	for _, depth := range []int{1, 3} {
+		h := newHandlerContextWith(func(srv *Server) {
+			srv.PrefetchDepth = depth
+		})
+		h.SetReadCloser(&rcBuffer{bytes.NewReader(nil)})
+		h.snd <- &packetRRQ{packetXRQ{filename: "file"}}
+
+		assert.Equal(t, &packetDATA{blockNr: 1, data: []byte{}}, <-h.rcv)
+		h.snd <- &packetACK{blockNr: 1}
+		close(h.snd)
+
+		// There should not be any more packets.
+		p, ok := <-h.rcv
+		assert.False(t, ok)
+		assert.Nil(t, p)
+	}
+}
+
+func TestReadRequestExactMultiple(t *testing.T) {
+	// A file that is a multiple of the block size ends with an empty DATA
+	// packet, also if the final data is returned together with io.EOF.
+	readers := map[string]func([]byte) io.Reader{
+		"plain": func(b []byte) io.Reader { return bytes.NewReader(b) },
+		"eof":   func(b []byte) io.Reader { return iotest.DataErrReader(bytes.NewReader(b)) },
+	}
+
+	for _, size := range []int{8, 16} {
+		for name, newReader := range readers {
+			for _, depth := range []int{1, 3} {
+				h := newHandlerContextWith(func(srv *Server) {
+					srv.PrefetchDepth = depth
+				})
+				h.SetReadCloser(&rcBuffer{newReader(bytes.Repeat([]byte{0x1}, size))})
+				h.Negotiate(t, map[string]string{"blksize": "8"})
+
+				blocks := size / 8
+				for blockNr := uint16(1); blockNr <= uint16(blocks); blockNr++ {
+					assert.Equal(t, &packetDATA{blockNr: blockNr, data: bytes.Repeat([]byte{0x1}, 8)}, <-h.rcv, name)
+					h.snd <- &packetACK{blockNr: blockNr}
+				}
+
+				final := uint16(blocks + 1)
+				assert.Equal(t, &packetDATA{blockNr: final, data: []byte{}}, <-h.rcv, name)
+				h.snd <- &packetACK{blockNr: final}
+				close(h.snd)
+
+				_, ok := <-h.rcv
+				assert.False(t, ok, name)
+			}
+		}
+	}
+}
+
+func TestReadRequestFinalBlock(t *testing.T) {
+	// The final block is the first one with less than blksize bytes,
+	// however the ReadCloser reports the end of the file.
+	readers := map[string]func([]byte) ReadCloser{
+		"plain":   func(b []byte) ReadCloser { return &rcBuffer{bytes.NewReader(b)} },
+		"eof":     func(b []byte) ReadCloser { return &rcBuffer{iotest.DataErrReader(bytes.NewReader(b))} },
+		"onebyte": func(b []byte) ReadCloser { return &rcBuffer{iotest.OneByteReader(bytes.NewReader(b))} },
+		"block":   func(b []byte) ReadCloser { return &rcBlocks{data: b} },
+	}
+
+	for size, lengths := range map[int][]int{
+		7: {7},
+		8: {8, 0},
+		9: {8, 1},
+	} {
+		buf := make([]byte, size)
+		for i := range buf {
+			buf[i] = byte(i)
+		}
+
+		for name, newReader := range readers {
+			msg := name + " " + strconv.Itoa(size)
+			h := newHandlerContext()
+			h.SetReadCloser(newReader(buf))
+			h.Negotiate(t, map[string]string{"blksize": "8"})
+
+			off := 0
+			for i, n := range lengths {
+				blockNr := uint16(i + 1)
+				assert.Equal(t, &packetDATA{blockNr: blockNr, data: buf[off : off+n]}, <-h.rcv, msg)
+				h.snd <- &packetACK{blockNr: blockNr}
+				off += n
+			}
+			close(h.snd)
+
+			_, ok := <-h.rcv
+			assert.False(t, ok, msg)
+		}
+	}
+}
+
+func TestReadRequestBufferReuse(t *testing.T) {
+	buf := make([]byte, 60)
+	for i := range buf {
+		buf[i] = byte(i)
+	}
+
+	// The DATA packets received from the session are reused once they are
+	// acknowledged, so they are only looked at before their ACK is sent.
+	// Until then, neither their block number nor their payload may change.
+	for _, depth := range []int{1, 3} {
+		h := newHandlerContextWith(func(srv *Server) {
+			srv.PrefetchDepth = depth
+		})
+		h.SetReadCloser(&rcBuffer{bytes.NewBuffer(buf)})
+		h.Negotiate(t, map[string]string{"blksize": "8", "windowsize": "2"})
+
+		// Every ACK acknowledges the first packet of the window, so that the
+		// rest of it stays in flight while the next block is read.
+		var unacked []*packetDATA
+		for acked := uint16(0); acked < 8; acked++ {
+			n := 2
+			if acked == 7 {
+				n = 1
+			}
+			for i := 0; i < n; i++ {
+				unacked = append(unacked, (<-h.rcv).(*packetDATA))
+			}
+
+			for _, p := range unacked {
+				off := int(p.blockNr-1) * 8
+				assert.Equal(t, buf[off:off+len(p.data)], p.data)
+			}
+
+			for len(unacked) > 0 && unacked[0].blockNr <= acked+1 {
+				unacked = unacked[1:]
+			}
+			h.snd <- &packetACK{blockNr: acked + 1}
+		}
+		close(h.snd)
+
+		_, ok := <-h.rcv
+		assert.False(t, ok)
+	}
+}
+
+// rcSizer is a ReadCloser that reports its size through Sizer.
+type rcSizer struct {
+	io.Reader
+	size int64
+	err  error
+}
+
+func (r *rcSizer) Close() error {
+	return nil
+}
+
+func (r *rcSizer) Size() (int64, error) {
+	return r.size, r.err
+}
+
+func TestReadRequestSizer(t *testing.T) {
+	var tests = []struct {
+		rc    ReadCloser
+		oack  map[string]string
+		total int64
+	}{
+		// The size is reported without io.Seeker.
+		{rc: &rcSizer{Reader: strings.NewReader("data"), size: 4}, oack: map[string]string{"tsize": "4"}, total: 4},
+		// The tsize option is omitted if the size is unknown.
+		{rc: &rcSizer{Reader: strings.NewReader("data"), err: errors.New("unknown")}, oack: nil, total: -1},
+		{rc: &rcBuffer{strings.NewReader("data")}, oack: nil, total: -1},
+	}
+
+	for _, test := range tests {
+		var total int64
+		h := newHandlerContext()
+		h.readFunc = func(_ net.Addr, _ string) (ReadCloser, error) {
+			SetProgress(h.ctx, func(transferred, t int64) {
+				total = t
+			})
+			return test.rc, nil
+		}
+
+		h.snd <- &packetRRQ{packetXRQ{filename: "file", options: map[string]string{"tsize": "0"}}}
+		if test.oack != nil {
+			assert.Equal(t, &packetOACK{options: test.oack}, <-h.rcv)
+			h.snd <- &packetACK{blockNr: 0}
+		}
+
+		assert.Equal(t, &packetDATA{blockNr: 1, data: []byte("data")}, <-h.rcv)
+		h.snd <- &packetACK{blockNr: 1}
+		close(h.snd)
+
+		_, ok := <-h.rcv
+		assert.False(t, ok)
+		assert.Equal(t, test.total, total)
+	}
+}
+
+// rcBlocks is a ReadCloser that implements BlockReader, and records the
+// offsets of the blocks that were read.
+type rcBlocks struct {
+	data    []byte
+	offsets []int64
+	err     error
+}
+
+func (r *rcBlocks) Read(b []byte) (int, error) {
+	panic("Read called")
+}
+
+func (r *rcBlocks) Close() error {
+	return nil
+}
+
+func (r *rcBlocks) ReadBlock(off int64, n int) ([]byte, error) {
+	r.offsets = append(r.offsets, off)
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	data := r.data[off:]
+	if len(data) > n {
+		data = data[:n]
+	}
+
+	// The final block may come with io.EOF.
+	if int(off)+len(data) == len(r.data) {
+		return data, io.EOF
+	}
+	return data, nil
+}
+
+func TestReadRequestBlockReader(t *testing.T) {
+	for _, size := range []int{20, 16} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i)
+		}
+
+		rc := &rcBlocks{data: data}
+		h := newHandlerContext()
+		h.SetReadCloser(rc)
+		h.Negotiate(t, map[string]string{"blksize": "8"})
+
+		// The blocks are sent as they are, and a file that is a multiple of
+		// the block size ends with an empty block.
+		for blockNr, off := uint16(1), 0; off <= size; blockNr, off = blockNr+1, off+8 {
+			end := off + 8
+			if end > size {
+				end = size
+			}
+
+			px := <-h.rcv
+			assert.Equal(t, &packetDATA{blockNr: blockNr, data: data[off:end]}, px)
+			if end > off {
+				assert.True(t, &px.(*packetDATA).data[0] == &data[off])
+			}
+			h.snd <- &packetACK{blockNr: blockNr}
+		}
+		close(h.snd)
+
+		_, ok := <-h.rcv
+		assert.False(t, ok)
+		assert.Equal(t, int64(0), rc.offsets[0])
+	}
+
+	// An error of ReadBlock aborts the transfer.
+	h := newHandlerContext()
+	h.SetReadCloser(&rcBlocks{err: errors.New("read error")})
+	h.snd <- &packetRRQ{packetXRQ{filename: "file"}}
+	assert.Equal(t, &packetERROR{errorCode: 0, errorMessage: "read error"}, <-h.rcv)
+
+	// So does a block that is too large.
+	h = newHandlerContext()
+	h.SetReadCloser(&rcLargeBlocks{})
+	h.snd <- &packetRRQ{packetXRQ{filename: "file"}}
+	assert.Equal(t, &packetERROR{errorCode: 0, errorMessage: errBlockSize.Error()}, <-h.rcv)
+}
+
+// rcLargeBlocks is a BlockReader that returns blocks larger than asked for.
+type rcLargeBlocks struct {
+	rcBlocks
+}
+
+func (r *rcLargeBlocks) ReadBlock(off int64, n int) ([]byte, error) {
+	return make([]byte, n+1), nil
+}
+
+func TestReadRequestChunks(t *testing.T) {
+	var tests = []struct {
+		buf     []byte
+		packets []*packetDATA // DATA packets we expect to receive.
+	}{
+		{
+			// Empty last packet.
+			buf: []byte{0x0, 0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8, 0x9, 0xa, 0xb, 0xc, 0xd, 0xe, 0xf},
+			packets: []*packetDATA{
+				&packetDATA{blockNr: 1, data: []byte{0x0, 0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7}},
+				&packetDATA{blockNr: 2, data: []byte{0x8, 0x9, 0xa, 0xb, 0xc, 0xd, 0xe, 0xf}},
+				&packetDATA{blockNr: 3, data: []byte{}},
+			},
+		},
+		{
+			// Partial last packet.
+			buf: []byte{0x0, 0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8, 0x9, 0xa, 0xb, 0xc, 0xd, 0xe},
+			packets: []*packetDATA{
+				&packetDATA{blockNr: 1, data: []byte{0x0, 0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7}},
+				&packetDATA{blockNr: 2, data: []byte{0x8, 0x9, 0xa, 0xb, 0xc, 0xd, 0xe}},
+			},
+		},
+	}
+
+	// Blocks are the same whether or not they are read ahead.
+	for _, depth := range []int{1, 3} {
+		for _, test := range tests {
+			h := newHandlerContextWith(func(srv *Server) {
+				srv.PrefetchDepth = depth
+			})
+			h.SetReadCloser(&rcBuffer{iotest.OneByteReader(bytes.NewBuffer(test.buf))})
+			h.Negotiate(t, map[string]string{"blksize": "8"})
+
+			for _, expected := range test.packets {
+				pdata := <-h.rcv
+				assert.IsType(t, &packetDATA{}, pdata)
+
+				actual := pdata.(*packetDATA)
+				assert.Equal(t, expected, actual)
+				h.snd <- &packetACK{blockNr: actual.blockNr}
+			}
+
+			// End dallying after the final ACK.
+			h.snd <- ErrTimeout
+
+			// There should not be any more packets.
+			p, ok := <-h.rcv
+			assert.False(t, ok)
+			assert.Nil(t, p)
+		}
+	}
+}
+
+func TestReadRequestWindow(t *testing.T) {
+	buf := make([]byte, 40)
+	for i := range buf {
+		buf[i] = byte(i)
+	}
+
+	block := func(blockNr uint16) *packetDATA {
+		off := int(blockNr-1) * 8
+		end := off + 8
+		if end > len(buf) {
+			end = len(buf)
+		}
+		return &packetDATA{blockNr: blockNr, data: buf[off:end]}
+	}
+
+	h := newHandlerContext()
+	h.SetReadCloser(&rcBuffer{bytes.NewBuffer(buf)})
+	h.Negotiate(t, map[string]string{"blksize": "8", "windowsize": "4"})
+
+	// Full window
+	for blockNr := uint16(1); blockNr <= 4; blockNr++ {
+		assert.Equal(t, block(blockNr), <-h.rcv)
+	}
+
+	// Timeout retransmits the full window
+	h.snd <- ErrTimeout
+	for blockNr := uint16(1); blockNr <= 4; blockNr++ {
+		assert.Equal(t, block(blockNr), <-h.rcv)
+	}
+
+	// Mid-window ACK slides the window; sending resumes after the ACKed block
+	h.snd <- &packetACK{blockNr: 2}
+	for blockNr := uint16(3); blockNr <= 6; blockNr++ {
+		assert.Equal(t, block(blockNr), <-h.rcv)
+	}
+
+	// Duplicate and out-of-order ACKs are ignored
+	h.snd <- &packetACK{blockNr: 2}
+	h.snd <- &packetACK{blockNr: 1}
+
+	// The final block is 6, which is empty since the file size is a multiple
+	// of the block size.
+	assert.Equal(t, []byte{}, block(6).data)
+	h.snd <- &packetACK{blockNr: 6}
+
+	// End dallying after the final ACK.
+	h.snd <- ErrTimeout
+
+	// There should not be any more packets.
+	p, ok := <-h.rcv
+	assert.False(t, ok)
+	assert.Nil(t, p)
+}
+
+func TestReadRequestWindowLosses(t *testing.T) {
+	stats := make(chan Stats, 1)
+	h := newHandlerContextWith(func(srv *Server) {
+		srv.Stats = func(st Stats) {
+			stats <- st
+		}
+	})
+	h.SetReadCloser(&rcBuffer{bytes.NewBuffer(make([]byte, 80))})
+	h.Negotiate(t, map[string]string{"blksize": "8", "windowsize": "4"})
+
+	window := func(first uint16) {
+		for blockNr := first; blockNr < first+4; blockNr++ {
+			assert.Equal(t, blockNr, (<-h.rcv).(*packetDATA).blockNr)
+		}
+	}
+
+	// Blocks 2 and 4 are lost, so the peer acknowledges block 1 and drops
+	// block 3. Only the blocks after it are sent again.
+	window(1)
+	h.snd <- &packetACK{blockNr: 1}
+	window(2)
+
+	// A repeated ACK for block 1 doesn't restart the window again. Blocks 3
+	// and 5 are lost this time.
+	h.snd <- &packetACK{blockNr: 1}
+	h.snd <- &packetACK{blockNr: 2}
+	window(3)
+
+	// No losses.
+	h.snd <- &packetACK{blockNr: 6}
+	window(7)
+
+	// Block 8 is lost. Block 11 is the final, empty block.
+	h.snd <- &packetACK{blockNr: 7}
+	window(8)
+	h.snd <- &packetACK{blockNr: 11}
+	h.snd <- ErrTimeout
+
+	_, ok := <-h.rcv
+	assert.False(t, ok)
+
+	// Without timeouts, nothing counts as retransmitted; the blocks that the
+	// peer dropped are part of the next window.
+	st := <-stats
+	assert.Equal(t, 11, st.Blocks)
+	assert.Equal(t, 0, st.Retransmits)
+}
+
+func TestReadRequestDally(t *testing.T) {
+	h := newHandlerContext()
+	h.SetReadCloser(&rcBuffer{bytes.NewBuffer([]byte{0x1})})
+	h.snd <- &packetRRQ{packetXRQ{filename: "file"}}
+
+	pdata := <-h.rcv
+	assert.Equal(t, &packetDATA{blockNr: 1, data: []byte{0x1}}, pdata)
+	h.snd <- &packetACK{blockNr: 1}
+
+	// A duplicate of the final ACK is answered with the final DATA packet.
+	h.snd <- &packetACK{blockNr: 1}
+	pdata = <-h.rcv
+	assert.Equal(t, &packetDATA{blockNr: 1, data: []byte{0x1}}, pdata)
+
+	// Other packets are ignored.
+	h.snd <- &packetACK{blockNr: 0}
+
+	// End dallying.
+	h.snd <- ErrTimeout
+
+	// There should not be any more packets.
+	p, ok := <-h.rcv
+	assert.False(t, ok)
+	assert.Nil(t, p)
+}
+
+func TestReadRequestFutureACK(t *testing.T) {
+	h := newHandlerContext()
+	h.SetReadCloser(&rcBuffer{bytes.NewBuffer(bytes.Repeat([]byte{0x1}, 1000))})
+	h.snd <- &packetRRQ{packetXRQ{filename: "file"}}
+
+	assert.Equal(t, uint16(1), (<-h.rcv).(*packetDATA).blockNr)
+
+	// A stale ACK is ignored, but an ACK for a block that was not sent yet
+	// cannot be legitimate, and ends the transfer.
+	h.snd <- &packetACK{blockNr: 0}
+	h.snd <- &packetACK{blockNr: 5}
+	assert.Equal(t, &packetERROR{errorCode: 4, errorMessage: errFutureACK.Error()}, <-h.rcv)
+
+	_, ok := <-h.rcv
+	assert.False(t, ok)
+}
+
+func TestFutureACK(t *testing.T) {
+	window := func(blockNrs ...uint16) []*packetDATA {
+		var w []*packetDATA
+		for _, blockNr := range blockNrs {
+			w = append(w, &packetDATA{blockNr: blockNr})
+		}
+		return w
+	}
+
+	var tests = []struct {
+		window []*packetDATA
+		ack    uint16
+		future bool
+	}{
+		{window(9, 10), 11, true},
+		{window(9, 10), 10, false},
+		{window(9, 10), 8, false},
+		{window(9, 10), 10 + 1<<15 - 1, true},
+		{window(9, 10), 10 + 1<<15, false},
+		{window(65534, 65535), 1, true},
+		{window(1, 2), 65535, false},
+		{nil, 1, false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.future, futureACK(test.window, &packetACK{blockNr: test.ack}), test.ack)
+	}
+	assert.False(t, futureACK(window(1), &packetDATA{blockNr: 2}))
+}
+
+func TestReadRequestTsize(t *testing.T) {
+	buf := []byte("hello world\n")
+
+	{
+		// Size is known
+		h := newHandlerContext()
+		h.SetReadCloser(&rcSeeker{bytes.NewReader(buf)})
+		h.snd <- &packetRRQ{packetXRQ{filename: "file", options: map[string]string{"tsize": "0"}}}
+
+		poack := <-h.rcv
+		assert.Equal(t, &packetOACK{options: map[string]string{"tsize": "12"}}, poack)
+		h.snd <- &packetACK{blockNr: 0}
+
+		pdata := <-h.rcv
+		assert.Equal(t, &packetDATA{blockNr: 1, data: buf}, pdata)
+		h.snd <- &packetACK{blockNr: 1}
+	}
+
+	{
+		// Size is not known, other options are accepted
+		h := newHandlerContext()
+		h.SetReadCloser(&rcBuffer{bytes.NewBuffer(buf)})
+		h.snd <- &packetRRQ{packetXRQ{filename: "file", options: map[string]string{"tsize": "0", "blksize": "8"}}}
+
+		poack := <-h.rcv
+		assert.Equal(t, &packetOACK{options: map[string]string{"blksize": "8"}}, poack)
+		h.snd <- &packetACK{blockNr: 0}
+
+		pdata := <-h.rcv
+		assert.Equal(t, &packetDATA{blockNr: 1, data: buf[:8]}, pdata)
+		h.snd <- &packetACK{blockNr: 1}
+
+		pdata = <-h.rcv
+		assert.Equal(t, &packetDATA{blockNr: 2, data: buf[8:]}, pdata)
+		h.snd <- &packetACK{blockNr: 2}
+	}
+
+	{
+		// Size is not known, no other options; no OACK is sent
+		h := newHandlerContext()
+		h.SetReadCloser(&rcBuffer{bytes.NewBuffer(buf)})
+		h.snd <- &packetRRQ{packetXRQ{filename: "file", options: map[string]string{"tsize": "0"}}}
+
+		pdata := <-h.rcv
+		assert.Equal(t, &packetDATA{blockNr: 1, data: buf}, pdata)
+		h.snd <- &packetACK{blockNr: 1}
+	}
+}
+
+func TestReadRequestNetascii(t *testing.T) {
+	h := newHandlerContext()
+	h.SetReadCloser(&rcBuffer{bytes.NewBufferString("one\ntwo\n")})
+	h.snd <- &packetRRQ{packetXRQ{filename: "file", mode: modeNETASCII, options: map[string]string{"blksize": "8"}}}
+
+	poack := <-h.rcv
+	assert.IsType(t, &packetOACK{}, poack)
+	h.snd <- &packetACK{blockNr: 0}
+
+	// The LF at the end of the first line is pushed to the next block.
+	pdata := <-h.rcv
+	assert.Equal(t, &packetDATA{blockNr: 1, data: []byte("one\r\ntwo")}, pdata)
+	h.snd <- &packetACK{blockNr: 1}
+
+	pdata = <-h.rcv
+	assert.Equal(t, &packetDATA{blockNr: 2, data: []byte("\r\n")}, pdata)
+	h.snd <- &packetACK{blockNr: 2}
+}
+
+func TestReadRequestRetryCount(t *testing.T) {
+	var tests = []struct {
+		retries int
+		sends   int // The number of times a DATA packet is expected to be sent.
+	}{
+		{retries: 0, sends: 1},
+		{retries: 1, sends: 2},
+		{retries: 5, sends: 6},
+		{retries: -1, sends: 4}, // Default
+	}
+
+	for _, test := range tests {
+		h := newHandlerContextWith(func(srv *Server) {
+			srv.Retries = test.retries
+		})
+
+		h.SetReadCloser(&rcBuffer{bytes.NewBuffer([]byte{0x1})})
+		h.snd <- &packetRRQ{packetXRQ{filename: "file"}}
+
+		for i := 0; i < test.sends; i++ {
+			pdata := <-h.rcv
+			assert.Equal(t, &packetDATA{blockNr: 1, data: []byte{0x1}}, pdata)
+			// Trigger timeout
+			h.snd <- ErrTimeout
+		}
+
+		// The session gives up after the last retransmission.
+		p, ok := <-h.rcv
+		assert.False(t, ok)
+		assert.Nil(t, p)
+	}
+}
+
+func TestReadRequestBackoff(t *testing.T) {
+	h := newHandlerContextWith(func(srv *Server) {
+		srv.Backoff = ExponentialBackoff(10 * time.Second)
+	})
+
+	h.SetReadCloser(&rcBuffer{bytes.NewBuffer([]byte{0x1})})
+	h.snd <- &packetRRQ{packetXRQ{filename: "file"}}
+
+	for i := 0; i < 4; i++ {
+		_ = <-h.rcv
+		h.snd <- ErrTimeout
+	}
+
+	p, ok := <-h.rcv
+	assert.False(t, ok)
+	assert.Nil(t, p)
+
+	// The first read is that of the request.
+	var timeouts []time.Duration
+	for _, d := range h.timeouts[1:] {
+		timeouts = append(timeouts, d.Round(time.Second))
+	}
+
+	assert.Equal(t, []time.Duration{
+		3 * time.Second,
+		6 * time.Second,
+		10 * time.Second,
+		10 * time.Second,
+	}, timeouts)
+}
+
+func TestDefaultTimeout(t *testing.T) {
+	h := newHandlerContextWith(func(srv *Server) {
+		srv.DefaultTimeout = 250 * time.Millisecond
+		srv.Retries = 1
+	})
+
+	h.SetReadCloser(&rcBuffer{bytes.NewBuffer([]byte{0x1})})
+	h.snd <- &packetRRQ{packetXRQ{filename: "file"}}
+
+	for i := 0; i < 2; i++ {
+		_ = <-h.rcv
+		h.snd <- ErrTimeout
+	}
+
+	_, ok := <-h.rcv
+	assert.False(t, ok)
+
+	// The default timeout is not rounded to whole seconds.
+	for _, d := range h.timeouts[1:] {
+		assert.True(t, d > 200*time.Millisecond && d <= 250*time.Millisecond)
+	}
+}
+
+func TestTimeoutBounds(t *testing.T) {
+	var tests = []struct {
+		min, max time.Duration
+		option   string
+		value    string
+		acked    string
+	}{
+		{0, 0, "timeout", "0", "1"},
+		{0, 0, "timeout", "300", "255"},
+		{2 * time.Second, 0, "timeout", "1", "2"},
+		{1500 * time.Millisecond, 0, "timeout", "1", "2"},
+		{0, 5 * time.Second, "timeout", "10", "5"},
+		{0, 500 * time.Millisecond, "timeout", "10", "1"},
+		{0, 10 * time.Minute, "timeout", "300", "255"},
+		{0, 5 * time.Second, "timeout", "3", "3"},
+		{50 * time.Millisecond, 0, "utimeout", "20000", "50000"},
+		{0, 100 * time.Millisecond, "utimeout", "1000000", "100000"},
+		{0, time.Millisecond, "utimeout", "1000000", "10000"},
+	}
+
+	for _, test := range tests {
+		h := newHandlerContextWith(func(srv *Server) {
+			srv.MinTimeout, srv.MaxTimeout = test.min, test.max
+		})
+		h.snd <- &packetRRQ{packetXRQ{filename: "file", options: map[string]string{test.option: test.value}}}
+		assert.Equal(t, &packetOACK{options: map[string]string{test.option: test.acked}}, <-h.rcv, test)
+	}
+}
+
+func TestReadRequestUtimeout(t *testing.T) {
+	h := newHandlerContext()
+	h.SetReadCloser(&rcBuffer{bytes.NewBuffer([]byte{0x1})})
+	h.Negotiate(t, map[string]string{"timeout": "5", "utimeout": "250000"})
+
+	pdata := <-h.rcv
+	assert.IsType(t, &packetDATA{}, pdata)
+	h.snd <- &packetACK{blockNr: 1}
+
+	// End dallying after the final ACK.
+	h.snd <- ErrTimeout
+
+	_, ok := <-h.rcv
+	assert.False(t, ok)
+
+	// Every read after that of the request waits for the utimeout.
+	for _, d := range h.timeouts[1:] {
+		assert.True(t, d > 200*time.Millisecond && d <= 250*time.Millisecond)
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	b := ExponentialBackoff(5 * time.Second)
+	assert.Equal(t, time.Second, b(time.Second, 0))
+	assert.Equal(t, 2*time.Second, b(time.Second, 1))
+	assert.Equal(t, 4*time.Second, b(time.Second, 2))
+	assert.Equal(t, 5*time.Second, b(time.Second, 3))
+	assert.Equal(t, 5*time.Second, b(time.Second, 100))
+	assert.Equal(t, 5*time.Second, b(10*time.Second, 0))
+}
+
+func TestJitter(t *testing.T) {
+	b := Jitter(nil, 0.1, rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		d := b(time.Second, 0)
+		assert.True(t, d >= 900*time.Millisecond && d <= 1100*time.Millisecond)
+	}
+
+	// The jitter is applied to the time returned by the wrapped Backoff.
+	b = Jitter(ExponentialBackoff(5*time.Second), 0.1, rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		d := b(time.Second, 2)
+		assert.True(t, d >= 3600*time.Millisecond && d <= 4400*time.Millisecond)
+	}
+
+	// The same seed results in the same sequence.
+	b1 := Jitter(nil, 0.5, rand.NewSource(42))
+	b2 := Jitter(nil, 0.5, rand.NewSource(42))
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, b1(time.Second, i), b2(time.Second, i))
+	}
+
+	// Without jitter, the timeout is unchanged.
+	assert.Equal(t, time.Second, Jitter(nil, 0, nil)(time.Second, 0))
+}
+
+func TestReadRequestRetries(t *testing.T) {
+	h := newHandlerContext()
+
+	buf := []byte{0x1}
+	h.SetReadCloser(&rcBuffer{bytes.NewBuffer(buf)})
+	h.Negotiate(t, map[string]string{"blksize": "8"})
+
+	for i := 0; i < 2; i++ {
+		// Throw away packet
+		_ = <-h.rcv
+		// Trigger timeout
+		h.snd <- ErrTimeout
+	}
+
+	pdata := <-h.rcv
+	assert.IsType(t, &packetDATA{}, pdata)
+
+	data := pdata.(*packetDATA)
+	assert.Equal(t, uint16(1), data.blockNr)
+	assert.Equal(t, buf, data.data)
+	h.snd <- &packetACK{blockNr: data.blockNr}
+}
+
+type errWriter struct{}
+
+func (e errWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("no space left on device")
+}
+
+func TestWriteFileError(t *testing.T) {
+	var tests = []struct {
+		p            packet
+		errorCode    uint16
+		errorMessage string
+	}{
+		{
+			&packetWRQ{packetXRQ{filename: "Permission"}},
+			2,
+			os.ErrPermission.Error(),
+		},
+		{
+			&packetWRQ{packetXRQ{filename: "Exists"}},
+			6,
+			os.ErrExist.Error(),
+		},
+		{
+			&packetWRQ{packetXRQ{filename: "Wrapped"}},
+			2,
+			"open Wrapped: permission denied",
+		},
+		{
+			&packetWRQ{packetXRQ{filename: "Nil"}},
+			0,
+			errNoFile.Error(),
+		},
+		{
+			&packetWRQ{packetXRQ{filename: "Default"}},
+			0,
+			"",
+		},
+	}
+
+	for _, test := range tests {
+		h := newHandlerContext()
+		h.writeFunc = func(_ net.Addr, filename string) (WriteCloser, error) {
+			switch filename {
+			case "Permission":
+				return nil, os.ErrPermission
+			case "Exists":
+				return nil, os.ErrExist
+			case "Wrapped":
+				return nil, &os.PathError{Op: "open", Path: filename, Err: os.ErrPermission}
+			case "Nil":
+				return nil, nil
+			default:
+				return nil, errors.New("")
+			}
+		}
+
+		h.snd <- test.p
+		px := <-h.rcv
+		assert.IsType(t, &packetERROR{}, px)
+
+		p := px.(*packetERROR)
+		assert.Equal(t, p.errorCode, test.errorCode)
+		assert.Equal(t, p.errorMessage, test.errorMessage)
+	}
+}
+
+func TestWriteRequestWithoutOptions(t *testing.T) {
+	h := newHandlerContext()
+
+	var buf bytes.Buffer
+	h.SetWriteCloser(&wcBuffer{&buf})
+	h.snd <- &packetWRQ{packetXRQ{filename: "file"}}
+
+	// Without options, the first DATA packet is solicited with ACK 0.
+	pack := <-h.rcv
+	assert.Equal(t, &packetACK{blockNr: 0}, pack)
+
+	data := []byte("hello world\n")
+	h.snd <- &packetDATA{blockNr: 1, data: data}
+
+	pack = <-h.rcv
+	assert.Equal(t, &packetACK{blockNr: 1}, pack)
+
+	// There should not be any more packets.
+	p, ok := <-h.rcv
+	assert.False(t, ok)
+	assert.Nil(t, p)
+
+	assert.Equal(t, data, buf.Bytes())
+}
+
+func TestWriteRequestChunks(t *testing.T) {
+	var tests = []struct {
+		packets []*packetDATA // DATA packets we send.
+		buf     []byte        // Bytes we expect to be written.
+	}{
+		{
+			// Empty last packet.
+			packets: []*packetDATA{
+				&packetDATA{blockNr: 1, data: []byte{0x0, 0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7}},
+				&packetDATA{blockNr: 2, data: []byte{0x8, 0x9, 0xa, 0xb, 0xc, 0xd, 0xe, 0xf}},
+				&packetDATA{blockNr: 3, data: []byte{}},
+			},
+			buf: []byte{0x0, 0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8, 0x9, 0xa, 0xb, 0xc, 0xd, 0xe, 0xf},
+		},
+		{
+			// Partial last packet.
+			packets: []*packetDATA{
+				&packetDATA{blockNr: 1, data: []byte{0x0, 0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7}},
+				&packetDATA{blockNr: 2, data: []byte{0x8, 0x9, 0xa, 0xb, 0xc, 0xd, 0xe}},
+			},
+			buf: []byte{0x0, 0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8, 0x9, 0xa, 0xb, 0xc, 0xd, 0xe},
+		},
+	}
+
+	for _, test := range tests {
+		h := newHandlerContext()
+
+		var buf bytes.Buffer
+		h.SetWriteCloser(&wcBuffer{&buf})
+		h.NegotiateWrite(t, map[string]string{"blksize": "8"})
+
+		for _, p := range test.packets {
+			h.snd <- p
+
+			pack := <-h.rcv
+			assert.Equal(t, &packetACK{blockNr: p.blockNr}, pack)
+		}
+
+		// There should not be any more packets.
+		p, ok := <-h.rcv
+		assert.False(t, ok)
+		assert.Nil(t, p)
+
+		assert.Equal(t, test.buf, buf.Bytes())
+	}
+}
+
+func TestWriteRequestRetries(t *testing.T) {
+	h := newHandlerContext()
+
+	var buf bytes.Buffer
+	h.SetWriteCloser(&wcBuffer{&buf})
+	h.snd <- &packetWRQ{packetXRQ{filename: "file"}}
+
+	for i := 0; i < 2; i++ {
+		pack := <-h.rcv
+		assert.Equal(t, &packetACK{blockNr: 0}, pack)
+		// Trigger timeout
+		h.snd <- ErrTimeout
+	}
+
+	pack := <-h.rcv
+	assert.Equal(t, &packetACK{blockNr: 0}, pack)
+
+	h.snd <- &packetDATA{blockNr: 1, data: []byte{0x1}}
+	pack = <-h.rcv
+	assert.Equal(t, &packetACK{blockNr: 1}, pack)
+	assert.Equal(t, []byte{0x1}, buf.Bytes())
+}
+
+func TestWriteRequestDiskFull(t *testing.T) {
+	h := newHandlerContext()
+	h.SetWriteCloser(&wcBuffer{errWriter{}})
+	h.snd <- &packetWRQ{packetXRQ{filename: "file"}}
+
+	pack := <-h.rcv
+	assert.Equal(t, &packetACK{blockNr: 0}, pack)
+
+	h.snd <- &packetDATA{blockNr: 1, data: []byte{0x1}}
+	px := <-h.rcv
+	assert.IsType(t, &packetERROR{}, px)
+
+	p := px.(*packetERROR)
+	assert.Equal(t, p.errorCode, uint16(3))
+	assert.Equal(t, p.errorMessage, "no space left on device")
+}
+
+func TestWriteRequestBlockTooLarge(t *testing.T) {
+	h := newHandlerContext()
+
+	var buf bytes.Buffer
+	h.SetWriteCloser(&wcBuffer{&buf})
+	h.snd <- &packetWRQ{packetXRQ{filename: "file"}}
+
+	pack := <-h.rcv
+	assert.Equal(t, &packetACK{blockNr: 0}, pack)
+
+	h.snd <- &packetDATA{blockNr: 1, data: make([]byte, 513)}
+	px := <-h.rcv
+	assert.IsType(t, &packetERROR{}, px)
+
+	p := px.(*packetERROR)
+	assert.Equal(t, p.errorCode, uint16(4))
+	assert.Equal(t, p.errorMessage, "block larger than blksize")
+	assert.Equal(t, 0, buf.Len())
+}
+
+type wcOptions struct {
+	wcBuffer
+	options *NegotiatedOptions
+}
+
+func (w *wcOptions) SetOptions(o NegotiatedOptions) {
+	w.options = &o
+}
+
+func TestWriteRequestSetOptions(t *testing.T) {
+	h := newHandlerContext()
+
+	w := &wcOptions{wcBuffer: wcBuffer{&bytes.Buffer{}}}
+	h.SetWriteCloser(w)
+	h.snd <- &packetWRQ{packetXRQ{filename: "file"}}
+
+	assert.Equal(t, &packetACK{blockNr: 0}, <-h.rcv)
+	assert.Equal(t, &NegotiatedOptions{
+		Blksize:    defaultBlksize,
+		Timeout:    defaultTimeout,
+		Windowsize: 1,
+		Tsize:      -1,
+	}, w.options)
+}
+
+func TestWriteRequestMaxWriteSize(t *testing.T) {
+	{
+		// The announced size exceeds the limit.
+		h := newHandlerContextWith(func(srv *Server) {
+			srv.MaxWriteSize = 16
+		})
+		h.snd <- &packetWRQ{packetXRQ{filename: "file", options: map[string]string{"tsize": "17"}}}
+
+		px := <-h.rcv
+		assert.IsType(t, &packetERROR{}, px)
+
+		p := px.(*packetERROR)
+		assert.Equal(t, p.errorCode, uint16(3))
+		assert.Equal(t, p.errorMessage, "file too large")
+	}
+
+	{
+		// The peer announced a size within the limit, but sends more.
+		h := newHandlerContextWith(func(srv *Server) {
+			srv.MaxWriteSize = 16
+		})
+
+		var buf bytes.Buffer
+		h.SetWriteCloser(&wcBuffer{&buf})
+		h.NegotiateWrite(t, map[string]string{"blksize": "8", "tsize": "12"})
+
+		h.snd <- &packetDATA{blockNr: 1, data: []byte("01234567")}
+		assert.Equal(t, &packetACK{blockNr: 1}, <-h.rcv)
+		h.snd <- &packetDATA{blockNr: 2, data: []byte("89abcdef")}
+		assert.Equal(t, &packetACK{blockNr: 2}, <-h.rcv)
+		h.snd <- &packetDATA{blockNr: 3, data: []byte("g")}
+
+		px := <-h.rcv
+		assert.IsType(t, &packetERROR{}, px)
+
+		p := px.(*packetERROR)
+		assert.Equal(t, p.errorCode, uint16(3))
+		assert.Equal(t, p.errorMessage, "file too large")
+		assert.Equal(t, 16, buf.Len())
+	}
+}
+
+type wcAllocator struct {
+	wcBuffer
+	size int64
+	max  int64
+}
+
+func (w *wcAllocator) Allocate(size int64) error {
+	if size > w.max {
+		return errors.New("file too large")
+	}
+
+	w.size = size
+	return nil
+}
+
+func TestWriteRequestTsize(t *testing.T) {
+	{
+		// Size is echoed and passed to the Allocator
+		h := newHandlerContext()
+
+		var buf bytes.Buffer
+		w := &wcAllocator{wcBuffer: wcBuffer{&buf}, max: 16}
+		h.SetWriteCloser(w)
+		h.NegotiateWrite(t, map[string]string{"tsize": "12"})
+		assert.Equal(t, int64(12), w.size)
+
+		h.snd <- &packetDATA{blockNr: 1, data: []byte("hello world\n")}
+		pack := <-h.rcv
+		assert.Equal(t, &packetACK{blockNr: 1}, pack)
+	}
+
+	{
+		// Size is rejected by the Allocator
+		h := newHandlerContext()
+		h.SetWriteCloser(&wcAllocator{wcBuffer: wcBuffer{&bytes.Buffer{}}, max: 16})
+		h.snd <- &packetWRQ{packetXRQ{filename: "file", options: map[string]string{"tsize": "17"}}}
+
+		px := <-h.rcv
+		assert.IsType(t, &packetERROR{}, px)
+
+		p := px.(*packetERROR)
+		assert.Equal(t, p.errorCode, uint16(3))
+		assert.Equal(t, p.errorMessage, "file too large")
+	}
+}
+
+type wcAborter struct {
+	wcBuffer
+	closed  bool
+	aborted error
+}
+
+func (w *wcAborter) Close() error {
+	w.closed = true
+	return nil
+}
+
+func (w *wcAborter) Abort(err error) error {
+	w.aborted = err
+	return nil
+}
+
+func TestWriteRequestAbort(t *testing.T) {
+	{
+		// A completed transfer closes the WriteCloser
+		h := newHandlerContext()
+		w := &wcAborter{wcBuffer: wcBuffer{&bytes.Buffer{}}}
+		h.SetWriteCloser(w)
+		h.snd <- &packetWRQ{packetXRQ{filename: "file"}}
+
+		pack := <-h.rcv
+		assert.Equal(t, &packetACK{blockNr: 0}, pack)
+
+		h.snd <- &packetDATA{blockNr: 1, data: []byte{0x1}}
+		pack = <-h.rcv
+		assert.Equal(t, &packetACK{blockNr: 1}, pack)
+
+		_, ok := <-h.rcv
+		assert.False(t, ok)
+		assert.True(t, w.closed)
+		assert.Nil(t, w.aborted)
+	}
+
+	{
+		// An incomplete transfer aborts the WriteCloser
+		h := newHandlerContextWith(func(srv *Server) {
+			srv.Retries = 1
+		})
+		w := &wcAborter{wcBuffer: wcBuffer{&bytes.Buffer{}}}
+		h.SetWriteCloser(w)
+		h.snd <- &packetWRQ{packetXRQ{filename: "file"}}
+
+		for i := 0; i < 2; i++ {
+			_ = <-h.rcv
+			h.snd <- ErrTimeout
+		}
+
+		_, ok := <-h.rcv
+		assert.False(t, ok)
+		assert.False(t, w.closed)
+		assert.True(t, errors.Is(w.aborted, ErrTimeout))
+	}
+}
+
+type wcSyncer struct {
+	wcAborter
+	synced bool
+	err    error
+}
+
+func (w *wcSyncer) Sync() error {
+	w.synced = true
+	return w.err
+}
+
+func TestWriteRequestSync(t *testing.T) {
+	{
+		// The final block is synced before it is acknowledged
+		h := newHandlerContext()
+		w := &wcSyncer{wcAborter: wcAborter{wcBuffer: wcBuffer{&bytes.Buffer{}}}}
+		h.SetWriteCloser(w)
+		h.snd <- &packetWRQ{packetXRQ{filename: "file"}}
+		assert.Equal(t, &packetACK{blockNr: 0}, <-h.rcv)
+
+		h.snd <- &packetDATA{blockNr: 1, data: make([]byte, 512)}
+		assert.Equal(t, &packetACK{blockNr: 1}, <-h.rcv)
+		assert.False(t, w.synced)
+
+		h.snd <- &packetDATA{blockNr: 2, data: []byte{0x1}}
+		assert.Equal(t, &packetACK{blockNr: 2}, <-h.rcv)
+		assert.True(t, w.synced)
+
+		_, ok := <-h.rcv
+		assert.False(t, ok)
+		assert.True(t, w.closed)
+		assert.Nil(t, w.aborted)
+	}
+
+	{
+		// A failed sync fails the transfer
+		h := newHandlerContext()
+		w := &wcSyncer{wcAborter: wcAborter{wcBuffer: wcBuffer{&bytes.Buffer{}}}, err: errors.New("sync failed")}
+		h.SetWriteCloser(w)
+		h.snd <- &packetWRQ{packetXRQ{filename: "file"}}
+		assert.Equal(t, &packetACK{blockNr: 0}, <-h.rcv)
+
+		h.snd <- &packetDATA{blockNr: 1, data: []byte{0x1}}
+		assert.Equal(t, &packetERROR{errorCode: 3, errorMessage: "sync failed"}, <-h.rcv)
+
+		_, ok := <-h.rcv
+		assert.False(t, ok)
+		assert.False(t, w.closed)
+		assert.True(t, errors.Is(w.aborted, w.err))
+	}
+
+	{
+		// A trailing CR in netascii mode is written before the sync
+		h := newHandlerContext()
+		var buf bytes.Buffer
+		w := &wcSyncer{wcAborter: wcAborter{wcBuffer: wcBuffer{&buf}}}
+		h.SetWriteCloser(w)
+		h.snd <- &packetWRQ{packetXRQ{filename: "file", mode: modeNETASCII}}
+		assert.Equal(t, &packetACK{blockNr: 0}, <-h.rcv)
+
+		h.snd <- &packetDATA{blockNr: 1, data: []byte("a\r")}
+		assert.Equal(t, &packetACK{blockNr: 1}, <-h.rcv)
+		assert.True(t, w.synced)
+		assert.Equal(t, "a\r", buf.String())
+	}
+}
+
+// wcFlusher is a wcSyncer that records the order of Flush and Sync.
+type wcFlusher struct {
+	wcSyncer
+	calls []string
+	err   error
+}
+
+func (w *wcFlusher) Flush() error {
+	w.calls = append(w.calls, "flush")
+	return w.err
+}
+
+func (w *wcFlusher) Sync() error {
+	w.calls = append(w.calls, "sync")
+	return w.wcSyncer.Sync()
+}
+
+func TestWriteRequestFlush(t *testing.T) {
+	{
+		// The final block is flushed before it is synced
+		h := newHandlerContext()
+		w := &wcFlusher{wcSyncer: wcSyncer{wcAborter: wcAborter{wcBuffer: wcBuffer{&bytes.Buffer{}}}}}
+		h.SetWriteCloser(w)
+		h.snd <- &packetWRQ{packetXRQ{filename: "file"}}
+		assert.Equal(t, &packetACK{blockNr: 0}, <-h.rcv)
+
+		h.snd <- &packetDATA{blockNr: 1, data: []byte{0x1}}
+		assert.Equal(t, &packetACK{blockNr: 1}, <-h.rcv)
+		assert.Equal(t, []string{"flush", "sync"}, w.calls)
+
+		_, ok := <-h.rcv
+		assert.False(t, ok)
+		assert.True(t, w.closed)
+	}
+
+	{
+		// A failed flush fails the transfer without a sync
+		h := newHandlerContext()
+		w := &wcFlusher{wcSyncer: wcSyncer{wcAborter: wcAborter{wcBuffer: wcBuffer{&bytes.Buffer{}}}}, err: errors.New("flush failed")}
+		h.SetWriteCloser(w)
+		h.snd <- &packetWRQ{packetXRQ{filename: "file"}}
+		assert.Equal(t, &packetACK{blockNr: 0}, <-h.rcv)
+
+		h.snd <- &packetDATA{blockNr: 1, data: []byte{0x1}}
+		assert.Equal(t, &packetERROR{errorCode: 3, errorMessage: "flush failed"}, <-h.rcv)
+		assert.Equal(t, []string{"flush"}, w.calls)
+
+		_, ok := <-h.rcv
+		assert.False(t, ok)
+		assert.False(t, w.closed)
+		assert.True(t, errors.Is(w.aborted, w.err))
+	}
+}
+
+func TestWriteRequestNetascii(t *testing.T) {
+	h := newHandlerContext()
+
+	var buf bytes.Buffer
+	h.SetWriteCloser(&wcBuffer{&buf})
+	h.snd <- &packetWRQ{packetXRQ{filename: "file", mode: modeNETASCII}}
+
+	pack := <-h.rcv
+	assert.Equal(t, &packetACK{blockNr: 0}, pack)
+
+	// The CR LF sequence straddles two blocks.
+	h.snd <- &packetDATA{blockNr: 1, data: bytes.Repeat([]byte{'\r'}, 512)}
+	pack = <-h.rcv
+	assert.Equal(t, &packetACK{blockNr: 1}, pack)
+
+	h.snd <- &packetDATA{blockNr: 2, data: []byte("\nx\r\x00")}
+	pack = <-h.rcv
+	assert.Equal(t, &packetACK{blockNr: 2}, pack)
+
+	// Wait for the session to end, so that the WriteCloser is closed.
+	_, ok := <-h.rcv
+	assert.False(t, ok)
+
+	expected := append(bytes.Repeat([]byte{'\r'}, 511), []byte("\nx\r")...)
+	assert.Equal(t, expected, buf.Bytes())
+}
+
+func TestBlockNrWraparound(t *testing.T) {
+	// Transfer a file that spans two wraparounds of the block number.
+	const blocks = 2*65536 + 16
+
+	buf := make([]byte, blocks*8+1)
+	for i := range buf {
+		buf[i] = byte(i / 8)
+	}
+
+	block := func(i int) []byte {
+		if i*8+8 > len(buf) {
+			return buf[i*8:]
+		}
+		return buf[i*8 : i*8+8]
+	}
+
+	{
+		// Read
+		h := newHandlerContext()
+		h.SetReadCloser(&rcBuffer{bytes.NewBuffer(buf)})
+		h.Negotiate(t, map[string]string{"blksize": "8"})
+
+		for i := 0; i <= blocks; i++ {
+			pdata := <-h.rcv
+			data, ok := pdata.(*packetDATA)
+			if !assert.True(t, ok) {
+				return
+			}
+
+			if data.blockNr != uint16(i+1) || !bytes.Equal(data.data, block(i)) {
+				t.Fatalf("unexpected DATA packet %d at index %d", data.blockNr, i)
+			}
+
+			h.snd <- &packetACK{blockNr: data.blockNr}
+		}
+
+		// End dallying after the final ACK.
+		h.snd <- ErrTimeout
+
+		// There should not be any more packets.
+		_, ok := <-h.rcv
+		assert.False(t, ok)
+	}
+
+	{
+		// Write
+		h := newHandlerContext()
+
+		var out bytes.Buffer
+		h.SetWriteCloser(&wcBuffer{&out})
+		h.NegotiateWrite(t, map[string]string{"blksize": "8"})
+
+		for i := 0; i <= blocks; i++ {
+			blockNr := uint16(i + 1)
+			h.snd <- &packetDATA{blockNr: blockNr, data: block(i)}
+
+			pack := <-h.rcv
+			if ack, ok := pack.(*packetACK); !ok || ack.blockNr != blockNr {
+				t.Fatalf("unexpected packet %#v at index %d", pack, i)
+			}
+		}
+
+		// Wait for the session to end.
+		_, ok := <-h.rcv
+		assert.False(t, ok)
+		assert.Equal(t, buf, out.Bytes())
+	}
+}
+
+func TestBlockNrRollover(t *testing.T) {
+	var tests = []struct {
+		rollover string
+		next     uint16 // The block number following 65535.
+	}{
+		{rollover: "0", next: 0},
+		{rollover: "1", next: 1},
+	}
+
+	for _, test := range tests {
+		h := newHandlerContext()
+		h.SetReadCloser(&rcBuffer{bytes.NewBuffer(make([]byte, 65536*8))})
+		h.Negotiate(t, map[string]string{"blksize": "8", "rollover": test.rollover})
+
+		expected := uint16(1)
+		for i := 0; i <= 65536; i++ {
+			pdata := <-h.rcv
+			data, ok := pdata.(*packetDATA)
+			if !assert.True(t, ok) {
+				return
+			}
+
+			if data.blockNr != expected {
+				t.Fatalf("expected DATA packet %d, got %d", expected, data.blockNr)
+			}
+
+			h.snd <- &packetACK{blockNr: data.blockNr}
+
+			expected++
+			if expected == 0 {
+				expected = test.next
+			}
+		}
+
+		// End dallying after the final ACK.
+		h.snd <- ErrTimeout
+
+		// There should not be any more packets.
+		_, ok := <-h.rcv
+		assert.False(t, ok)
+	}
+}
+
+func TestWriteRequestWindowsize(t *testing.T) {
+	block := func(blockNr uint16) *packetDATA {
+		data := []byte("01234567")
+		if blockNr == 7 {
+			data = data[:2]
+		}
+		return &packetDATA{blockNr: blockNr, data: data}
+	}
+
+	h := newHandlerContext()
+
+	var buf bytes.Buffer
+	h.SetWriteCloser(&wcBuffer{&buf})
+	h.NegotiateWrite(t, map[string]string{"blksize": "8", "windowsize": "4"})
+
+	// Block 3 is dropped from the first window, which is answered with an ACK
+	// for the last block received in order as soon as block 4 arrives.
+	h.snd <- block(1)
+	h.snd <- block(2)
+	h.snd <- block(4)
+	assert.Equal(t, &packetACK{blockNr: 2}, <-h.rcv)
+
+	// The ACK is retransmitted when the timeout expires.
+	h.snd <- ErrTimeout
+	assert.Equal(t, &packetACK{blockNr: 2}, <-h.rcv)
+
+	// The next window is acknowledged once it is complete.
+	for blockNr := uint16(3); blockNr <= 6; blockNr++ {
+		h.snd <- block(blockNr)
+	}
+	assert.Equal(t, &packetACK{blockNr: 6}, <-h.rcv)
+
+	// The final block is acknowledged right away.
+	h.snd <- block(7)
+	assert.Equal(t, &packetACK{blockNr: 7}, <-h.rcv)
+
+	// Wait for the session to end.
+	_, ok := <-h.rcv
+	assert.False(t, ok)
+	assert.Equal(t, strings.Repeat("01234567", 6)+"01", buf.String())
+}
+
+func TestWriteRequestDuplicateData(t *testing.T) {
+	h := newHandlerContext()
+
+	var buf bytes.Buffer
+	h.SetWriteCloser(&wcBuffer{&buf})
+	h.NegotiateWrite(t, map[string]string{"blksize": "8"})
+
+	h.snd <- &packetDATA{blockNr: 1, data: []byte("01234567")}
+	pack := <-h.rcv
+	assert.Equal(t, &packetACK{blockNr: 1}, pack)
+
+	// Duplicates are ACKed again, but not written again.
+	for i := 0; i < 2; i++ {
+		h.snd <- &packetDATA{blockNr: 1, data: []byte("01234567")}
+		pack = <-h.rcv
+		assert.Equal(t, &packetACK{blockNr: 1}, pack)
+	}
+
+	h.snd <- &packetDATA{blockNr: 2, data: []byte("89")}
+	pack = <-h.rcv
+	assert.Equal(t, &packetACK{blockNr: 2}, pack)
+
+	// Wait for the session to end.
+	_, ok := <-h.rcv
+	assert.False(t, ok)
+	assert.Equal(t, "0123456789", buf.String())
+}
+
+// benchPeer is a packetReader and packetWriter that requests a file and
+// acknowledges every DATA packet right away, without allocating.
+type benchPeer struct {
+	rrq     packetRRQ
+	ack     packetACK
+	blksize int
+	started bool
+	final   bool // Whether the final DATA packet has been written.
+	done    bool // Whether the final DATA packet has been acknowledged.
+}
+
+// To implement packetReader
+func (p *benchPeer) read(timeout time.Duration) (packet, error) {
+	if !p.started {
+		p.started = true
+		return &p.rrq, nil
+	}
+
+	if p.done {
+		return nil, ErrTimeout
+	}
+
+	p.done = p.final
+	return &p.ack, nil
+}
+
+// Implement packetWriter
+func (p *benchPeer) write(x packet) error {
+	if data, ok := x.(*packetDATA); ok {
+		p.ack.blockNr = data.blockNr
+		p.final = len(data.data) < p.blksize
+	}
+	return nil
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+// benchmarkReadRequest measures reads of files of the given size, with blocks
+// of blksize bytes, of which open returns the ReadCloser.
+func benchmarkReadRequest(b *testing.B, size, blksize int, open func() ReadCloser) {
+	srv := NewServer(HandlerFuncs{
+		Read: func(ctx context.Context, peer net.Addr, filename string) (ReadCloser, error) {
+			return open(), nil
+		},
+	})
+
+	var options map[string]string
+	if blksize != defaultBlksize {
+		options = map[string]string{"blksize": strconv.Itoa(blksize)}
+	}
+
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		p := &benchPeer{
+			rrq:     packetRRQ{packetXRQ{filename: "file", mode: "octet", options: options}},
+			blksize: blksize,
+		}
+		if err := srv.serve(nil, p, p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkReadRequest measures an octet read without options. The number of
+// allocations per transfer should not grow with the number of blocks.
+func BenchmarkReadRequest(b *testing.B) {
+	const size = 1 << 20
+	benchmarkReadRequest(b, size, defaultBlksize, func() ReadCloser {
+		return &rcBuffer{io.LimitReader(zeroReader{}, size)}
+	})
+}
+
+// BenchmarkReadRequestBlockReader compares reading a file in memory into the
+// buffers of the DATA packets with sending its blocks as they are.
+func BenchmarkReadRequestBlockReader(b *testing.B) {
+	data := make([]byte, 16<<20)
+
+	b.Run("Read", func(b *testing.B) {
+		benchmarkReadRequest(b, len(data), 8192, func() ReadCloser {
+			return &rcBuffer{bytes.NewReader(data)}
+		})
+	})
+
+	b.Run("ReadBlock", func(b *testing.B) {
+		benchmarkReadRequest(b, len(data), 8192, func() ReadCloser {
+			return memReader{bytes.NewReader(data), data}
+		})
+	})
 }
@@ -0,0 +1,99 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"fmt"
+	"net"
+)
+
+// EventType identifies the kind of an Event.
+type EventType int
+
+const (
+	// EventRequest is logged when a read or write request is received.
+	EventRequest EventType = iota
+
+	// EventNegotiate is logged when options have been negotiated. The
+	// accepted options are in Options.
+	EventNegotiate
+
+	// EventRetransmit is logged every time a packet is retransmitted because
+	// the peer didn't reply in time.
+	EventRetransmit
+
+	// EventTimeout is logged when the peer didn't reply after the last
+	// retransmission.
+	EventTimeout
+
+	// EventError is logged for errors that don't otherwise end up anywhere,
+	// such as failing to send an error packet or to close a file.
+	EventError
+
+	// EventComplete is logged when a session ends. The number of bytes
+	// transferred is in Bytes. If the session failed, the cause is in Err.
+	EventComplete
+
+	// EventClamp is logged when an option requested by the peer is lowered
+	// to what the socket of the session can handle, before the options are
+	// acknowledged. The lowered option is in Options, and the reason in Err.
+	EventClamp
+)
+
+var eventTypeNames = []string{
+	EventRequest:    "request",
+	EventNegotiate:  "negotiate",
+	EventRetransmit: "retransmit",
+	EventTimeout:    "timeout",
+	EventError:      "error",
+	EventComplete:   "complete",
+	EventClamp:      "clamp",
+}
+
+func (t EventType) String() string {
+	if t < 0 || int(t) >= len(eventTypeNames) {
+		return fmt.Sprintf("EventType(%d)", int(t))
+	}
+
+	return eventTypeNames[t]
+}
+
+// Event describes something that happened during a session.
+type Event struct {
+	Type     EventType
+	Peer     net.Addr
+	Filename string // Empty if the request has not been received yet.
+	Write    bool   // Whether the request is a write request.
+
+	Options map[string]string // The accepted options, for EventNegotiate, or the lowered one, for EventClamp.
+	Bytes   int64             // The number of bytes transferred, for EventComplete.
+	Err     error             // The error, for EventError, EventComplete and EventClamp.
+}
+
+// Logger is the interface for receiving the events of sessions. A Logger is
+// called from the goroutine of the session, so it should not block.
+type Logger interface {
+	Log(e Event)
+}
+
+// LoggerFunc is an adapter to allow the use of an ordinary function as Logger.
+type LoggerFunc func(e Event)
+
+// Log calls f(e).
+func (f LoggerFunc) Log(e Event) {
+	f(e)
+}
@@ -0,0 +1,140 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// eventRecorder records the events logged by a session. The events can be
+// inspected once the session has ended.
+type eventRecorder struct {
+	events []Event
+}
+
+func (r *eventRecorder) Log(e Event) {
+	r.events = append(r.events, e)
+}
+
+func (r *eventRecorder) types() []EventType {
+	var types []EventType
+	for _, e := range r.events {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+func TestEventTypeString(t *testing.T) {
+	assert.Equal(t, "retransmit", EventRetransmit.String())
+	assert.Equal(t, "complete", EventComplete.String())
+	assert.Equal(t, "clamp", EventClamp.String())
+	assert.Equal(t, "EventType(42)", EventType(42).String())
+}
+
+func TestLogReadRequest(t *testing.T) {
+	r := &eventRecorder{}
+	h := newHandlerContextWith(func(srv *Server) {
+		srv.Logger = r
+	})
+
+	h.SetReadCloser(&rcBuffer{bytes.NewBuffer([]byte("0123456789"))})
+	h.snd <- &packetRRQ{packetXRQ{filename: "file", options: map[string]string{"blksize": "8"}}}
+	assert.IsType(t, &packetOACK{}, <-h.rcv)
+	h.snd <- &packetACK{blockNr: 0}
+
+	// Trigger a retransmission of the first DATA packet.
+	_ = <-h.rcv
+	h.snd <- ErrTimeout
+	_ = <-h.rcv
+	h.snd <- &packetACK{blockNr: 1}
+	_ = <-h.rcv
+	h.snd <- &packetACK{blockNr: 2}
+
+	// End dallying after the final ACK.
+	h.snd <- ErrTimeout
+
+	_, ok := <-h.rcv
+	assert.False(t, ok)
+
+	assert.Equal(t, []EventType{
+		EventRequest,
+		EventNegotiate,
+		EventRetransmit,
+		EventComplete,
+	}, r.types())
+
+	for _, e := range r.events {
+		assert.Equal(t, "file", e.Filename)
+		assert.False(t, e.Write)
+		assert.Equal(t, ZeroConn.RemoteAddr(), e.Peer)
+	}
+
+	assert.Equal(t, map[string]string{"blksize": "8"}, r.events[1].Options)
+	assert.Equal(t, int64(10), r.events[3].Bytes)
+	assert.Nil(t, r.events[3].Err)
+}
+
+func TestLogWriteRequest(t *testing.T) {
+	r := &eventRecorder{}
+	h := newHandlerContextWith(func(srv *Server) {
+		srv.Logger = r
+	})
+
+	h.snd <- &packetWRQ{packetXRQ{filename: "file"}}
+	assert.Equal(t, &packetACK{blockNr: 0}, <-h.rcv)
+	h.snd <- &packetDATA{blockNr: 1, data: []byte{0x1, 0x2}}
+	assert.Equal(t, &packetACK{blockNr: 1}, <-h.rcv)
+
+	_, ok := <-h.rcv
+	assert.False(t, ok)
+
+	assert.Equal(t, []EventType{EventRequest, EventComplete}, r.types())
+	assert.True(t, r.events[1].Write)
+	assert.Equal(t, int64(2), r.events[1].Bytes)
+	assert.Nil(t, r.events[1].Err)
+}
+
+func TestLogTimeout(t *testing.T) {
+	r := &eventRecorder{}
+	h := newHandlerContextWith(func(srv *Server) {
+		srv.Logger = r
+		srv.Retries = 1
+	})
+
+	h.SetReadCloser(&rcBuffer{bytes.NewBuffer([]byte{0x1})})
+	h.snd <- &packetRRQ{packetXRQ{filename: "file"}}
+
+	for i := 0; i < 2; i++ {
+		_ = <-h.rcv
+		h.snd <- ErrTimeout
+	}
+
+	_, ok := <-h.rcv
+	assert.False(t, ok)
+
+	assert.Equal(t, []EventType{
+		EventRequest,
+		EventRetransmit,
+		EventTimeout,
+		EventComplete,
+	}, r.types())
+	assert.Equal(t, int64(0), r.events[3].Bytes)
+	assert.Equal(t, &RetriesExhaustedError{Retries: 1}, r.events[3].Err)
+}
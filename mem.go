@@ -0,0 +1,127 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync"
+)
+
+// MemHandler is a Handler that serves files stored in memory. Files written
+// by peers are stored once the transfer completes. It is safe for concurrent
+// use.
+type MemHandler struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+// NewMemHandler returns a MemHandler without files.
+func NewMemHandler() *MemHandler {
+	return &MemHandler{files: make(map[string][]byte)}
+}
+
+// SetFile stores a copy of data as the file with the given name, replacing
+// the file if it exists.
+func (h *MemHandler) SetFile(filename string, data []byte) {
+	h.store(filename, append([]byte(nil), data...))
+}
+
+// File returns a copy of the file with the given name, and whether it exists.
+func (h *MemHandler) File(filename string) ([]byte, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	data, ok := h.files[filename]
+	if !ok {
+		return nil, false
+	}
+
+	return append([]byte(nil), data...), true
+}
+
+// store stores data as the file with the given name. The data is not copied,
+// and must not be modified afterwards.
+func (h *MemHandler) store(filename string, data []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.files[filename] = data
+}
+
+// memReader is the ReadCloser for a file of a MemHandler. Since it implements
+// io.Seeker and io.ReaderAt, the tsize and multicast options are supported.
+// Blocks are sent straight from the file through BlockReader.
+type memReader struct {
+	*bytes.Reader
+	data []byte
+}
+
+func (r memReader) Close() error {
+	return nil
+}
+
+func (r memReader) ReadBlock(off int64, n int) ([]byte, error) {
+	if off >= int64(len(r.data)) {
+		return nil, io.EOF
+	}
+
+	data := r.data[off:]
+	if len(data) > n {
+		data = data[:n]
+	}
+
+	return data, nil
+}
+
+func (h *MemHandler) ReadFile(ctx context.Context, peer net.Addr, filename string) (ReadCloser, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// Files are never modified in place, so the data can be shared.
+	data, ok := h.files[filename]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	return memReader{bytes.NewReader(data), data}, nil
+}
+
+// memWriter is the WriteCloser for a file of a MemHandler. The file is stored
+// when it is closed, and discarded when it is aborted.
+type memWriter struct {
+	bytes.Buffer
+
+	h        *MemHandler
+	filename string
+}
+
+func (w *memWriter) Close() error {
+	w.h.store(w.filename, w.Bytes())
+	return nil
+}
+
+func (w *memWriter) Abort(err error) error {
+	return nil
+}
+
+func (h *MemHandler) WriteFile(ctx context.Context, peer net.Addr, filename string) (WriteCloser, error) {
+	return &memWriter{h: h, filename: filename}, nil
+}
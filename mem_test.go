@@ -0,0 +1,128 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemHandlerReadFile(t *testing.T) {
+	h := NewMemHandler()
+	h.SetFile("file", []byte("data"))
+
+	rc, err := h.ReadFile(context.Background(), ZeroConn.RemoteAddr(), "file")
+	if assert.Nil(t, err) {
+		data, err := ioutil.ReadAll(rc)
+		assert.Nil(t, err)
+		assert.Equal(t, "data", string(data))
+		assert.Nil(t, rc.Close())
+	}
+
+	_, err = h.ReadFile(context.Background(), ZeroConn.RemoteAddr(), "missing")
+	assert.Equal(t, os.ErrNotExist, err)
+}
+
+func TestMemHandlerReadBlock(t *testing.T) {
+	h := NewMemHandler()
+	h.SetFile("file", []byte("0123456789"))
+
+	rc, err := h.ReadFile(context.Background(), ZeroConn.RemoteAddr(), "file")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	br, ok := rc.(BlockReader)
+	if !assert.True(t, ok) {
+		return
+	}
+
+	for _, test := range []struct {
+		off  int64
+		data string
+		err  error
+	}{
+		{0, "01234", nil},
+		{5, "56789", nil},
+		{8, "89", nil},
+		{10, "", io.EOF},
+	} {
+		data, err := br.ReadBlock(test.off, 5)
+		assert.Equal(t, test.data, string(data))
+		assert.Equal(t, test.err, err)
+	}
+}
+
+func TestMemHandlerWriteFile(t *testing.T) {
+	h := NewMemHandler()
+
+	wc, err := h.WriteFile(context.Background(), ZeroConn.RemoteAddr(), "file")
+	if assert.Nil(t, err) {
+		_, err = wc.Write([]byte("data"))
+		assert.Nil(t, err)
+
+		// Nothing is stored until the file is closed.
+		_, ok := h.File("file")
+		assert.False(t, ok)
+
+		assert.Nil(t, wc.Close())
+		data, ok := h.File("file")
+		assert.True(t, ok)
+		assert.Equal(t, "data", string(data))
+	}
+
+	// An aborted write is discarded.
+	wc, err = h.WriteFile(context.Background(), ZeroConn.RemoteAddr(), "aborted")
+	if assert.Nil(t, err) {
+		_, err = wc.Write([]byte("partial"))
+		assert.Nil(t, err)
+		assert.Nil(t, wc.(Aborter).Abort(errors.New("aborted")))
+
+		_, ok := h.File("aborted")
+		assert.False(t, ok)
+	}
+}
+
+func TestMemHandlerConcurrent(t *testing.T) {
+	h := NewMemHandler()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			wc, _ := h.WriteFile(context.Background(), ZeroConn.RemoteAddr(), "file")
+			_, _ = wc.Write([]byte("data"))
+			_ = wc.Close()
+
+			rc, err := h.ReadFile(context.Background(), ZeroConn.RemoteAddr(), "file")
+			if assert.Nil(t, err) {
+				data, _ := ioutil.ReadAll(rc)
+				assert.Equal(t, "data", string(data))
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,110 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"context"
+	"net"
+	"os"
+)
+
+// HandlerFuncs adapts a pair of functions to a Handler. A nil function denies
+// the corresponding requests with os.ErrPermission.
+type HandlerFuncs struct {
+	Read  func(ctx context.Context, peer net.Addr, filename string) (ReadCloser, error)
+	Write func(ctx context.Context, peer net.Addr, filename string) (WriteCloser, error)
+}
+
+func (h HandlerFuncs) ReadFile(ctx context.Context, peer net.Addr, filename string) (ReadCloser, error) {
+	if h.Read == nil {
+		return nil, os.ErrPermission
+	}
+
+	return h.Read(ctx, peer, filename)
+}
+
+func (h HandlerFuncs) WriteFile(ctx context.Context, peer net.Addr, filename string) (WriteCloser, error) {
+	if h.Write == nil {
+		return nil, os.ErrPermission
+	}
+
+	return h.Write(ctx, peer, filename)
+}
+
+// Chain returns Handler h wrapped by middleware mw. The first middleware is
+// the outermost, so it sees a request first. A middleware can deny a request
+// by returning an error without calling the Handler it wraps.
+//
+// The returned Handler only implements the Handler interface. Optional
+// interfaces of h, such as OptionsNegotiator, are hidden by the middleware.
+func Chain(h Handler, mw ...func(Handler) Handler) Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+
+	return h
+}
+
+// AllowPeers returns middleware that denies requests from peers for which
+// allow returns false with os.ErrPermission.
+func AllowPeers(allow func(peer net.Addr) bool) func(Handler) Handler {
+	return func(h Handler) Handler {
+		return HandlerFuncs{
+			Read: func(ctx context.Context, peer net.Addr, filename string) (ReadCloser, error) {
+				if !allow(peer) {
+					return nil, os.ErrPermission
+				}
+				return h.ReadFile(ctx, peer, filename)
+			},
+			Write: func(ctx context.Context, peer net.Addr, filename string) (WriteCloser, error) {
+				if !allow(peer) {
+					return nil, os.ErrPermission
+				}
+				return h.WriteFile(ctx, peer, filename)
+			},
+		}
+	}
+}
+
+// LogRequests returns middleware that logs every request, along with the
+// error the Handler it wraps returned for it, through logf. A function such
+// as log.Printf can be passed as logf.
+func LogRequests(logf func(format string, v ...interface{})) func(Handler) Handler {
+	return func(h Handler) Handler {
+		return HandlerFuncs{
+			Read: func(ctx context.Context, peer net.Addr, filename string) (ReadCloser, error) {
+				rc, err := h.ReadFile(ctx, peer, filename)
+				logf("read %q from %v: %v", filename, peer, errString(err))
+				return rc, err
+			},
+			Write: func(ctx context.Context, peer net.Addr, filename string) (WriteCloser, error) {
+				wc, err := h.WriteFile(ctx, peer, filename)
+				logf("write %q from %v: %v", filename, peer, errString(err))
+				return wc, err
+			},
+		}
+	}
+}
+
+// errString returns the message of err, or "ok" if err is nil.
+func errString(err error) string {
+	if err == nil {
+		return "ok"
+	}
+
+	return err.Error()
+}
@@ -0,0 +1,90 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChain(t *testing.T) {
+	var calls []string
+	mw := func(name string) func(Handler) Handler {
+		return func(h Handler) Handler {
+			return HandlerFuncs{
+				Read: func(ctx context.Context, peer net.Addr, filename string) (ReadCloser, error) {
+					calls = append(calls, name)
+					return h.ReadFile(ctx, peer, filename)
+				},
+			}
+		}
+	}
+
+	h := NewMemHandler()
+	h.SetFile("file", []byte("data"))
+
+	// Middleware sees requests in order, with the peer address unchanged.
+	_, err := Chain(h, mw("a"), mw("b")).ReadFile(context.Background(), ZeroConn.RemoteAddr(), "file")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "b"}, calls)
+
+	// A nil function denies the request.
+	_, err = Chain(h, mw("a")).WriteFile(context.Background(), ZeroConn.RemoteAddr(), "file")
+	assert.Equal(t, os.ErrPermission, err)
+}
+
+func TestAllowPeers(t *testing.T) {
+	h := NewMemHandler()
+	h.SetFile("file", []byte("data"))
+
+	allowed := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}
+	denied := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1234}
+	c := Chain(h, AllowPeers(func(peer net.Addr) bool {
+		return peer.(*net.UDPAddr).IP.Equal(allowed.IP)
+	}))
+
+	_, err := c.ReadFile(context.Background(), allowed, "file")
+	assert.Nil(t, err)
+	_, err = c.WriteFile(context.Background(), allowed, "new")
+	assert.Nil(t, err)
+
+	_, err = c.ReadFile(context.Background(), denied, "file")
+	assert.Equal(t, os.ErrPermission, err)
+	_, err = c.WriteFile(context.Background(), denied, "new")
+	assert.Equal(t, os.ErrPermission, err)
+}
+
+func TestLogRequests(t *testing.T) {
+	var lines []string
+	logf := func(format string, v ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, v...))
+	}
+
+	c := Chain(NewMemHandler(), LogRequests(logf))
+	_, _ = c.ReadFile(context.Background(), ZeroConn.RemoteAddr(), "missing")
+	_, _ = c.WriteFile(context.Background(), ZeroConn.RemoteAddr(), "new")
+
+	assert.Equal(t, []string{
+		`read "missing" from 0.0.0.0: file does not exist`,
+		`write "new" from 0.0.0.0: ok`,
+	}, lines)
+}
@@ -0,0 +1,309 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+// Multicast read requests (RFC 2090).
+//
+// Clients that request the same file with the multicast option share a
+// multicast group, provided that its content and the block size are the
+// same. The DATA packets of the transfer are sent to the group,
+// where every client of the group receives them. Only one client, the master
+// client, acknowledges DATA packets. When the master client has received the
+// whole file, the next client of the group is made master client. It
+// acknowledges the last block it received contiguously, after which the
+// server continues sending from the block following it.
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// multicastGroup is the state shared by the sessions of a multicast group.
+type multicastGroup struct {
+	key  string
+	addr *net.UDPAddr
+	w    *packetWriterImpl // Sends packets to the group.
+
+	// The channels of the sessions in the group, in the order they joined.
+	// The first session serves the master client. Its channel is signalled
+	// when it becomes the first.
+	clients []chan struct{}
+
+	// The time the master client last acknowledged a block, which tells the
+	// other sessions whether the group still makes progress.
+	progressed time.Time
+}
+
+// multicastWriter sends DATA packets to a multicast group, and every other
+// packet to the peer of the session.
+type multicastWriter struct {
+	packetWriter
+
+	group packetWriter
+}
+
+func (w multicastWriter) write(x packet) error {
+	if _, ok := x.(*packetDATA); ok {
+		return w.group.write(x)
+	}
+
+	return w.packetWriter.write(x)
+}
+
+// joinGroup adds a session to the multicast group for key, which is created
+// at time now if it doesn't exist yet. The returned channel is signalled when
+// the session is to serve the master client.
+func (srv *Server) joinGroup(key string, now time.Time) (*multicastGroup, chan struct{}, error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	g, ok := srv.groups[key]
+	if !ok {
+		addr := srv.groupAddr()
+		conn, err := net.ListenPacket(udpNetwork(addr.IP), ":0")
+		if err != nil {
+			return nil, nil, err
+		}
+
+		g = &multicastGroup{
+			key:        key,
+			addr:       addr,
+			w:          &packetWriterImpl{PacketConn: conn, addr: addr, trace: srv.PacketTrace},
+			progressed: now,
+		}
+
+		if srv.groups == nil {
+			srv.groups = make(map[string]*multicastGroup)
+		}
+		srv.groups[key] = g
+	}
+
+	ch := make(chan struct{}, 1)
+	if len(g.clients) == 0 {
+		ch <- struct{}{}
+	}
+
+	g.clients = append(g.clients, ch)
+	return g, ch, nil
+}
+
+// leaveGroup removes the session with channel ch from multicast group g. If
+// the session served the master client, the next session in the group takes
+// over. The group is removed once its last session has left.
+func (srv *Server) leaveGroup(g *multicastGroup, ch chan struct{}) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	for i, c := range g.clients {
+		if c != ch {
+			continue
+		}
+
+		g.clients = append(g.clients[:i], g.clients[i+1:]...)
+		if i == 0 && len(g.clients) > 0 {
+			g.clients[0] <- struct{}{}
+		}
+		break
+	}
+
+	if len(g.clients) == 0 {
+		delete(srv.groups, g.key)
+		_ = g.w.PacketConn.Close()
+	}
+}
+
+// groupProgressed records that multicast group g made progress at time t.
+func (srv *Server) groupProgressed(g *multicastGroup, t time.Time) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	g.progressed = t
+}
+
+// groupIdle returns how long multicast group g has not made progress at time
+// t.
+func (srv *Server) groupIdle(g *multicastGroup, t time.Time) time.Duration {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	return t.Sub(g.progressed)
+}
+
+// contentKey identifies the content of file r of the given size, so that
+// requests for files of the same name but with different content don't share
+// a multicast group.
+func contentKey(r io.ReaderAt, size int64) string {
+	if k, ok := r.(ContentKeyer); ok {
+		return k.ContentKey()
+	}
+
+	key := strconv.FormatInt(size, 10)
+	if st, ok := r.(interface{ Stat() (os.FileInfo, error) }); ok {
+		if fi, err := st.Stat(); err == nil {
+			key += "@" + fi.ModTime().UTC().Format(time.RFC3339Nano)
+		}
+	}
+
+	return key
+}
+
+// groupAddr returns the address for a new multicast group. Groups use the IP
+// address of srv.MulticastAddr, with the lowest port from srv.MulticastAddr
+// onwards that isn't used by another group.
+func (srv *Server) groupAddr() *net.UDPAddr {
+	port := srv.MulticastAddr.Port
+	for used := true; used; {
+		used = false
+		for _, g := range srv.groups {
+			if g.addr.Port == port {
+				used = true
+				port++
+				break
+			}
+		}
+	}
+
+	return &net.UDPAddr{IP: srv.MulticastAddr.IP, Port: port, Zone: srv.MulticastAddr.Zone}
+}
+
+// serveMulticast serves a read request for which the multicast option was
+// negotiated. The file is read from r, which holds size bytes. The options
+// argument holds the other options to include in the OACK.
+func (s *session) serveMulticast(r io.ReaderAt, size int64, options map[string]string) error {
+	// Only clients that use the same block size can share a group. The
+	// content key is quoted, so that it can't run into the filename.
+	key := fmt.Sprintf("%d/%q/%s", s.blksize, contentKey(r, size), s.filename)
+	g, ch, err := s.srv.joinGroup(key, s.clock.Now())
+	if err != nil {
+		return s.abort(tftpErrNotDefined, err)
+	}
+
+	defer s.srv.leaveGroup(g, ch)
+
+	var master bool
+	select {
+	case <-ch:
+		master = true
+	default:
+	}
+
+	mc := 0
+	if master {
+		mc = 1
+	}
+
+	options["multicast"] = fmt.Sprintf("%s,%d,%d", g.addr.IP, g.addr.Port, mc)
+	s.log(Event{Type: EventNegotiate, Options: options})
+
+	oack := &packetOACK{options: options}
+	if !master {
+		// Other clients don't reply to the OACK. They receive the DATA packets
+		// that are sent to the group until they are made master client. The
+		// address of the group is not repeated at that point.
+		if err = s.write(oack); err != nil {
+			return err
+		}
+
+		if err = s.waitForMaster(g, ch); err != nil {
+			return err
+		}
+
+		oack = &packetOACK{options: map[string]string{"multicast": ",,1"}}
+	}
+
+	// The master client replies with an ACK for the last block it received
+	// contiguously, which is 0 if it didn't receive any. Block numbers are
+	// assumed not to have wrapped around at this point.
+	px, err := s.writeAndWaitForPacket(oack, func(p packet) bool {
+		_, ok := p.(*packetACK)
+		return ok
+	})
+	if err != nil {
+		return err
+	}
+
+	s.srv.groupProgressed(g, s.clock.Now())
+	unicast := s.packetWriter
+	s.packetWriter = multicastWriter{packetWriter: unicast, group: g.w}
+	defer func() {
+		s.packetWriter = unicast
+	}()
+
+	// Blocks are numbered from 1, with the final block holding less than
+	// "blksize" bytes.
+	final := int(size/int64(s.blksize)) + 1
+	buf := make([]byte, s.blksize)
+	for acked := int(px.(*packetACK).blockNr); acked < final; {
+		i := acked + 1
+		n, err := r.ReadAt(buf, int64(i-1)*int64(s.blksize))
+		if err != nil && err != io.EOF {
+			return s.abort(tftpErrNotDefined, err)
+		}
+
+		// The master client may acknowledge an earlier block if it missed a
+		// DATA packet, in which case sending resumes from the block after it.
+		p := &packetDATA{blockNr: uint16(i), data: buf[:n]}
+		px, err := s.writeAndWaitForPacket(p, func(p packet) bool {
+			ack, ok := p.(*packetACK)
+			return ok && int(uint16(i)-ack.blockNr) <= i
+		})
+		if err != nil {
+			return err
+		}
+
+		acked = i - int(uint16(i)-px.(*packetACK).blockNr)
+		if acked == i {
+			s.transferred(buf[:n])
+			s.srv.groupProgressed(g, s.clock.Now())
+		}
+	}
+
+	return nil
+}
+
+// waitForMaster waits until the session is made master client of multicast
+// group g, which is signalled through ch. The wait is abandoned once the
+// group has not made progress for IdleTimeout, or if it isn't set, for as
+// long as the session would wait for a reply before giving up.
+func (s *session) waitForMaster(g *multicastGroup, ch chan struct{}) error {
+	limit := s.idleTimeout
+	if limit <= 0 {
+		limit = s.timeout * time.Duration(s.retries+1)
+	}
+
+	t := time.NewTimer(limit)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ch:
+			return nil
+		case <-s.ctx.Done():
+			return s.abort(tftpErrNotDefined, s.ctx.Err())
+		case <-t.C:
+			idle := s.srv.groupIdle(g, s.clock.Now())
+			if idle >= limit {
+				return s.abort(tftpErrNotDefined, errIdle)
+			}
+			t.Reset(limit - idle)
+		}
+	}
+}
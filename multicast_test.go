@@ -0,0 +1,284 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type rcReaderAt struct {
+	*bytes.Reader
+}
+
+func (r *rcReaderAt) Close() error {
+	return nil
+}
+
+// readerAtHandler serves reads from data through an io.ReaderAt.
+type readerAtHandler struct {
+	data []byte
+}
+
+func (h readerAtHandler) ReadFile(ctx context.Context, peer net.Addr, filename string) (ReadCloser, error) {
+	return &rcReaderAt{bytes.NewReader(h.data)}, nil
+}
+
+func (h readerAtHandler) WriteFile(ctx context.Context, peer net.Addr, filename string) (WriteCloser, error) {
+	return nil, nil
+}
+
+func TestServeMulticast(t *testing.T) {
+	// The group is a unicast socket in this test, which receives the DATA
+	// packets on behalf of every client.
+	g, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	group := &testClient{PacketConn: g, t: t}
+	defer group.Close()
+
+	srv := NewServer(readerAtHandler{data: []byte("0123456789abcdef01")})
+	srv.MulticastAddr = g.LocalAddr().(*net.UDPAddr)
+
+	l, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		_ = srv.Serve(l)
+	}()
+
+	var clients []*testClient
+	for _, mc := range []int{1, 0} {
+		c := newTestClient(t, l.LocalAddr())
+		defer c.Close()
+
+		c.write(&packetRRQ{packetXRQ{
+			filename: "file",
+			mode:     modeOCTET,
+			options:  map[string]string{"multicast": "", "blksize": "8"},
+		}})
+
+		var px packet
+		px, c.addr = c.read()
+		assert.Equal(t, &packetOACK{options: map[string]string{
+			"multicast": fmt.Sprintf("%s,%d,%d", srv.MulticastAddr.IP, srv.MulticastAddr.Port, mc),
+			"blksize":   "8",
+		}}, px)
+
+		clients = append(clients, c)
+	}
+
+	blocks := []*packetDATA{
+		{blockNr: 1, data: []byte("01234567")},
+		{blockNr: 2, data: []byte("89abcdef")},
+		{blockNr: 3, data: []byte("01")},
+	}
+
+	// The master client receives the whole file through the group.
+	master := clients[0]
+	for i, b := range blocks {
+		master.write(&packetACK{blockNr: uint16(i)})
+		px, _ := group.read()
+		assert.Equal(t, b, px)
+	}
+	master.write(&packetACK{blockNr: 3})
+
+	// The next client is made master client, and asks for the blocks it
+	// missed.
+	master = clients[1]
+	px, _ := master.read()
+	assert.Equal(t, &packetOACK{options: map[string]string{"multicast": ",,1"}}, px)
+
+	master.write(&packetACK{blockNr: 1})
+	px, _ = group.read()
+	assert.Equal(t, blocks[1], px)
+
+	// An ACK for an earlier block means that a DATA packet was missed.
+	master.write(&packetACK{blockNr: 1})
+	px, _ = group.read()
+	assert.Equal(t, blocks[1], px)
+
+	master.write(&packetACK{blockNr: 2})
+	px, _ = group.read()
+	assert.Equal(t, blocks[2], px)
+	master.write(&packetACK{blockNr: 3})
+}
+
+func TestServeMulticastDeclined(t *testing.T) {
+	srv := NewServer(bufHandler{data: []byte("0123")})
+	srv.MulticastAddr = &net.UDPAddr{IP: net.IPv4(239, 0, 0, 1), Port: 1758}
+
+	l, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		_ = srv.Serve(l)
+	}()
+
+	c := newTestClient(t, l.LocalAddr())
+	defer c.Close()
+
+	// The file cannot be read at random, so the option is declined.
+	c.write(&packetRRQ{packetXRQ{
+		filename: "file",
+		mode:     modeOCTET,
+		options:  map[string]string{"multicast": "", "blksize": "8"},
+	}})
+
+	px, addr := c.read()
+	assert.Equal(t, &packetOACK{options: map[string]string{"blksize": "8"}}, px)
+	c.addr = addr
+
+	c.write(&packetACK{blockNr: 0})
+	px, _ = c.read()
+	assert.Equal(t, &packetDATA{blockNr: 1, data: []byte("0123")}, px)
+	c.write(&packetACK{blockNr: 1})
+}
+
+// keyedReaderAt is an rcReaderAt with a content key.
+type keyedReaderAt struct {
+	rcReaderAt
+	key string
+}
+
+func (r *keyedReaderAt) ContentKey() string {
+	return r.key
+}
+
+// keyedHandler serves the file with the next key from keys for every read
+// request.
+type keyedHandler struct {
+	readerAtHandler
+	keys chan string
+}
+
+func (h keyedHandler) ReadFile(ctx context.Context, peer net.Addr, filename string) (ReadCloser, error) {
+	return &keyedReaderAt{rcReaderAt{bytes.NewReader(h.data)}, <-h.keys}, nil
+}
+
+func TestServeMulticastContentKey(t *testing.T) {
+	keys := make(chan string, 2)
+	keys <- "v1"
+	keys <- "v2"
+
+	srv := NewServer(keyedHandler{readerAtHandler{data: []byte("0123")}, keys})
+	srv.MulticastAddr = &net.UDPAddr{IP: net.IPv4(239, 0, 0, 1), Port: 1758}
+
+	l, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		_ = srv.Serve(l)
+	}()
+
+	// Every version of the file gets its own group, of which the client is
+	// the master client.
+	for _, port := range []int{1758, 1759} {
+		c := newTestClient(t, l.LocalAddr())
+		defer c.Close()
+
+		c.write(&packetRRQ{packetXRQ{
+			filename: "file",
+			mode:     modeOCTET,
+			options:  map[string]string{"multicast": ""},
+		}})
+
+		px, _ := c.read()
+		assert.Equal(t, &packetOACK{options: map[string]string{
+			"multicast": fmt.Sprintf("239.0.0.1,%d,1", port),
+		}}, px)
+	}
+}
+
+// blockingReaderAt is an rcReaderAt whose ReadAt blocks until release is
+// closed.
+type blockingReaderAt struct {
+	rcReaderAt
+	release chan struct{}
+}
+
+func (r *blockingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	<-r.release
+	return r.rcReaderAt.ReadAt(p, off)
+}
+
+type blockingHandler struct {
+	readerAtHandler
+	release chan struct{}
+}
+
+func (h blockingHandler) ReadFile(ctx context.Context, peer net.Addr, filename string) (ReadCloser, error) {
+	return &blockingReaderAt{rcReaderAt{bytes.NewReader(h.data)}, h.release}, nil
+}
+
+func TestServeMulticastStalled(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	srv := NewServer(blockingHandler{readerAtHandler{data: []byte("0123")}, release})
+	srv.MulticastAddr = &net.UDPAddr{IP: net.IPv4(239, 0, 0, 1), Port: 1758}
+	srv.IdleTimeout = 100 * time.Millisecond
+
+	l, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		_ = srv.Serve(l)
+	}()
+
+	var clients []*testClient
+	for i := 0; i < 2; i++ {
+		c := newTestClient(t, l.LocalAddr())
+		defer c.Close()
+
+		c.write(&packetRRQ{packetXRQ{
+			filename: "file",
+			mode:     modeOCTET,
+			options:  map[string]string{"multicast": ""},
+		}})
+
+		var px packet
+		px, c.addr = c.read()
+		assert.IsType(t, &packetOACK{}, px)
+		clients = append(clients, c)
+	}
+
+	// The master client's session is stuck reading the file, so the other
+	// client gives up waiting for it.
+	clients[0].write(&packetACK{blockNr: 0})
+	px, _ := clients[1].read()
+	assert.IsType(t, &packetERROR{}, px)
+}
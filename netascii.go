@@ -0,0 +1,208 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+// Conversion between local and netascii line endings.
+//
+// In netascii mode, a line ends with CR LF and a bare CR is sent as CR NUL
+// (RFC 764). Locally, a line ends with LF.
+
+import (
+	"bufio"
+	"hash"
+	"io"
+)
+
+// netasciiReader converts the data read from a ReadCloser to netascii.
+type netasciiReader struct {
+	rc ReadCloser
+	r  *bufio.Reader
+
+	next    byte // The byte to return before reading the next one.
+	pending bool // Whether next is valid.
+}
+
+func newNetasciiReader(rc ReadCloser) *netasciiReader {
+	return &netasciiReader{
+		rc: rc,
+		r:  bufio.NewReader(rc),
+	}
+}
+
+// hashTo makes the reader write the data it reads from the ReadCloser to h,
+// before it is converted. It must be called before the first Read.
+func (n *netasciiReader) hashTo(h hash.Hash) {
+	n.r.Reset(io.TeeReader(n.rc, h))
+}
+
+func (n *netasciiReader) Read(p []byte) (int, error) {
+	i := 0
+	for i < len(p) {
+		// The second byte of a translated sequence may not have fit in the
+		// previous buffer.
+		if n.pending {
+			p[i] = n.next
+			n.pending = false
+			i++
+			continue
+		}
+
+		c, err := n.r.ReadByte()
+		if err != nil {
+			if err == io.EOF && i > 0 {
+				err = nil
+			}
+			return i, err
+		}
+
+		switch c {
+		case '\n':
+			p[i] = '\r'
+			n.next = '\n'
+			n.pending = true
+		case '\r':
+			p[i] = '\r'
+			n.next = 0
+			n.pending = true
+		default:
+			p[i] = c
+		}
+
+		i++
+	}
+
+	return i, nil
+}
+
+func (n *netasciiReader) Close() error {
+	return n.rc.Close()
+}
+
+// netasciiWriter converts netascii data to local data before writing it to a
+// WriteCloser.
+type netasciiWriter struct {
+	wc   WriteCloser
+	hash hash.Hash // Written with the converted data, if not nil.
+
+	buf []byte
+	cr  bool // Whether the last byte written was a CR.
+}
+
+func newNetasciiWriter(wc WriteCloser) *netasciiWriter {
+	return &netasciiWriter{
+		wc: wc,
+	}
+}
+
+func (n *netasciiWriter) Write(p []byte) (int, error) {
+	n.buf = n.buf[:0]
+	for _, c := range p {
+		// What a CR translates to depends on the byte following it, which may
+		// only be written in the next call.
+		if n.cr {
+			n.cr = false
+			switch c {
+			case '\n':
+				n.buf = append(n.buf, '\n')
+				continue
+			case 0:
+				n.buf = append(n.buf, '\r')
+				continue
+			default:
+				// Not valid netascii; pass it through as is.
+				n.buf = append(n.buf, '\r')
+			}
+		}
+
+		if c == '\r' {
+			n.cr = true
+			continue
+		}
+
+		n.buf = append(n.buf, c)
+	}
+
+	_, err := n.write(n.buf)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// write writes converted data to the WriteCloser, and to the hash once it is
+// written.
+func (n *netasciiWriter) write(p []byte) (int, error) {
+	m, err := n.wc.Write(p)
+	if err == nil && n.hash != nil {
+		n.hash.Write(p)
+	}
+
+	return m, err
+}
+
+// Flush writes a trailing CR like Close does, and flushes the WriteCloser if
+// it is a Flusher.
+func (n *netasciiWriter) Flush() error {
+	if n.cr {
+		n.cr = false
+		_, err := n.write([]byte{'\r'})
+		if err != nil {
+			return err
+		}
+	}
+
+	if f, ok := n.wc.(Flusher); ok {
+		return f.Flush()
+	}
+
+	return nil
+}
+
+// Sync syncs the WriteCloser if it is a Syncer.
+func (n *netasciiWriter) Sync() error {
+	if s, ok := n.wc.(Syncer); ok {
+		return s.Sync()
+	}
+
+	return nil
+}
+
+func (n *netasciiWriter) Close() error {
+	// A trailing CR is not valid netascii; pass it through as is.
+	if n.cr {
+		n.cr = false
+		_, err := n.write([]byte{'\r'})
+		if err != nil {
+			_ = n.wc.Close()
+			return err
+		}
+	}
+
+	return n.wc.Close()
+}
+
+// Abort discards a trailing CR and aborts the underlying WriteCloser, or
+// closes it if it does not implement Aborter.
+func (n *netasciiWriter) Abort(err error) error {
+	n.cr = false
+	if a, ok := n.wc.(Aborter); ok {
+		return a.Abort(err)
+	}
+
+	return n.wc.Close()
+}
@@ -0,0 +1,98 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var netasciiTests = []struct {
+	local    string
+	netascii string
+}{
+	{"", ""},
+	{"hello", "hello"},
+	{"hello\n", "hello\r\n"},
+	{"\n\n", "\r\n\r\n"},
+	{"a\rb", "a\r\x00b"},
+	{"\r\n", "\r\x00\r\n"},
+	{"\r", "\r\x00"},
+}
+
+func TestNetasciiReader(t *testing.T) {
+	for _, test := range netasciiTests {
+		rc := &rcBuffer{iotest.OneByteReader(bytes.NewBufferString(test.local))}
+		b, err := ioutil.ReadAll(newNetasciiReader(rc))
+		assert.Nil(t, err)
+		assert.Equal(t, test.netascii, string(b))
+	}
+}
+
+func TestNetasciiReaderSmallBuffer(t *testing.T) {
+	// Every translated sequence straddles a buffer boundary.
+	r := newNetasciiReader(&rcBuffer{bytes.NewBufferString("\n\r\n")})
+	for _, expected := range []byte("\r\n\r\x00\r\n") {
+		var b [1]byte
+		n, err := r.Read(b[:])
+		assert.Nil(t, err)
+		assert.Equal(t, 1, n)
+		assert.Equal(t, expected, b[0])
+	}
+
+	n, err := r.Read(make([]byte, 1))
+	assert.Equal(t, 0, n)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestNetasciiWriter(t *testing.T) {
+	for _, test := range netasciiTests {
+		// Split the input at every possible position, so that translated
+		// sequences straddle the boundary between two writes.
+		for i := 0; i <= len(test.netascii); i++ {
+			var buf bytes.Buffer
+			w := newNetasciiWriter(&wcBuffer{&buf})
+
+			n, err := w.Write([]byte(test.netascii[:i]))
+			assert.Nil(t, err)
+			assert.Equal(t, i, n)
+
+			n, err = w.Write([]byte(test.netascii[i:]))
+			assert.Nil(t, err)
+			assert.Equal(t, len(test.netascii)-i, n)
+
+			assert.Nil(t, w.Close())
+			assert.Equal(t, test.local, buf.String())
+		}
+	}
+}
+
+func TestNetasciiWriterInvalid(t *testing.T) {
+	var buf bytes.Buffer
+	w := newNetasciiWriter(&wcBuffer{&buf})
+
+	// A CR that is not followed by LF or NUL is passed through as is.
+	_, err := w.Write([]byte("a\rb\r"))
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+	assert.Equal(t, "a\rb\r", buf.String())
+}
@@ -0,0 +1,199 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// CustomOptionFunc negotiates an option that the server doesn't implement
+// itself, as registered with Server.RegisterOption. It is called with the
+// context of the session, which is the one passed to the Handler, and the
+// value the peer requested, and returns the value to acknowledge. If ok is
+// false, the option is declined, and omitted from the OACK. An error rejects
+// the request with an "option negotiation" error.
+//
+// It is called after ReadFile or WriteFile, and before the OptionsNegotiator
+// of the Handler, which may still decline the option.
+type CustomOptionFunc func(ctx context.Context, value string) (ack string, ok bool, err error)
+
+// RegisterOption registers fn to negotiate the option name, which is not an
+// option that the server implements, such as an option of a custom scheme of
+// some clients. Option names are case insensitive. A registered option is no
+// longer unknown to StrictOptions.
+//
+// RegisterOption panics if the server implements the option itself, or if it
+// was registered before.
+func (srv *Server) RegisterOption(name string, fn CustomOptionFunc) {
+	name = strings.ToLower(name)
+	if builtinOption(name) {
+		panic("gotftp: option " + name + " is implemented by the server")
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if _, ok := srv.options[name]; ok {
+		panic("gotftp: option " + name + " registered twice")
+	}
+
+	if srv.options == nil {
+		srv.options = make(map[string]CustomOptionFunc)
+	}
+	srv.options[name] = fn
+}
+
+// customOption returns the function registered for option name, if any.
+func (srv *Server) customOption(name string) CustomOptionFunc {
+	if srv == nil {
+		return nil
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.options[name]
+}
+
+var (
+	errOffsetSeek    = errors.New("offset requires a seekable file")
+	errOffsetBlksize = errors.New("offset not a multiple of blksize")
+	errOffsetSize    = errors.New("offset beyond end of file")
+)
+
+// offsetRequest holds the offset that a CustomOptionFunc set for a read
+// request, along with the option that set it.
+type offsetRequest struct {
+	negotiating string // The option being negotiated, if it may set the offset.
+	option      string // The option that set the offset, if any.
+	offset      int64
+}
+
+// offsetContextKey is the context key for the offsetRequest of a session.
+var offsetContextKey = contextKey{"offset"}
+
+// SetOffset sets the offset in the file at which the read request of the
+// session that ctx belongs to starts, for an option that resumes a download.
+// It must be called from a CustomOptionFunc, and takes effect only if the
+// option is acknowledged.
+//
+// The ReadCloser is seeked to offset before the transfer starts, and tsize
+// reports the size of the remainder. Block numbers continue from the offset,
+// so that every block has the number it has in a transfer of the whole file.
+// The request is rejected with an "option negotiation" error if the
+// ReadCloser doesn't implement io.Seeker, the offset is beyond the end of the
+// file, or it is not a multiple of the negotiated blksize. Multicast is not
+// available for such a transfer.
+//
+// SetOffset returns false if ctx doesn't belong to a session that is
+// negotiating an option of a read request.
+func SetOffset(ctx context.Context, offset int64) bool {
+	o, ok := ctx.Value(offsetContextKey).(*offsetRequest)
+	if !ok || o.negotiating == "" || offset < 0 {
+		return false
+	}
+
+	o.option, o.offset = o.negotiating, offset
+	return true
+}
+
+// negotiateCustom negotiates the options in o that have a CustomOptionFunc
+// registered, and adds the accepted ones to oack.
+func (s *session) negotiateCustom(o, oack map[string]string) error {
+	for name, requested := range o {
+		fn := s.srv.customOption(name)
+		if fn == nil {
+			continue
+		}
+
+		accepted, ok, err := customOptionFunc(name, fn)(s, requested)
+		if err != nil {
+			return err
+		}
+		if ok {
+			oack[name] = accepted
+		}
+	}
+
+	return nil
+}
+
+// customOptionFunc returns the optionFunc for option name, which calls fn.
+func customOptionFunc(name string, fn CustomOptionFunc) optionFunc {
+	return func(s *session, requested string) (string, bool, error) {
+		// Only the options of a read request may set the offset.
+		if s.seek != nil && !s.wrq {
+			s.seek.negotiating = name
+			defer func() { s.seek.negotiating = "" }()
+		}
+
+		return fn(s.ctx, requested)
+	}
+}
+
+// seekOffset seeks r to the offset set by the CustomOptionFunc of an option
+// that was acknowledged, if any, and updates tsize in options accordingly.
+func (s *session) seekOffset(r io.Reader, options map[string]string) error {
+	if s.seek == nil || s.seek.option == "" {
+		return nil
+	}
+
+	if _, ok := options[s.seek.option]; !ok {
+		return nil
+	}
+
+	seeker, ok := r.(io.Seeker)
+	if !ok {
+		return errOffsetSeek
+	}
+
+	if s.seek.offset%int64(s.blksize) != 0 {
+		return errOffsetBlksize
+	}
+
+	n, err := seeker.Seek(s.seek.offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	remaining, ok := size(r)
+	if ok && remaining < 0 {
+		return errOffsetSize
+	}
+
+	s.offset, s.skip = n, n
+	if _, present := options["tsize"]; present && ok {
+		s.tsize = remaining
+		options["tsize"] = strconv.FormatInt(remaining, 10)
+	}
+
+	return nil
+}
+
+// firstBlockNr returns the block number of the first DATA packet of the
+// transfer, which follows the blocks that were skipped by SetOffset.
+func (s *session) firstBlockNr() uint16 {
+	blocks := s.skip / int64(s.blksize)
+	if s.rollover == 1 {
+		return uint16(1 + blocks%65535)
+	}
+
+	return uint16(1 + blocks)
+}
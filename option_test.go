@@ -0,0 +1,196 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// offsetOption is a CustomOptionFunc for an option that resumes a download.
+func offsetOption(ctx context.Context, value string) (string, bool, error) {
+	offset, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return "", false, err
+	}
+
+	if !SetOffset(ctx, offset) {
+		return "", false, nil
+	}
+	return value, true, nil
+}
+
+func TestRegisterOption(t *testing.T) {
+	data := make([]byte, 1500)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	h := newHandlerContextWith(func(srv *Server) {
+		srv.RegisterOption("Offset", offsetOption)
+	})
+	h.SetReadCloser(&rcSeeker{bytes.NewReader(data)})
+
+	// The transfer starts at the offset, with the block numbers it has in a
+	// transfer of the whole file.
+	h.Negotiate(t, map[string]string{"offset": "1024", "blksize": "512"})
+	assert.Equal(t, &packetDATA{blockNr: 3, data: data[1024:]}, <-h.rcv)
+	h.snd <- &packetACK{blockNr: 3}
+	close(h.snd)
+
+	_, ok := <-h.rcv
+	assert.False(t, ok)
+}
+
+func TestRegisterOptionTsize(t *testing.T) {
+	h := newHandlerContextWith(func(srv *Server) {
+		srv.RegisterOption("offset", offsetOption)
+	})
+	h.SetReadCloser(&rcSeeker{bytes.NewReader(make([]byte, 1500))})
+
+	h.snd <- &packetRRQ{packetXRQ{filename: "file", options: map[string]string{"offset": "512", "tsize": "0"}}}
+	assert.Equal(t, &packetOACK{options: map[string]string{"offset": "512", "tsize": "988"}}, <-h.rcv)
+}
+
+func TestRegisterOptionRejected(t *testing.T) {
+	var tests = []struct {
+		rc     ReadCloser
+		offset string
+		err    error
+	}{
+		{&rcBuffer{bytes.NewReader(make([]byte, 1500))}, "512", errOffsetSeek},
+		{&rcSeeker{bytes.NewReader(make([]byte, 1500))}, "100", errOffsetBlksize},
+		{&rcSeeker{bytes.NewReader(make([]byte, 1500))}, "2048", errOffsetSize},
+	}
+
+	for _, test := range tests {
+		h := newHandlerContextWith(func(srv *Server) {
+			srv.RegisterOption("offset", offsetOption)
+		})
+		h.SetReadCloser(test.rc)
+
+		h.snd <- &packetRRQ{packetXRQ{filename: "file", options: map[string]string{"offset": test.offset}}}
+		assert.Equal(t, &packetERROR{errorCode: 8, errorMessage: test.err.Error()}, <-h.rcv)
+	}
+}
+
+func TestRegisterOptionDeclined(t *testing.T) {
+	errBad := errors.New("bad value")
+	h := newHandlerContextWith(func(srv *Server) {
+		srv.StrictOptions = true
+		srv.RegisterOption("a", func(ctx context.Context, value string) (string, bool, error) {
+			return "", false, nil
+		})
+		srv.RegisterOption("b", func(ctx context.Context, value string) (string, bool, error) {
+			return "2", true, nil
+		})
+	})
+
+	// A declined option is omitted from the OACK, and registered options are
+	// known to StrictOptions.
+	h.snd <- &packetRRQ{packetXRQ{filename: "file", options: map[string]string{"a": "1", "b": "1"}}}
+	assert.Equal(t, &packetOACK{options: map[string]string{"b": "2"}}, <-h.rcv)
+
+	// An error rejects the request.
+	h = newHandlerContextWith(func(srv *Server) {
+		srv.RegisterOption("a", func(ctx context.Context, value string) (string, bool, error) {
+			return "", false, errBad
+		})
+	})
+	h.snd <- &packetRRQ{packetXRQ{filename: "file", options: map[string]string{"a": "1"}}}
+	assert.Equal(t, &packetERROR{errorCode: 8, errorMessage: errBad.Error()}, <-h.rcv)
+
+	// The offset of a write request cannot be set.
+	h = newHandlerContextWith(func(srv *Server) {
+		srv.RegisterOption("offset", offsetOption)
+	})
+	h.snd <- &packetWRQ{packetXRQ{filename: "file", options: map[string]string{"offset": "512", "blksize": "512"}}}
+	assert.Equal(t, &packetOACK{options: map[string]string{"blksize": "512"}}, <-h.rcv)
+}
+
+func TestRegisterOptionPanics(t *testing.T) {
+	srv := NewServer(nil)
+	srv.RegisterOption("offset", offsetOption)
+
+	assert.Panics(t, func() { srv.RegisterOption("OFFSET", offsetOption) })
+	assert.Panics(t, func() { srv.RegisterOption("blksize", offsetOption) })
+	assert.False(t, SetOffset(context.Background(), 512))
+}
+
+func TestFirstBlockNr(t *testing.T) {
+	var tests = []struct {
+		skip     int64
+		rollover uint16
+		blockNr  uint16
+	}{
+		{0, 0, 1},
+		{512, 0, 2},
+		{65535 * 512, 0, 0},
+		{65536 * 512, 0, 1},
+		{65535 * 512, 1, 1},
+		{65536 * 512, 1, 2},
+	}
+
+	for _, test := range tests {
+		s := &session{blksize: 512, skip: test.skip, rollover: test.rollover}
+		assert.Equal(t, test.blockNr, s.firstBlockNr(), test.skip)
+	}
+}
+
+func TestLenientOACK(t *testing.T) {
+	data := bytes.Repeat([]byte{0x1}, 600)
+	rrq := &packetRRQ{packetXRQ{filename: "file", options: map[string]string{"blksize": "8", "windowsize": "4"}}}
+	oack := &packetOACK{options: map[string]string{"blksize": "8", "windowsize": "4"}}
+
+	// By default, an OACK that is never acknowledged fails the transfer.
+	h := newHandlerContextWith(func(srv *Server) {
+		srv.Retries = 1
+	})
+	h.SetReadCloser(&rcBuffer{bytes.NewBuffer(data)})
+	h.snd <- rrq
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, oack, <-h.rcv)
+		h.snd <- ErrTimeout
+	}
+	_, ok := <-h.rcv
+	assert.False(t, ok)
+
+	// Otherwise, the transfer proceeds as if no options were requested.
+	h = newHandlerContextWith(func(srv *Server) {
+		srv.Retries = 1
+		srv.DefaultBlksize = 1024
+		srv.LenientOACK = true
+	})
+	h.SetReadCloser(&rcBuffer{bytes.NewBuffer(data)})
+	h.snd <- rrq
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, oack, <-h.rcv)
+		h.snd <- ErrTimeout
+	}
+	assert.Equal(t, &packetDATA{blockNr: 1, data: data[:512]}, <-h.rcv)
+	h.snd <- &packetACK{blockNr: 1}
+	assert.Equal(t, &packetDATA{blockNr: 2, data: data[512:]}, <-h.rcv)
+	h.snd <- &packetACK{blockNr: 2}
+	h.snd <- ErrTimeout
+	_, ok = <-h.rcv
+	assert.False(t, ok)
+}
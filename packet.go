@@ -22,6 +22,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"strings"
 )
@@ -39,6 +40,7 @@ const (
 
 	modeNETASCII = mode("netascii")
 	modeOCTET    = mode("octet")
+	modeMAIL     = mode("mail")
 )
 
 type tftpError struct {
@@ -48,22 +50,28 @@ type tftpError struct {
 
 var (
 	// Error codes as defined by the TFTP spec.
-	tftpErrNotDefined        = tftpError{0, "Not defined, see error message (if any)."}
-	tftpErrNotFound          = tftpError{1, "File not found."}
-	tftpErrAccessViolation   = tftpError{2, "Access violation."}
-	tftpErrDiskFull          = tftpError{3, "Disk full or allocation exceeded."}
-	tftpErrIllegalOperation  = tftpError{4, "Illegal TFTP operation."}
-	tftpErrUnknownTransferID = tftpError{5, "Unknown transfer ID."}
-	tftpErrFileAlreadyExists = tftpError{6, "File already exists."}
-	tftpErrNoSuchUser        = tftpError{7, "No such user."}
-	tftpErrOptionNegotiation = tftpError{8, "Option negotiation error."}
+	tftpErrNotDefined        = tftpError{CodeNotDefined, "Not defined, see error message (if any)."}
+	tftpErrNotFound          = tftpError{CodeFileNotFound, "File not found."}
+	tftpErrAccessViolation   = tftpError{CodeAccessViolation, "Access violation."}
+	tftpErrDiskFull          = tftpError{CodeDiskFull, "Disk full or allocation exceeded."}
+	tftpErrIllegalOperation  = tftpError{CodeIllegalOperation, "Illegal TFTP operation."}
+	tftpErrUnknownTransferID = tftpError{CodeUnknownTransferID, "Unknown transfer ID."}
+	tftpErrFileAlreadyExists = tftpError{CodeFileAlreadyExists, "File already exists."}
+	tftpErrNoSuchUser        = tftpError{CodeNoSuchUser, "No such user."}
+	tftpErrOptionNegotiation = tftpError{CodeOptionNegotiation, "Option negotiation error."}
 )
 
 var (
-	errOpcode = errors.New("invalid opcode")
-	errMode   = errors.New("invalid mode")
+	errOpcode   = errors.New("invalid opcode")
+	errMode     = errors.New("invalid mode")
+	errFilename = errors.New("filename too long")
 )
 
+// maxFilename is the maximum length of the filename in a request. A request
+// packet, options included, is limited to 512 bytes (RFC 2347), so a longer
+// filename is certainly malformed.
+const maxFilename = 512
+
 // Packet is the interface that every TFTP packet implements.
 type packet interface {
 	Read(b *bytes.Buffer) error
@@ -136,6 +144,11 @@ type packetXRQ struct {
 func (p *packetXRQ) Read(b *bytes.Buffer) error {
 	var err error
 
+	// The length is checked before the filename is copied out of the buffer.
+	if i := bytes.IndexByte(b.Bytes(), 0); i > maxFilename {
+		return errFilename
+	}
+
 	p.filename, err = readChunk(b)
 	if err != nil {
 		return err
@@ -146,10 +159,10 @@ func (p *packetXRQ) Read(b *bytes.Buffer) error {
 		return err
 	}
 
-	// Check if mode is valid
+	// Check if mode is valid. Modes are case-insensitive (RFC 1350).
 	p.mode = mode(strings.ToLower(m))
-	if p.mode != modeNETASCII && p.mode != modeOCTET {
-		return errMode
+	if p.mode != modeNETASCII && p.mode != modeOCTET && p.mode != modeMAIL {
+		return fmt.Errorf("%w %q", errMode, m)
 	}
 
 	p.options, err = readOptions(b)
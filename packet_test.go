@@ -19,7 +19,9 @@ package gotftp
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"io"
+	"math/rand"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -77,7 +79,36 @@ func testReadPacketXRQ(t *testing.T, prefix []byte) {
 		b.WriteString("filename\x00")
 		b.WriteString("invalid\x00")
 		_, err = packetFromWire(&b)
-		assert.Equal(t, err, errMode)
+		assert.True(t, errors.Is(err, errMode))
+		assert.Equal(t, `invalid mode "invalid"`, err.Error())
+	}
+
+	{
+		// Filename too long
+		b.Reset()
+		b.Write(prefix)
+		b.Write(bytes.Repeat([]byte("a"), maxFilename+1))
+		b.WriteString("\x00octet\x00")
+		_, err = packetFromWire(&b)
+		assert.Equal(t, err, errFilename)
+
+		// Filename of maximum length
+		b.Reset()
+		b.Write(prefix)
+		b.Write(bytes.Repeat([]byte("a"), maxFilename))
+		b.WriteString("\x00octet\x00")
+		_, err = packetFromWire(&b)
+		assert.Nil(t, err)
+	}
+
+	{
+		// Mail mode (rejected by the session, not by the parser)
+		b.Reset()
+		b.Write(prefix)
+		b.WriteString("filename\x00")
+		b.WriteString("MAIL\x00")
+		_, err = packetFromWire(&b)
+		assert.Nil(t, err)
 	}
 
 	{
@@ -143,6 +174,54 @@ func testReadPacketXRQ(t *testing.T, prefix []byte) {
 	}
 }
 
+func TestReadPacketXRQMalformed(t *testing.T) {
+	var b bytes.Buffer
+	b.Write([]byte{0x0, uint8(opcodeRRQ)})
+	b.WriteString("filename\x00octet\x00blksize\x001024\x00")
+	valid := b.Bytes()
+
+	// Every truncation of a valid request that ends between two chunks or
+	// inside one is rejected, except for the request without its options.
+	for n := 0; n < len(valid); n++ {
+		p, err := packetFromWire(bytes.NewBuffer(valid[:n]))
+		if n == len("xxfilename\x00octet\x00") {
+			assert.Nil(t, err)
+			continue
+		}
+		assert.Nil(t, p)
+		assert.NotNil(t, err)
+	}
+
+	// Random garbage after the opcode never makes the parser panic.
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		raw := make([]byte, 2+rnd.Intn(2*maxFilename))
+		rnd.Read(raw[2:])
+		raw[1] = uint8(opcodeRRQ + opcode(rnd.Intn(2)))
+		_, _ = packetFromWire(bytes.NewBuffer(raw))
+	}
+
+	// An overlong filename is rejected, with or without a NUL terminator.
+	raw := append([]byte{0x0, uint8(opcodeWRQ)}, bytes.Repeat([]byte("a"), 65000)...)
+	_, err := packetFromWire(bytes.NewBuffer(append(raw, 0)))
+	assert.Equal(t, errFilename, err)
+	_, err = packetFromWire(bytes.NewBuffer(raw))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestPacketXRQFilenameBytes(t *testing.T) {
+	// Filenames that are not valid UTF-8, such as Latin-1, are kept as is.
+	raw := []byte("\x00\x01caf\xe9\xff\x00octet\x00")
+	p, err := packetFromWire(bytes.NewBuffer(raw))
+	if assert.Nil(t, err) {
+		assert.Equal(t, []byte("caf\xe9\xff"), []byte(p.(*packetRRQ).filename))
+	}
+
+	var b bytes.Buffer
+	assert.Nil(t, packetToWire(p, &b))
+	assert.Equal(t, raw, b.Bytes())
+}
+
 func TestReadPacketRRQ(t *testing.T) {
 	testReadPacketXRQ(t, []byte{0x0, uint8(opcodeRRQ)})
 }
@@ -0,0 +1,50 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"time"
+)
+
+// negotiatePipeline accepts the pipeline option of a read request if the
+// server has Pipelining enabled. See Server.Pipelining for the handshake.
+func negotiatePipeline(s *session, requested string) (string, bool, error) {
+	if s.srv == nil || !s.srv.Pipelining || s.wrq || requested != "1" {
+		return "", false, nil
+	}
+
+	s.pipeline = true
+	return requested, true, nil
+}
+
+// pipelinedReader returns the read request that was pipelined after the
+// previous session, before reading further packets from packetReader.
+type pipelinedReader struct {
+	packetReader
+
+	req packet
+}
+
+func (r *pipelinedReader) read(timeout time.Duration) (packet, error) {
+	if r.req != nil {
+		p := r.req
+		r.req = nil
+		return p, nil
+	}
+
+	return r.packetReader.read(timeout)
+}
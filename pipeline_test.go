@@ -0,0 +1,101 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipelining(t *testing.T) {
+	stats := make(chan Stats, 2)
+	h := newHandlerContextWith(func(srv *Server) {
+		srv.Pipelining = true
+		srv.Stats = func(st Stats) {
+			stats <- st
+		}
+	})
+	h.readFunc = func(_ net.Addr, filename string) (ReadCloser, error) {
+		return &rcBuffer{bytes.NewBufferString(filename)}, nil
+	}
+
+	h.Negotiate(t, map[string]string{"pipeline": "1"})
+	assert.Equal(t, &packetDATA{blockNr: 1, data: []byte("file")}, <-h.rcv)
+	h.snd <- &packetACK{blockNr: 1}
+
+	// A duplicate of the final ACK is answered as usual, until the next
+	// request arrives. That one doesn't pipeline, and ends the session.
+	h.snd <- &packetACK{blockNr: 1}
+	assert.Equal(t, &packetDATA{blockNr: 1, data: []byte("file")}, <-h.rcv)
+	h.snd <- &packetRRQ{packetXRQ{filename: "next", options: map[string]string{"blksize": "8"}}}
+	assert.Equal(t, &packetOACK{options: map[string]string{"blksize": "8"}}, <-h.rcv)
+	h.snd <- &packetACK{blockNr: 0}
+	assert.Equal(t, &packetDATA{blockNr: 1, data: []byte("next")}, <-h.rcv)
+	h.snd <- &packetACK{blockNr: 1}
+
+	h.snd <- &packetRRQ{packetXRQ{filename: "last"}}
+	h.snd <- ErrTimeout
+
+	_, ok := <-h.rcv
+	assert.False(t, ok)
+
+	// Every file is a session of its own.
+	for _, filename := range []string{"file", "next"} {
+		st := <-stats
+		assert.Equal(t, filename, st.Filename)
+		assert.Nil(t, st.Err)
+	}
+}
+
+func TestPipeliningDeclined(t *testing.T) {
+	for _, test := range []struct {
+		pipelining bool
+		p          packet
+	}{
+		// Not enabled
+		{false, &packetRRQ{packetXRQ{filename: "file", options: map[string]string{"pipeline": "1", "blksize": "8"}}}},
+		// Unknown value
+		{true, &packetRRQ{packetXRQ{filename: "file", options: map[string]string{"pipeline": "2", "blksize": "8"}}}},
+		// Write request
+		{true, &packetWRQ{packetXRQ{filename: "file", options: map[string]string{"pipeline": "1", "blksize": "8"}}}},
+	} {
+		h := newHandlerContextWith(func(srv *Server) {
+			srv.Pipelining = test.pipelining
+		})
+		h.snd <- test.p
+		assert.Equal(t, &packetOACK{options: map[string]string{"blksize": "8"}}, <-h.rcv)
+
+		if _, ok := test.p.(*packetRRQ); ok {
+			h.snd <- &packetACK{blockNr: 0}
+			assert.Equal(t, &packetDATA{blockNr: 1, data: []byte{}}, <-h.rcv)
+			h.snd <- &packetACK{blockNr: 1}
+
+			// A request after the transfer is ignored.
+			h.snd <- &packetRRQ{packetXRQ{filename: "next"}}
+			h.snd <- ErrTimeout
+		} else {
+			h.snd <- &packetDATA{blockNr: 1, data: []byte{}}
+			assert.Equal(t, &packetACK{blockNr: 1}, <-h.rcv)
+		}
+
+		_, ok := <-h.rcv
+		assert.False(t, ok)
+	}
+}
@@ -0,0 +1,79 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"net"
+	"time"
+)
+
+// openSocket returns a socket bound to address addr of network, taken from
+// the pool if possible. It also returns the key of the pool.
+func (srv *Server) openSocket(network, addr string) (net.PacketConn, string, error) {
+	key := network + " " + addr
+	if conn := srv.pooledSocket(key); conn != nil {
+		return conn, key, nil
+	}
+
+	conn, err := net.ListenPacket(network, addr)
+	return conn, key, err
+}
+
+// pooledSocket returns an idle socket from the pool with the given key, after
+// discarding the packets that are waiting to be read from it, or nil if there
+// is none.
+func (srv *Server) pooledSocket(key string) net.PacketConn {
+	for {
+		srv.mu.Lock()
+		conns := srv.pool[key]
+		if len(conns) == 0 {
+			srv.mu.Unlock()
+			return nil
+		}
+		conn := conns[len(conns)-1]
+		srv.pool[key] = conns[:len(conns)-1]
+		srv.mu.Unlock()
+
+		// The read deadline of the previous session has passed, which
+		// would fail any read.
+		if conn.SetReadDeadline(time.Time{}) == nil && drainSocket(conn) {
+			return conn
+		}
+
+		_ = conn.Close()
+	}
+}
+
+// releaseSocket returns the socket of a session that ended to the pool with
+// the given key, or closes it if the pool is full, key is empty, or sockets
+// can't be drained on this platform.
+func (srv *Server) releaseSocket(key string, conn net.PacketConn) {
+	if canDrain && key != "" && srv.SocketPoolSize > 0 {
+		srv.mu.Lock()
+		if !srv.inShutdown && len(srv.pool[key]) < srv.SocketPoolSize {
+			if srv.pool == nil {
+				srv.pool = make(map[string][]net.PacketConn)
+			}
+			srv.pool[key] = append(srv.pool[key], conn)
+			srv.mu.Unlock()
+			return
+		}
+		srv.mu.Unlock()
+	}
+
+	_ = conn.Close()
+}
@@ -0,0 +1,100 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readFrom reads the data of a transfer of a single block by c, and returns
+// the address it was sent from.
+func readFrom(t *testing.T, c *testClient, data []byte) net.Addr {
+	c.write(&packetRRQ{packetXRQ{filename: "file", mode: modeOCTET}})
+	px, addr := c.read()
+	assert.Equal(t, &packetDATA{blockNr: 1, data: data}, px)
+
+	c.addr = addr
+	c.write(&packetACK{blockNr: 1})
+	return addr
+}
+
+func TestSocketPool(t *testing.T) {
+	if !canDrain {
+		t.Skip("sockets are not pooled on this platform")
+	}
+
+	data := []byte("data")
+	srv := NewServer(bufHandler{data: data})
+	srv.SocketPoolSize = 1
+	srv.DefaultTimeout = 50 * time.Millisecond // Limits the time spent dallying.
+
+	l, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		_ = srv.Serve(l)
+	}()
+
+	c1 := newTestClient(t, l.LocalAddr())
+	defer c1.Close()
+	addr := readFrom(t, c1, data)
+
+	// A late retransmission arrives after the session has ended.
+	time.Sleep(4 * srv.DefaultTimeout)
+	c1.write(&packetACK{blockNr: 1})
+	time.Sleep(10 * time.Millisecond)
+
+	// The socket is reused, but the late packet doesn't reach the session,
+	// which would answer it with an "unknown transfer ID" error.
+	c2 := newTestClient(t, l.LocalAddr())
+	defer c2.Close()
+	assert.Equal(t, addr.String(), readFrom(t, c2, data).String())
+
+	assert.Nil(t, c1.SetReadDeadline(time.Now().Add(4*srv.DefaultTimeout)))
+	_, _, err = c1.ReadFrom(make([]byte, 512))
+	if nerr, ok := err.(net.Error); assert.True(t, ok) {
+		assert.True(t, nerr.Timeout())
+	}
+
+	// Sessions that are active at the same time have sockets of their own.
+	time.Sleep(4 * srv.DefaultTimeout)
+	c3 := newTestClient(t, l.LocalAddr())
+	defer c3.Close()
+	c3.write(&packetRRQ{packetXRQ{filename: "file", mode: modeOCTET}})
+	_, addr3 := c3.read()
+
+	c4 := newTestClient(t, l.LocalAddr())
+	defer c4.Close()
+	c4.write(&packetRRQ{packetXRQ{filename: "file", mode: modeOCTET}})
+	_, addr4 := c4.read()
+	assert.NotEqual(t, addr3.String(), addr4.String())
+
+	c3.addr, c4.addr = addr3, addr4
+	c3.write(&packetACK{blockNr: 1})
+	c4.write(&packetACK{blockNr: 1})
+
+	// Shutdown closes the idle sockets.
+	assert.Nil(t, srv.Shutdown(context.Background()))
+	assert.Nil(t, srv.pool)
+}
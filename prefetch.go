@@ -0,0 +1,93 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import "io"
+
+// prefetchBlock is a block read by a prefetchReader, along with the error
+// that reading it ended with.
+type prefetchBlock struct {
+	data []byte
+	err  error
+}
+
+// prefetchReader reads blocks from an io.Reader in a background goroutine,
+// so that reading the next blocks overlaps with sending the current ones. It
+// returns the same data and errors as reading blocks from the underlying
+// io.Reader with io.ReadAtLeast would.
+type prefetchReader struct {
+	blocks chan prefetchBlock
+	done   chan struct{} // Closed to stop the goroutine.
+	exited chan struct{} // Closed when the goroutine has stopped.
+
+	data []byte // The unread part of the current block.
+	err  error  // The error the current block ended with.
+}
+
+// newPrefetchReader returns a prefetchReader that reads blocks of size bytes
+// from r, up to ahead blocks ahead of what was read from it.
+func newPrefetchReader(r io.Reader, size, ahead int) *prefetchReader {
+	p := &prefetchReader{
+		blocks: make(chan prefetchBlock, ahead-1),
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(p.exited)
+
+		for {
+			buf := make([]byte, size)
+			n, err := io.ReadAtLeast(r, buf, size)
+
+			select {
+			case p.blocks <- prefetchBlock{data: buf[:n], err: err}:
+			case <-p.done:
+				return
+			}
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return p
+}
+
+func (p *prefetchReader) Read(b []byte) (int, error) {
+	for len(p.data) == 0 {
+		if p.err != nil {
+			return 0, p.err
+		}
+
+		blk := <-p.blocks
+		p.data, p.err = blk.data, blk.err
+	}
+
+	n := copy(b, p.data)
+	p.data = p.data[n:]
+	return n, nil
+}
+
+// Close stops the goroutine and waits for it to return, after which the
+// underlying io.Reader is no longer used.
+func (p *prefetchReader) Close() error {
+	close(p.done)
+	<-p.exited
+	return nil
+}
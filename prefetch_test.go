@@ -0,0 +1,74 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefetchReader(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 10)
+
+	for _, size := range []int{1, 7, 10, 100, 512} {
+		for _, ahead := range []int{1, 2, 4} {
+			r := iotest.OneByteReader(bytes.NewReader(data))
+			p := newPrefetchReader(r, size, ahead)
+
+			// Blocks are read with the same boundaries as from the reader.
+			var blocks int
+			for {
+				buf := make([]byte, size)
+				n, err := io.ReadAtLeast(p, buf, size)
+				if n > 0 {
+					assert.Equal(t, data[blocks*size:blocks*size+n], buf[:n])
+				}
+				if err != nil {
+					assert.True(t, err == io.EOF || err == io.ErrUnexpectedEOF)
+					break
+				}
+				blocks++
+			}
+
+			assert.Equal(t, len(data)/size, blocks)
+			assert.Nil(t, p.Close())
+		}
+	}
+}
+
+func TestPrefetchReaderError(t *testing.T) {
+	errRead := errors.New("read error")
+	r := io.MultiReader(bytes.NewReader([]byte("0123")), iotest.ErrReader(errRead))
+	p := newPrefetchReader(r, 8, 2)
+
+	data, err := ioutil.ReadAll(p)
+	assert.Equal(t, errRead, err)
+	assert.Equal(t, "0123", string(data))
+	assert.Nil(t, p.Close())
+}
+
+func TestPrefetchReaderClose(t *testing.T) {
+	// Closing stops the goroutine while it waits to hand off a block.
+	p := newPrefetchReader(bytes.NewReader(make([]byte, 1024)), 8, 2)
+	assert.Nil(t, p.Close())
+}
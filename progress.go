@@ -0,0 +1,77 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"context"
+	"sync"
+)
+
+// ProgressFunc is called with the number of data bytes of a transfer that
+// were acknowledged so far, and the size of the file, or -1 if it is unknown.
+// It is called from the goroutine of the session, so it should return
+// quickly, or hand off to another goroutine; the transfer stalls while it
+// runs.
+type ProgressFunc func(transferred, total int64)
+
+// progress holds the ProgressFunc of a session.
+type progress struct {
+	mu sync.Mutex
+	fn ProgressFunc
+}
+
+func (p *progress) set(fn ProgressFunc) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fn = fn
+}
+
+func (p *progress) get() ProgressFunc {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.fn
+}
+
+// progressContextKey is the context key for the progress of a session.
+var progressContextKey = contextKey{"progress"}
+
+// SetProgress sets the function that the session that ctx belongs to reports
+// its progress to: after every block the peer acknowledged for a read request,
+// and after every block that was written for a write request. A Handler can
+// call it with the context passed to ReadFile or WriteFile. It returns false
+// if ctx doesn't belong to a session.
+func SetProgress(ctx context.Context, fn ProgressFunc) bool {
+	p, ok := ctx.Value(progressContextKey).(*progress)
+	if !ok {
+		return false
+	}
+
+	p.set(fn)
+	return true
+}
+
+// reportProgress reports the number of bytes transferred so far to the
+// ProgressFunc of the session, if there is one.
+func (s *session) reportProgress() {
+	if s.progress == nil {
+		return
+	}
+
+	if fn := s.progress.get(); fn != nil {
+		fn(s.bytes, s.total)
+	}
+}
@@ -0,0 +1,81 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// progressCalls records the calls of a ProgressFunc.
+type progressCalls [][2]int64
+
+func (p *progressCalls) add(transferred, total int64) {
+	*p = append(*p, [2]int64{transferred, total})
+}
+
+func TestProgressReadRequest(t *testing.T) {
+	var calls progressCalls
+
+	h := newHandlerContext()
+	h.readFunc = func(_ net.Addr, _ string) (ReadCloser, error) {
+		assert.True(t, SetProgress(h.ctx, calls.add))
+		return &rcSeeker{bytes.NewReader([]byte("0123456789"))}, nil
+	}
+	h.Negotiate(t, map[string]string{"blksize": "8"})
+
+	_ = <-h.rcv
+	h.snd <- &packetACK{blockNr: 1}
+	_ = <-h.rcv
+	h.snd <- &packetACK{blockNr: 2}
+
+	// End dallying after the final ACK.
+	h.snd <- ErrTimeout
+	_, ok := <-h.rcv
+	assert.False(t, ok)
+
+	// The size is known, even though tsize wasn't negotiated.
+	assert.Equal(t, progressCalls{{8, 10}, {10, 10}}, calls)
+}
+
+func TestProgressWriteRequest(t *testing.T) {
+	var calls progressCalls
+
+	h := newHandlerContext()
+	h.writeFunc = func(_ net.Addr, _ string) (WriteCloser, error) {
+		assert.True(t, SetProgress(h.ctx, calls.add))
+		return &wcBuffer{&bytes.Buffer{}}, nil
+	}
+	h.NegotiateWrite(t, map[string]string{"blksize": "8", "tsize": "10"})
+
+	h.snd <- &packetDATA{blockNr: 1, data: []byte("01234567")}
+	_ = <-h.rcv
+	h.snd <- &packetDATA{blockNr: 2, data: []byte("89")}
+	_ = <-h.rcv
+
+	_, ok := <-h.rcv
+	assert.False(t, ok)
+	assert.Equal(t, progressCalls{{8, 10}, {10, 10}}, calls)
+}
+
+func TestSetProgressWithoutSession(t *testing.T) {
+	assert.False(t, SetProgress(context.Background(), func(_, _ int64) {}))
+}
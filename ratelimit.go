@@ -0,0 +1,117 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter paces the data sent through it to a rate in bytes per second.
+// It is a token bucket that holds enough tokens for a single packet, so
+// packets are spread out evenly rather than sent in bursts.
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate int       // In bytes per second, or 0 if unlimited.
+	next time.Time // The time at which the next packet may be sent.
+}
+
+func newRateLimiter(rate int) *rateLimiter {
+	return &rateLimiter{rate: rate}
+}
+
+func (l *rateLimiter) setRate(rate int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = rate
+}
+
+// limited returns whether the rate is limited.
+func (l *rateLimiter) limited() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate > 0
+}
+
+// reserve reserves the sending of n bytes at time now, and returns the time
+// to wait before they may be sent.
+func (l *rateLimiter) reserve(now time.Time, n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate <= 0 {
+		return 0
+	}
+
+	if l.next.Before(now) {
+		l.next = now
+	}
+
+	d := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(n) * time.Second / time.Duration(l.rate))
+	return d
+}
+
+// rateLimiterContextKey is the context key for the rateLimiter of a session.
+var rateLimiterContextKey = contextKey{"rate-limiter"}
+
+// SetRateLimit sets the maximum rate in bytes per second at which the session
+// that ctx belongs to sends data, overriding Server.RateLimit. A rate of 0
+// means no limit. A Handler can call it with the context passed to ReadFile,
+// for example to give certain peers or files a different rate. It returns
+// false if ctx doesn't belong to a session.
+func SetRateLimit(ctx context.Context, rate int) bool {
+	l, ok := ctx.Value(rateLimiterContextKey).(*rateLimiter)
+	if !ok {
+		return false
+	}
+
+	l.setRate(rate)
+	return true
+}
+
+// pace waits until n bytes of data may be sent according to the rate limits
+// of the session, and returns the time it waited. It returns early with an
+// error if the context of the session is done.
+//
+// The limits are waited for one after the other, with the aggregate limit
+// last, so that its slot is reserved when the packet is about to be sent. A
+// slot reserved up front would go unused for as long as the per-session
+// limit holds the packet back, which would leave other sessions short of
+// AggregateRateLimit.
+func (s *session) pace(n int) (time.Duration, error) {
+	var waited time.Duration
+	for _, l := range s.limiters {
+		// The clock is only read if there is a limit to pace by.
+		if !l.limited() {
+			continue
+		}
+
+		d := l.reserve(s.clock.Now(), n)
+		if d <= 0 {
+			continue
+		}
+
+		waited += d
+		if err := s.clock.Sleep(s.ctx, d); err != nil {
+			return waited, err
+		}
+	}
+
+	return waited, nil
+}
@@ -0,0 +1,120 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiterReserve(t *testing.T) {
+	l := newRateLimiter(1000)
+
+	// The first packet can be sent right away, the next ones are spaced out.
+	now := time.Now()
+	assert.Equal(t, time.Duration(0), l.reserve(now, 500))
+	assert.Equal(t, 500*time.Millisecond, l.reserve(now, 500))
+	assert.Equal(t, time.Second, l.reserve(now, 500))
+
+	// Time that passed counts towards the wait.
+	assert.Equal(t, time.Second, l.reserve(now.Add(500*time.Millisecond), 500))
+
+	l.setRate(0)
+	assert.Equal(t, time.Duration(0), l.reserve(now, 500))
+}
+
+func TestPaceAggregate(t *testing.T) {
+	clock := newFakeClock()
+	aggregate := newRateLimiter(1024)
+	s := &session{
+		ctx:      context.Background(),
+		clock:    clock,
+		limiters: []*rateLimiter{newRateLimiter(512), aggregate},
+	}
+
+	d, err := s.pace(512)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(0), d)
+
+	// The second packet is held back by the per-session limit. The aggregate
+	// limit is only charged once that has passed, when the packet is sent.
+	d, err = s.pace(512)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Second, d)
+	assert.Equal(t, clock.Now().Add(500*time.Millisecond), aggregate.next)
+}
+
+// transferTime returns the time it takes to read 10 blocks of 512 bytes from
+// a Server configured by the function fn. If readFunc is not nil, it opens
+// the file.
+func transferTime(t *testing.T, fn func(*Server), readFunc func(h *handlerContext) (ReadCloser, error)) time.Duration {
+	h := newHandlerContextWith(fn)
+	if readFunc != nil {
+		h.readFunc = func(_ net.Addr, _ string) (ReadCloser, error) {
+			return readFunc(h)
+		}
+	} else {
+		h.SetReadCloser(&rcBuffer{bytes.NewBuffer(make([]byte, 10*512))})
+	}
+
+	h.snd <- &packetRRQ{packetXRQ{filename: "file"}}
+
+	start := time.Now()
+	for i := 1; i <= 11; i++ {
+		pdata := <-h.rcv
+		assert.IsType(t, &packetDATA{}, pdata)
+		h.snd <- &packetACK{blockNr: uint16(i)}
+	}
+
+	d := time.Since(start)
+
+	// End dallying after the final ACK.
+	h.snd <- ErrTimeout
+	return d
+}
+
+func TestRateLimit(t *testing.T) {
+	// The first packet is sent right away, and every one of the next 10 is
+	// delayed by 10ms.
+	d := transferTime(t, func(srv *Server) {
+		srv.RateLimit = 51200
+	}, nil)
+	assert.True(t, d >= 90*time.Millisecond)
+
+	d = transferTime(t, func(srv *Server) {
+		srv.AggregateRateLimit = 51200
+	}, nil)
+	assert.True(t, d >= 90*time.Millisecond)
+}
+
+func TestSetRateLimit(t *testing.T) {
+	d := transferTime(t, func(srv *Server) {
+		srv.RateLimit = 512
+	}, func(h *handlerContext) (ReadCloser, error) {
+		// The Handler lifts the limit for this session.
+		assert.True(t, SetRateLimit(h.ctx, 0))
+		return &rcBuffer{bytes.NewBuffer(make([]byte, 10*512))}, nil
+	})
+	assert.True(t, d < time.Second)
+
+	assert.False(t, SetRateLimit(context.Background(), 0))
+}
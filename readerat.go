@@ -0,0 +1,61 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"context"
+	"io"
+	"net"
+)
+
+// ReaderAtHandler returns a Handler that serves read requests from the
+// io.ReaderAt and size that open returns for a filename, such as a memory
+// mapped file or an object store that supports range requests. Every block is
+// read with a ReadAt call at its offset, so the io.ReaderAt can be shared by
+// concurrent transfers. The object ends at size, also if the io.ReaderAt has
+// more data. If the io.ReaderAt implements io.Closer, it is closed when the
+// transfer ends.
+//
+// The returned Handler rejects write requests.
+func ReaderAtHandler(open func(filename string) (io.ReaderAt, int64, error)) Handler {
+	return HandlerFuncs{
+		Read: func(ctx context.Context, peer net.Addr, filename string) (ReadCloser, error) {
+			r, size, err := open(filename)
+			if err != nil {
+				return nil, err
+			}
+
+			return &sectionReader{io.NewSectionReader(r, 0, size), r}, nil
+		},
+	}
+}
+
+// sectionReader is the ReadCloser of a ReaderAtHandler. Since it implements
+// io.Seeker and io.ReaderAt, the tsize and multicast options are supported,
+// and a transfer can be resumed at an offset.
+type sectionReader struct {
+	*io.SectionReader
+	r io.ReaderAt
+}
+
+func (r *sectionReader) Close() error {
+	if c, ok := r.r.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
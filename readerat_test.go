@@ -0,0 +1,126 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingReaderAt records the offsets it is read at, and whether it was
+// closed. Like an *os.File, it returns io.EOF together with a short read at
+// the end of its data.
+type recordingReaderAt struct {
+	mu      sync.Mutex
+	data    []byte
+	offsets []int64
+	closed  bool
+}
+
+func (r *recordingReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	r.mu.Lock()
+	r.offsets = append(r.offsets, off)
+	r.mu.Unlock()
+
+	return bytes.NewReader(r.data).ReadAt(b, off)
+}
+
+func (r *recordingReaderAt) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	return nil
+}
+
+func TestReaderAtHandler(t *testing.T) {
+	for _, test := range []struct {
+		data    []byte
+		size    int64
+		offsets []int64
+	}{
+		// Short read at the end.
+		{data: []byte("0123456789abcdefghij"), size: 20, offsets: []int64{0, 8, 16}},
+		// Multiple of the block size, which ends with an empty block.
+		{data: []byte("0123456789abcdef"), size: 16, offsets: []int64{0, 8}},
+		// Data past the size is not served.
+		{data: []byte("0123456789abcdefghij"), size: 10, offsets: []int64{0, 8}},
+		// Empty object.
+		{data: nil, size: 0, offsets: nil},
+	} {
+		r := &recordingReaderAt{data: test.data}
+		h := ReaderAtHandler(func(filename string) (io.ReaderAt, int64, error) {
+			if filename != "image" {
+				return nil, 0, os.ErrNotExist
+			}
+			return r, test.size, nil
+		})
+
+		l := listenTest(t, h)
+
+		rc, err := NewClient().Get(context.Background(), l.LocalAddr().String(), "image", WithBlksize(8))
+		if assert.Nil(t, err) {
+			b, err := ioutil.ReadAll(rc)
+			assert.Nil(t, err)
+			assert.Equal(t, string(test.data[:test.size]), string(b))
+			assert.Nil(t, rc.Close())
+		}
+
+		r.mu.Lock()
+		for _, off := range test.offsets {
+			assert.Contains(t, r.offsets, off)
+		}
+		r.mu.Unlock()
+
+		_, err = NewClient().Get(context.Background(), l.LocalAddr().String(), "other")
+		assert.Equal(t, &Error{Code: 1, Message: "file does not exist"}, err)
+
+		_, err = h.WriteFile(context.Background(), nil, "image")
+		assert.Equal(t, os.ErrPermission, err)
+
+		l.Close()
+	}
+}
+
+func TestReaderAtHandlerReadCloser(t *testing.T) {
+	r := &recordingReaderAt{data: []byte("0123456789")}
+	h := ReaderAtHandler(func(filename string) (io.ReaderAt, int64, error) {
+		return r, 10, nil
+	})
+
+	rc, err := h.ReadFile(context.Background(), nil, "image")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// The size is known, and blocks can be read at any offset.
+	n, ok := size(rc)
+	assert.True(t, ok)
+	assert.Equal(t, int64(10), n)
+	_, ok = rc.(io.ReaderAt)
+	assert.True(t, ok)
+
+	// The io.ReaderAt is closed with the ReadCloser.
+	assert.Nil(t, rc.Close())
+	assert.True(t, r.closed)
+}
@@ -18,23 +18,28 @@ package gotftp
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"hash"
 	"net"
 	"sync"
 	"time"
 
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 type controlMessage struct {
-	*ipv4.ControlMessage
+	dst  net.IP   // The address the request was sent to.
+	addr net.Addr // The address (including port) of the peer.
 }
 
 func (c controlMessage) LocalAddr() net.Addr {
-	return &net.IPAddr{IP: c.ControlMessage.Dst}
+	return &net.IPAddr{IP: c.dst}
 }
 
 func (c controlMessage) RemoteAddr() net.Addr {
-	return &net.IPAddr{IP: c.ControlMessage.Src}
+	return c.addr
 }
 
 type zeroConn struct{}
@@ -54,24 +59,95 @@ func newZeroConn() Conn {
 // ZeroConn can be used as a placeholder if otherwise not known.
 var ZeroConn = newZeroConn()
 
+// packetReaderImpl reads packets from the socket of a single session.
 type packetReaderImpl struct {
-	ch <-chan []byte
+	net.PacketConn
+
+	addr   net.Addr // The address of the peer.
+	req    []byte   // The request that started the session, returned by the first read.
+	buf    []byte
+	shared bool // Whether the socket is the listening socket, which other peers send requests to.
+	trace  func(dir PacketDirection, peer net.Addr, b []byte)
+	logger Logger // Told about failures to answer packets from other addresses, if not nil.
 }
 
 func (p *packetReaderImpl) read(timeout time.Duration) (packet, error) {
-	select {
-	case buf := <-p.ch:
-		return packetFromWire(bytes.NewBuffer(buf))
-	case <-time.After(timeout):
-		return nil, ErrTimeout
+	// The request was received on the listening socket.
+	if p.req != nil {
+		b := p.req
+		p.req = nil
+		if p.trace != nil {
+			p.trace(PacketReceived, p.addr, b)
+		}
+		return readPacket(b, p.addr)
 	}
+
+	err := p.PacketConn.SetReadDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		n, addr, err := p.PacketConn.ReadFrom(p.buf)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				return nil, ErrTimeout
+			}
+			return nil, err
+		}
+
+		// The transfer ID of the peer is the port it sent the request from,
+		// which is established before any reply is sent, including an OACK.
+		// Packets from any other address are answered with an error, without
+		// disturbing the transfer (RFC 1350). On the listening socket, they
+		// are requests of other peers, which are dropped instead.
+		if addr.String() != p.addr.String() {
+			if p.shared {
+				continue
+			}
+			if p.trace != nil {
+				p.trace(PacketReceived, addr, p.buf[:n])
+			}
+			w := &packetWriterImpl{PacketConn: p.PacketConn, addr: addr, trace: p.trace}
+			err = w.write(&packetERROR{
+				errorCode:    tftpErrUnknownTransferID.Code,
+				errorMessage: tftpErrUnknownTransferID.Message,
+			})
+			if err != nil && p.logger != nil {
+				p.logger.Log(Event{Type: EventError, Peer: addr, Err: err})
+			}
+			continue
+		}
+
+		if p.trace != nil {
+			p.trace(PacketReceived, addr, p.buf[:n])
+		}
+		return readPacket(p.buf[:n], addr)
+	}
+}
+
+// readPacket deserializes packet b, which was received from addr.
+func readPacket(b []byte, addr net.Addr) (packet, error) {
+	p, err := packetFromWire(bytes.NewBuffer(b))
+	if err != nil {
+		raw := make([]byte, len(b))
+		copy(raw, b)
+		return nil, &MalformedPacketError{Raw: raw, Addr: addr, Err: err}
+	}
+
+	return p, nil
 }
 
 type packetWriterImpl struct {
 	net.PacketConn
 
-	addr net.Addr
-	b    bytes.Buffer
+	addr  net.Addr
+	b     bytes.Buffer
+	trace func(dir PacketDirection, peer net.Addr, b []byte)
+}
+
+func (p *packetWriterImpl) maxDatagram() (int, bool) {
+	return sendBufferSize(p.PacketConn)
 }
 
 func (p *packetWriterImpl) write(x packet) error {
@@ -83,35 +159,458 @@ func (p *packetWriterImpl) write(x packet) error {
 	}
 
 	_, err = p.PacketConn.WriteTo(p.b.Bytes(), p.addr)
+	if err == nil && p.trace != nil {
+		p.trace(PacketSent, p.addr, p.b.Bytes())
+	}
 	return err
 }
 
-type syncPacketConn struct {
-	net.PacketConn
-	sync.Mutex
+const (
+	// defaultAddr is the address a Server listens on by default.
+	defaultAddr = ":69"
+
+	// defaultBlksize is the payload size per data packet by default (RFC 1350).
+	defaultBlksize = 512
+
+	// defaultTimeout is the time before a retransmit takes place by default.
+	defaultTimeout = 3 * time.Second
+
+	// defaultRetries is the number of times a packet is retransmitted by default.
+	defaultRetries = 3
+
+	// defaultMaxOptions is the maximum number of options in a request by default.
+	defaultMaxOptions = 16
+
+	// defaultMaxOptionBytes is the maximum size of the options in a request
+	// by default.
+	defaultMaxOptionBytes = 512
+)
+
+// ReplySource is the socket that a Server replies to requests from.
+type ReplySource int
+
+const (
+	// ReplyFromSession serves every transfer from a new socket on an
+	// ephemeral port, which serves as the transfer ID of the server.
+	ReplyFromSession ReplySource = iota
+
+	// ReplyFirstFromListener sends the first reply to a request from the
+	// listening socket, and serves the remainder of the transfer from a new
+	// socket once the peer has answered it.
+	ReplyFirstFromListener
+
+	// ReplyFromListener serves every transfer from the listening socket.
+	ReplyFromListener
+)
+
+// PacketDirection tells whether a packet passed to Server.PacketTrace was
+// received or sent.
+type PacketDirection int
+
+const (
+	// PacketReceived is a packet that was received from the peer.
+	PacketReceived PacketDirection = iota
+
+	// PacketSent is a packet that was sent to the peer.
+	PacketSent
+)
+
+func (d PacketDirection) String() string {
+	if d == PacketSent {
+		return "out"
+	}
+	return "in"
 }
 
-func (s *syncPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
-	s.Lock()
-	n, err := s.PacketConn.WriteTo(b, addr)
-	s.Unlock()
-	return n, err
+// ErrServerClosed is returned by Serve and ListenAndServe after a call to Shutdown.
+var ErrServerClosed = errors.New("server closed")
+
+var (
+	errServerBusy     = errors.New("server busy")
+	errNoSocket       = errors.New("no socket available")
+	errPeerDenied     = errors.New("access denied")
+	errTooManyOptions = errors.New("too many options")
+	errOptionsSize    = errors.New("options too large")
+)
+
+// Server defines parameters for running a TFTP server.
+//
+// A Server serves every request from its own goroutine. The replies for a
+// request are sent from a new UDP socket bound to an ephemeral port, which
+// serves as the transfer ID of the server for the remainder of the transfer
+// (RFC 1350), unless ReplySource says otherwise. A Server may be used to
+// serve more than once.
+type Server struct {
+	Addr    string  // UDP address to listen on, ":69" if empty.
+	Handler Handler // The handler to invoke for read and write requests.
+
+	// DefaultBlksize is the payload size per data packet if the peer doesn't
+	// negotiate the blksize option. If zero, the default of 512 is used.
+	//
+	// A peer that doesn't send the blksize option expects blocks of 512
+	// bytes, and takes a block of any other size to be the last one. Only
+	// change the default if every peer is known to use the same size without
+	// negotiating it. It is clamped to the bounds of RFC 2348.
+	DefaultBlksize int
+
+	// MaxWriteSize, if positive, is the maximum size in bytes of a file that
+	// is written. A write request that announces a larger size through the
+	// tsize option is rejected with a "disk full" error before any data is
+	// transferred. Since the announced size may be wrong, a transfer that
+	// exceeds the size is aborted as well.
+	MaxWriteSize int64
+
+	// ReadOnly rejects write requests with an "access violation" error before
+	// the Handler is called, for servers that only distribute files.
+	ReadOnly bool
+
+	// WriteOnly rejects read requests with an "access violation" error before
+	// the Handler is called, for servers that only collect files.
+	WriteOnly bool
+
+	// DisableOptions ignores the options of every request, as if the server
+	// only implemented RFC 1350. No OACK is sent, and transfers use 512 byte
+	// blocks, regardless of DefaultBlksize, and the default timeout. This
+	// helps with old peers that send garbage in the options area or don't
+	// understand an OACK. It takes precedence over StrictOptions.
+	DisableOptions bool
+
+	// StrictOptions rejects requests with an option the server doesn't
+	// recognize with an "option negotiation" error, which helps to surface
+	// misconfigured peers. By default, unrecognized options are ignored
+	// (RFC 2347).
+	StrictOptions bool
+
+	// LenientOACK accommodates peers that request options, but never
+	// acknowledge the OACK of a read request. Once the OACK has gone
+	// unanswered after all retries, the server falls back to the defaults of
+	// RFC 1350, 512 byte blocks and the default timeout, and sends DATA
+	// block 1 as if no options had been requested. This deviates from RFC
+	// 2347, under which the transfer fails: a peer that does understand the
+	// OACK, but whose ACKs got lost, now receives blocks of a size it didn't
+	// expect. Options registered through RegisterOption are not reverted,
+	// and a transfer that was moved to an offset through SetOffset fails as
+	// before. Write requests are not affected.
+	LenientOACK bool
+
+	// MaxOptions is the maximum number of options in a request, and
+	// MaxOptionBytes the maximum size of its options in bytes, counting the
+	// names, the values and their NUL terminators. A request that exceeds
+	// either is rejected with an "option negotiation" error before the
+	// Handler is called or any of its options is looked at. If zero, the
+	// defaults of 16 options and 512 bytes apply, which leaves ample room for
+	// real clients. If negative, there is no limit.
+	MaxOptions     int
+	MaxOptionBytes int
+
+	// PrefetchDepth is the number of blocks of a read request that are
+	// buffered. If larger than 1, up to PrefetchDepth-1 blocks are read ahead
+	// from the ReadCloser in a background goroutine, so that slow reads overlap
+	// with waiting for ACKs. If 1 or less, a block is read when it is about to
+	// be sent.
+	PrefetchDepth int
+
+	// MaxBlksize, if positive, caps the block size the peer can negotiate
+	// through the blksize option, in addition to the upper bound of 65464
+	// from RFC 2348. The capped size is echoed in the OACK. Blocks larger
+	// than the path MTU are fragmented, which makes the transfer sensitive
+	// to packet loss; 1468 avoids fragmentation on Ethernet with an MTU of
+	// 1500 bytes.
+	MaxBlksize int
+
+	// DefaultTimeout is the time before a retransmit takes place if the peer
+	// doesn't negotiate the timeout option. Unlike a negotiated timeout, it
+	// need not be a whole number of seconds. If zero, the default of 3
+	// seconds is used.
+	DefaultTimeout time.Duration
+
+	// MinTimeout and MaxTimeout, if positive, bound the timeout that a peer
+	// negotiates through the timeout or utimeout option, within the bounds of
+	// the option itself, such as the 1 to 255 seconds of RFC 2349. The
+	// bounded value is echoed in the OACK. On a LAN, a low MaxTimeout makes a
+	// lost peer fail fast; over a WAN, a MinTimeout avoids retransmissions
+	// by a peer that asks for a timeout shorter than the round trip time.
+	MinTimeout time.Duration
+	MaxTimeout time.Duration
+
+	// Retries is the number of times a packet is retransmitted when the peer
+	// doesn't reply before the timeout expires. If zero, a packet is sent only
+	// once. If negative, the default of 3 is used.
+	Retries int
+
+	// RewriteFilename, if not nil, is called with the filename of every
+	// request before it is passed to the Handler. It returns the filename to
+	// pass instead, which allows filenames to be normalized or remapped in a
+	// single place. If it returns an error, the request is denied with an
+	// "access violation" error.
+	RewriteFilename func(peer net.Addr, filename string) (string, error)
+
+	// MaxTransferDuration is the maximum time a session may take, counted
+	// from the arrival of the request. A session that takes longer is aborted
+	// with an error packet, and the context passed to the Handler expires. If
+	// zero, there is no limit.
+	MaxTransferDuration time.Duration
+
+	// IdleTimeout is the maximum time a session may go without progress,
+	// that is, without an ACK for a new block of a read request, or a new
+	// block of a write request. Unlike MaxTransferDuration, it starts over
+	// whenever the transfer progresses. With a window size greater than one,
+	// that is whenever the lowest unacknowledged block advances; duplicate
+	// ACKs and blocks out of order don't count. Time spent waiting for the
+	// rate limits before sending is not idle either. A session that is idle
+	// for longer is aborted with an error packet, even if it has retries
+	// left. If zero, there is no limit.
+	IdleTimeout time.Duration
+
+	// Backoff, if not nil, determines the time before each retransmission of
+	// a packet. If nil, the negotiated timeout is used for every attempt. See
+	// ExponentialBackoff and Jitter.
+	Backoff Backoff
+
+	// MaxRetransmitInterval, if positive, caps the time Backoff may wait
+	// before a retransmission, so that a transfer recovers quickly once a
+	// lossy link clears up. It never shortens the negotiated timeout. The
+	// retransmissions of a session still end when MaxTransferDuration or
+	// IdleTimeout is exceeded, whichever comes first.
+	MaxRetransmitInterval time.Duration
+
+	// RateLimit is the maximum rate in bytes per second at which a session
+	// sends data. It can be overridden per session with SetRateLimit. If zero,
+	// there is no limit.
+	RateLimit int
+
+	// AggregateRateLimit is the maximum rate in bytes per second at which all
+	// sessions together send data. If zero, there is no limit.
+	AggregateRateLimit int
+
+	// MaxConcurrentSessions is the maximum number of sessions that are served
+	// concurrently. Requests beyond this limit are answered with a "server
+	// busy" error. If zero, there is no limit.
+	MaxConcurrentSessions int
+
+	// Logger receives the lifecycle events of every session. If nil, events
+	// are not logged.
+	Logger Logger
+
+	// Tracer, if not nil, traces every session and its phases as spans. For
+	// a write request, the OACK is part of the transfer phase, since the
+	// first DATA packet acknowledges it.
+	Tracer Tracer
+
+	// PacketTrace, if not nil, is called with every packet that a session
+	// receives or sends, as the raw bytes on the wire, and the address of the
+	// peer. This includes malformed packets, packets from unexpected
+	// addresses, and the request that started the session. A sent packet is
+	// only passed once it was written successfully. b is only valid for the
+	// duration of the call, and PacketTrace may be called concurrently for
+	// different sessions.
+	PacketTrace func(dir PacketDirection, peer net.Addr, b []byte)
+
+	// Stats, if not nil, is called with the Stats of every session when it
+	// ends, including sessions that failed.
+	Stats func(Stats)
+
+	// Hash, if not nil, returns a new hash, such as sha256.New, that the data
+	// of every session is written to. Its digest is reported as Stats.Digest,
+	// and is that of the file for a complete transfer in either mode. In
+	// octet mode, data is hashed as the peer acknowledges it or as it is
+	// written to the WriteCloser, so the digest covers the same data as
+	// Stats.Bytes, also for a failed transfer. In netascii mode, data is
+	// hashed in its local form as it is read from the ReadCloser or written
+	// to the WriteCloser. Since the file is read ahead of the transfer, the
+	// digest of a failed netascii download covers more than the peer
+	// received. If nil, nothing is hashed.
+	Hash func() hash.Hash
+
+	// OnClose, if not nil, is called exactly once when a session ends, with
+	// the address of the peer, the filename as passed to the Handler, and the
+	// error the session failed with, if any. It is called for every session,
+	// including those that failed before the Handler was called, in which
+	// case the filename may be empty. The ReadCloser or WriteCloser of the
+	// session has been closed by then, which makes it the place to release
+	// resources that are tied to the session.
+	OnClose func(peer net.Addr, filename string, err error)
+
+	// ErrorMessage, if not nil, returns the message of the error packet that
+	// reports err to the peer with the given TFTP error code, in place of the
+	// text of err. The text of an error may reveal details that are not meant
+	// for the network, such as the paths of a file system, which ErrorMessage
+	// can replace with a generic message. The session still ends with err,
+	// as passed to Stats and OnClose. Error packets that are sent outside of
+	// a session, such as "server busy", are not passed to ErrorMessage.
+	ErrorMessage func(code uint16, err error) string
+
+	// AcceptBlksize, if not nil, is called with the block size requested by
+	// the peer through the blksize option. It returns the block size to
+	// accept, which is capped at the requested size, or false to decline the
+	// option so that the default block size is used. The accepted size is
+	// subject to MaxBlksize.
+	AcceptBlksize func(requested int) (accepted int, ok bool)
+
+	// ListenSession, if not nil, is called to open the socket a session with
+	// peer is served from. Its port serves as the transfer ID of the server,
+	// so it must differ from the port requests are received on. If nil, a UDP
+	// socket on an ephemeral port is opened in the address family of peer.
+	ListenSession func(peer net.Addr) (net.PacketConn, error)
+
+	// BindReplyAddr binds the socket a session is served from to the address
+	// the request was sent to, so that replies are sent from that address. On
+	// a host with multiple addresses, replies are otherwise sent from the
+	// address of the route to the peer, which peers behind NAT or with strict
+	// reverse path filtering may drop. It doesn't apply to ListenSession, and
+	// requests sent to a multicast or broadcast address are replied to from
+	// an unbound socket.
+	BindReplyAddr bool
+
+	// SocketPoolSize, if positive, is the number of idle sockets that are
+	// kept for reuse by later sessions, for each address that sessions are
+	// served from, which saves opening and closing a socket for every
+	// request under a high request rate. A socket is only reused once its
+	// session has ended, so every active session still has a port of its
+	// own, which serves as its transfer ID. Packets that arrive at an idle
+	// socket, such as late retransmissions of the previous peer, are
+	// discarded before it is reused. It doesn't apply to ListenSession.
+	// Sockets are only pooled on Unix, where they can be drained without
+	// blocking.
+	SocketPoolSize int
+
+	// ReplySource selects the socket that replies to a request are sent from.
+	// By default, every transfer is served from its own socket (RFC 1350).
+	// The other sources are not standard, and only meant for peers that fail
+	// to follow the transfer ID of the server to a new port.
+	//
+	// While a transfer is served from the listening socket, Serve doesn't
+	// read from it, so requests from other peers are dropped until the peer
+	// retransmits them. With ReplyFirstFromListener this only lasts until
+	// the peer answers the first reply. With ReplyFromListener it lasts for
+	// the whole transfer, so transfers are served one at a time, and a slow
+	// or stalled peer holds up all others for as long as its transfer lasts.
+	ReplySource ReplySource
+
+	// MulticastAddr, if not nil, enables the multicast option (RFC 2090) for
+	// read requests. Every multicast group is assigned the IP address of
+	// MulticastAddr, and the lowest port from the port of MulticastAddr
+	// onwards that isn't used by another group. Multicast requires the
+	// ReadCloser to implement io.ReaderAt and io.Seeker; for other files the
+	// option is declined.
+	MulticastAddr *net.UDPAddr
+
+	// Pipelining enables an experimental extension, which is not part of any
+	// RFC, for reading several files in a row over the transfer ID of one
+	// session. It saves a new socket per file, and a peer behind a firewall
+	// or NAT needs no new mapping for every transfer. The handshake is:
+	//
+	//  1. The peer sends an RRQ to the server with the "pipeline" option
+	//     set to "1", along with any other options.
+	//  2. The server acknowledges it with "pipeline" set to "1" in the OACK,
+	//     from its transfer ID. If the option is missing from the OACK, or
+	//     there is no OACK, pipelining was declined.
+	//  3. The file is transferred as usual, up to the final ACK.
+	//  4. For the next file, the peer sends a new RRQ to the transfer ID of
+	//     the server instead of the port of the request, from its own
+	//     transfer ID, within the timeout of the previous transfer. A
+	//     duplicate of the final ACK is still answered with the final DATA
+	//     packet until then.
+	//  5. The RRQ is served like a request that started a session, with
+	//     block numbers and options starting over. It must have the
+	//     "pipeline" option as well to be followed by yet another RRQ.
+	//
+	// Without a new RRQ in time, the session ends. A write request, or a read
+	// request served through MulticastAddr, never pipelines. Every file is a
+	// session of its own to Logger, Stats and OnClose.
+	Pipelining bool
+
+	// DuplicateRequestWindow, if positive, is the time during which a request
+	// that is identical to an earlier one from the same peer address and port
+	// is ignored. A peer that doesn't hear back in time retransmits its
+	// request from the same port, which would otherwise start a second
+	// session for the same transfer. The trade-off is that a peer that
+	// deliberately repeats a request from the same port within the window,
+	// for example after aborting the first transfer, is ignored until the
+	// window has passed. Requests from different ports are always served, as
+	// they belong to different transfers.
+	DuplicateRequestWindow time.Duration
+
+	// AllowList and DenyList restrict the peers that are served by IP
+	// address. A request from a peer in a network of DenyList is rejected,
+	// and so is a request from a peer outside of every network of AllowList,
+	// unless AllowList is empty. DenyList takes precedence, so that a single
+	// address can be excluded from an allowed network. A rejected request is
+	// answered with an "access violation" error before the request is
+	// inspected or the Handler is called. A peer whose address is not an IP
+	// address, which ServeConn may be used with, is only served if AllowList
+	// is empty.
+	AllowList []*net.IPNet
+	DenyList  []*net.IPNet
+
+	// Listening, if not nil, is called by ListenAndServe with the socket it
+	// opened, before any request is served. Binding the default port 69
+	// requires privileges, which a daemon can drop here, since the sockets
+	// that sessions are served from use unprivileged ephemeral ports. It can
+	// also be used to signal readiness. If it returns an error, the socket is
+	// closed and ListenAndServe returns the error.
+	Listening func(l net.PacketConn) error
+
+	mu         sync.Mutex
+	listeners  map[net.PacketConn]struct{}
+	inShutdown bool
+	sessions   sync.WaitGroup
+	sem        chan struct{} // Counting semaphore for MaxConcurrentSessions.
+	groups     map[string]*multicastGroup
+	limiter    *rateLimiter    // Limits the rate of all sessions together.
+	ctx        context.Context // Parent of the context of every session.
+	cancel     context.CancelFunc
+	recent     map[string]time.Time        // Recent requests by peer address and content.
+	swept      time.Time                   // The time expired requests were last removed from recent.
+	clock      clock                       // The clock of sessions and duplicate detection, if not nil.
+	options    map[string]CustomOptionFunc // Registered through RegisterOption.
+	pool       map[string][]net.PacketConn // Idle session sockets by network and address.
+	vars       *serverVars                 // Published through PublishVars, if not nil.
 }
 
+// NewServer returns a Server for Handler h with default parameters.
+func NewServer(h Handler) *Server {
+	return &Server{
+		Handler: h,
+		Retries: defaultRetries,
+	}
+}
+
+// Serve accepts requests on the PacketConn l using a Server with default
+// parameters for Handler h.
 func Serve(l net.PacketConn, h Handler) error {
-	ipv4pc := ipv4.NewPacketConn(l)
-	flags := ipv4.FlagSrc | ipv4.FlagDst | ipv4.FlagInterface
-	if err := ipv4pc.SetControlMessage(flags, true); err != nil {
+	return NewServer(h).Serve(l)
+}
+
+// Serve accepts requests on the PacketConn l, serving each request from its
+// own goroutine. Serve always returns a non-nil error. After Shutdown, the
+// returned error is ErrServerClosed.
+//
+// The PacketConn may be set up by the caller, for example with SO_REUSEPORT
+// or bound to an interface. It need not be a *net.UDPConn, although only a
+// UDP socket tells the address each request was sent to; for other
+// PacketConns, Conn.LocalAddr reports the local address of l. See also
+// ListenSession.
+func (srv *Server) Serve(l net.PacketConn) error {
+	if !srv.trackListener(l, true) {
+		return ErrServerClosed
+	}
+
+	defer srv.trackListener(l, false)
+
+	readFrom, err := newControlMessageReader(l)
+	if err != nil {
 		return err
 	}
 
-	lock := sync.Mutex{}
-	table := make(map[string]chan []byte)
 	buf := make([]byte, 65536)
 
 	for {
-		n, cm, addr, err := ipv4pc.ReadFrom(buf)
+		n, cm, err := readFrom(buf)
 		if err != nil {
+			if srv.shuttingDown() {
+				return ErrServerClosed
+			}
 			return err
 		}
 
@@ -120,66 +619,553 @@ func Serve(l net.PacketConn, h Handler) error {
 			continue
 		}
 
-		// Ownership of this buffer is transferred to the goroutine for the peer
-		// address, so we need to make a copy before handing it off.
+		// Ownership of this buffer is transferred to the goroutine for the
+		// request, so we need to make a copy before handing it off.
 		b := make([]byte, n)
 		copy(b, buf[:n])
 
-		lock.Lock()
+		if srv.duplicateRequest(cm.addr, b) {
+			continue
+		}
+
+		// Requests that arrive during shutdown are dropped. The peer will
+		// retransmit, possibly to a restarted server.
+		srv.mu.Lock()
+		if srv.inShutdown {
+			srv.mu.Unlock()
+			continue
+		}
+		srv.sessions.Add(1)
+		sem := srv.sem
+		srv.mu.Unlock()
+
+		if sem != nil {
+			select {
+			case sem <- struct{}{}:
+			default:
+				srv.sessions.Done()
+
+				srv.reject(l, cm.addr, errServerBusy)
+				continue
+			}
+		}
+
+		// A session that replies from the listening socket reads from it
+		// too, until it releases the socket.
+		var released chan struct{}
+		var release func()
+		if srv.ReplySource != ReplyFromSession {
+			var once sync.Once
+			released = make(chan struct{})
+			release = func() {
+				once.Do(func() { close(released) })
+			}
+		}
+
+		go func(c controlMessage) {
+			defer srv.sessions.Done()
+			if sem != nil {
+				defer func() { <-sem }()
+			}
+			srv.serveRequest(l, c, b, release)
+		}(*cm)
+
+		if released != nil {
+			<-released
+		}
+	}
+}
+
+// controlMessageReader reads a datagram along with the control message that
+// tells the address it was sent to. The control message is nil if it is not
+// available.
+type controlMessageReader func(b []byte) (int, *controlMessage, error)
+
+// newControlMessageReader returns a controlMessageReader for l, which may be
+// an IPv4 or an IPv6 socket. If l is not a UDP socket, control messages are
+// not available, and the address a request was sent to is taken to be the
+// local address of l.
+func newControlMessageReader(l net.PacketConn) (controlMessageReader, error) {
+	if _, ok := l.(*net.UDPConn); !ok {
+		var dst net.IP
+		if addr, ok := l.LocalAddr().(*net.UDPAddr); ok {
+			dst = addr.IP
+		}
+
+		return func(b []byte) (int, *controlMessage, error) {
+			n, addr, err := l.ReadFrom(b)
+			if err != nil {
+				return n, nil, err
+			}
+			return n, &controlMessage{dst: dst, addr: addr}, nil
+		}, nil
+	}
 
-		ch, ok := table[addr.String()]
-		if !ok {
-			ch = make(chan []byte, 10)
-			table[addr.String()] = ch
+	if addr, ok := l.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+		pc := ipv4.NewPacketConn(l)
+		flags := ipv4.FlagSrc | ipv4.FlagDst | ipv4.FlagInterface
+		if err := pc.SetControlMessage(flags, true); err != nil {
+			return nil, err
+		}
 
-			// Packet reader for client
-			r := &packetReaderImpl{
-				ch: ch,
+		return func(b []byte) (int, *controlMessage, error) {
+			n, cm, addr, err := pc.ReadFrom(b)
+			if err != nil || cm == nil {
+				return n, nil, err
 			}
+			return n, &controlMessage{dst: cm.Dst, addr: addr}, nil
+		}, nil
+	}
+
+	pc := ipv6.NewPacketConn(l)
+	flags := ipv6.FlagSrc | ipv6.FlagDst | ipv6.FlagInterface
+	if err := pc.SetControlMessage(flags, true); err != nil {
+		return nil, err
+	}
+
+	return func(b []byte) (int, *controlMessage, error) {
+		n, cm, addr, err := pc.ReadFrom(b)
+		if err != nil || cm == nil {
+			return n, nil, err
+		}
+		return n, &controlMessage{dst: cm.Dst, addr: addr}, nil
+	}, nil
+}
+
+// udpNetwork returns the network of a UDP socket that can exchange packets
+// with the address ip.
+func udpNetwork(ip net.IP) string {
+	if ip.To4() != nil {
+		return "udp4"
+	}
+
+	return "udp6"
+}
 
-			// Packet writer for client
-			w := &packetWriterImpl{
-				PacketConn: &syncPacketConn{
-					PacketConn: l,
-				},
-				addr: addr,
+// allowPeer reports whether requests from addr are served according to
+// AllowList and DenyList.
+func (srv *Server) allowPeer(addr net.Addr) bool {
+	if len(srv.AllowList) == 0 && len(srv.DenyList) == 0 {
+		return true
+	}
+
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.IPAddr:
+		ip = a.IP
+	default:
+		if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+			ip = net.ParseIP(host)
+		}
+	}
+	if ip == nil {
+		return len(srv.AllowList) == 0
+	}
+
+	for _, n := range srv.DenyList {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(srv.AllowList) == 0 {
+		return true
+	}
+	for _, n := range srv.AllowList {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// duplicateRequest reports whether request b from addr is a retransmission
+// of a request that was received within DuplicateRequestWindow, and records
+// it otherwise.
+func (srv *Server) duplicateRequest(addr net.Addr, b []byte) bool {
+	window := srv.DuplicateRequestWindow
+	if window <= 0 {
+		return false
+	}
+
+	now := srv.timeSource().Now()
+	key := addr.String() + "\x00" + string(b)
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if t, ok := srv.recent[key]; ok && now.Sub(t) < window {
+		return true
+	}
+
+	// Expired requests are removed at most once per window, so that the
+	// cost of a sweep is spread over the requests in between.
+	if now.Sub(srv.swept) >= window {
+		for k, t := range srv.recent {
+			if now.Sub(t) >= window {
+				delete(srv.recent, k)
 			}
+		}
+		srv.swept = now
+	}
+
+	if srv.recent == nil {
+		srv.recent = make(map[string]time.Time)
+	}
+	srv.recent[key] = now
+	return false
+}
 
-			// Kick off a serve loop for this peer address.
-			go func() {
-				// A client MAY reuse its socket for more than one request.
-				// Therefore, continue running the serve loop until there are no more
-				// inbound packets on the channel for this peer address.
-				for stop := false; !stop; {
-					serve(controlMessage{cm}, r, w, h)
+// trackListener adds or removes l from the set of listeners that is closed
+// on shutdown. It returns false if l cannot be added because the server is
+// shutting down.
+func (srv *Server) trackListener(l net.PacketConn, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if !add {
+		delete(srv.listeners, l)
+		return true
+	}
 
-					lock.Lock()
-					if len(ch) == 0 {
-						delete(table, addr.String())
-						stop = true
-					}
-					lock.Unlock()
-				}
-			}()
+	if srv.inShutdown {
+		return false
+	}
+
+	if srv.listeners == nil {
+		srv.listeners = make(map[net.PacketConn]struct{})
+	}
+
+	if srv.sem == nil && srv.MaxConcurrentSessions > 0 {
+		srv.sem = make(chan struct{}, srv.MaxConcurrentSessions)
+	}
+
+	srv.listeners[l] = struct{}{}
+	return true
+}
+
+// baseContext returns the parent of the context of every session, which is
+// cancelled when a shutdown is forced.
+func (srv *Server) baseContext() context.Context {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.ctx == nil {
+		srv.ctx, srv.cancel = context.WithCancel(context.Background())
+	}
+
+	return srv.ctx
+}
+
+// checkOptions returns an error if the options o of a request exceed
+// MaxOptions or MaxOptionBytes.
+func (srv *Server) checkOptions(o map[string]string) error {
+	max, maxBytes := defaultMaxOptions, defaultMaxOptionBytes
+	if srv != nil && srv.MaxOptions != 0 {
+		max = srv.MaxOptions
+	}
+	if srv != nil && srv.MaxOptionBytes != 0 {
+		maxBytes = srv.MaxOptionBytes
+	}
+
+	if max > 0 && len(o) > max {
+		return errTooManyOptions
+	}
+
+	if maxBytes > 0 {
+		n := 0
+		for name, value := range o {
+			n += len(name) + len(value) + 2
 		}
+		if n > maxBytes {
+			return errOptionsSize
+		}
+	}
+
+	return nil
+}
+
+// blksize returns the block size that applies if the blksize option is not
+// negotiated.
+func (srv *Server) blksize() int {
+	switch {
+	case srv.DisableOptions, srv.DefaultBlksize <= 0:
+		return defaultBlksize
+	case srv.DefaultBlksize < 8:
+		return 8
+	case srv.DefaultBlksize > 65464:
+		return 65464
+	}
 
-		select {
-		case ch <- b:
-		default:
-			// Drop packet on the floor if we can't handle it
+	return srv.DefaultBlksize
+}
+
+// timeout returns the timeout that applies if the timeout option is not
+// negotiated.
+func (srv *Server) timeout() time.Duration {
+	if srv.DefaultTimeout > 0 {
+		return srv.DefaultTimeout
+	}
+
+	return defaultTimeout
+}
+
+// aggregateLimiter returns the rateLimiter for AggregateRateLimit.
+func (srv *Server) aggregateLimiter() *rateLimiter {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.limiter == nil {
+		srv.limiter = newRateLimiter(srv.AggregateRateLimit)
+	}
+
+	return srv.limiter
+}
+
+func (srv *Server) shuttingDown() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.inShutdown
+}
+
+// Shutdown gracefully shuts down the server. It stops accepting new requests,
+// waits for in-flight sessions to finish and then closes the listeners.
+//
+// If ctx expires before all sessions have finished, Shutdown closes the
+// listeners all the same and returns ctx.Err(). The context of the sessions
+// that are still in flight at that point is cancelled, which aborts them.
+//
+// Once Shutdown has been called, Serve and ListenAndServe return
+// ErrServerClosed.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	srv.inShutdown = true
+	srv.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		srv.sessions.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	srv.mu.Lock()
+	if err != nil && srv.cancel != nil {
+		srv.cancel()
+	}
+	for l := range srv.listeners {
+		_ = l.Close()
+	}
+	for _, conns := range srv.pool {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}
+	srv.pool = nil
+	srv.mu.Unlock()
+
+	return err
+}
+
+// listenSession opens the socket a session with peer is served from, given
+// the address dst the request was sent to. It also returns the key of the
+// pool of sockets that the socket is returned to, if any, see releaseSocket.
+func (srv *Server) listenSession(peer net.Addr, dst net.IP) (net.PacketConn, string, error) {
+	if srv.ListenSession != nil {
+		conn, err := srv.ListenSession(peer)
+		return conn, "", err
+	}
+
+	network := "udp"
+	if addr, ok := peer.(*net.UDPAddr); ok {
+		network = udpNetwork(addr.IP)
+	}
+
+	if srv.BindReplyAddr && dst != nil && !dst.IsUnspecified() && !dst.IsMulticast() && !dst.Equal(net.IPv4bcast) {
+		conn, key, err := srv.openSocket(network, net.JoinHostPort(dst.String(), "0"))
+		if err == nil {
+			return conn, key, nil
+		}
+	}
+
+	return srv.openSocket(network, ":0")
+}
+
+// logError sends an EventError for err concerning peer to the Logger, if
+// there is one. It is for errors outside of a session.
+func (srv *Server) logError(peer net.Addr, err error) {
+	if srv.Logger != nil {
+		srv.Logger.Log(Event{Type: EventError, Peer: peer, Err: err})
+	}
+}
+
+// reject answers a request from peer that no session is started for with an
+// error packet for err. The reply is sent from the listening socket l, since
+// there is no other.
+func (srv *Server) reject(l net.PacketConn, peer net.Addr, err error) {
+	w := &packetWriterImpl{PacketConn: l, addr: peer, trace: srv.PacketTrace}
+	werr := w.write(&packetERROR{
+		errorCode:    tftpErrNotDefined.Code,
+		errorMessage: err.Error(),
+	})
+	if werr != nil {
+		srv.logError(peer, werr)
+	}
+}
+
+// serveRequest serves the request in buffer b from a new socket, in the same
+// address family as the peer. If release is not nil, replies are sent from
+// the listening socket l according to srv.ReplySource, and release is called
+// once the session no longer reads from l.
+func (srv *Server) serveRequest(l net.PacketConn, c controlMessage, b []byte, release func()) {
+	var conn net.PacketConn
+	if release != nil {
+		defer release()
+	}
+
+	if srv.ReplySource != ReplyFromListener {
+		var key string
+		var err error
+		conn, key, err = srv.listenSession(c.addr, c.dst)
+		if err != nil {
+			srv.logError(c.addr, err)
+			srv.reject(l, c.addr, errNoSocket)
+			return
 		}
 
-		// Unlock after sending buffer so that other routines can reliably check
-		// and use the length of a channel while holding the lock.
-		lock.Unlock()
+		defer srv.releaseSocket(key, conn)
+	}
+
+	if release != nil {
+		srv.serveFromListener(l, conn, c, b, release)
+		return
+	}
+
+	// Packet reader for client
+	r := &packetReaderImpl{
+		PacketConn: conn,
+		addr:       c.addr,
+		req:        b,
+		buf:        make([]byte, 65536),
+		trace:      srv.PacketTrace,
+		logger:     srv.Logger,
+	}
+
+	// Packet writer for client
+	w := &packetWriterImpl{
+		PacketConn: conn,
+		addr:       c.addr,
+		trace:      srv.PacketTrace,
+	}
+
+	_ = srv.serve(c, r, w)
+}
+
+// serveFromListener serves the request in buffer b from the listening socket
+// l. If conn is not nil, the session moves to conn once the peer has answered
+// the first reply, and release is called.
+func (srv *Server) serveFromListener(l, conn net.PacketConn, c controlMessage, b []byte, release func()) {
+	// Serve reads from l again once the session is done with it, so the
+	// deadlines set by the session must not linger.
+	defer func() {
+		_ = l.SetReadDeadline(time.Time{})
+	}()
+
+	r := &listenerReader{
+		packetReaderImpl: &packetReaderImpl{
+			PacketConn: l,
+			addr:       c.addr,
+			req:        b,
+			buf:        make([]byte, 65536),
+			shared:     true,
+			trace:      srv.PacketTrace,
+			logger:     srv.Logger,
+		},
+		w: &packetWriterImpl{
+			PacketConn: l,
+			addr:       c.addr,
+			trace:      srv.PacketTrace,
+		},
+		l:       l,
+		conn:    conn,
+		release: release,
+	}
+
+	_ = srv.serve(c, r, r.w)
+}
+
+// listenerReader reads the packets of a session that is served from the
+// listening socket. If conn is not nil, it moves the session to conn once a
+// packet other than the request has been read from the peer, and releases l.
+type listenerReader struct {
+	*packetReaderImpl
+
+	w       *packetWriterImpl
+	l       net.PacketConn
+	conn    net.PacketConn
+	release func()
+}
+
+func (r *listenerReader) read(timeout time.Duration) (packet, error) {
+	req := r.req != nil
+	p, err := r.packetReaderImpl.read(timeout)
+	if err != nil || req || r.conn == nil {
+		return p, err
 	}
+
+	// The peer has answered the first reply, so the transfer continues on
+	// the socket of the session, and Serve may read from l again.
+	_ = r.l.SetReadDeadline(time.Time{})
+	r.packetReaderImpl.PacketConn = r.conn
+	r.packetReaderImpl.shared = false
+	r.w.PacketConn = r.conn
+	r.conn = nil
+	r.release()
+	return p, err
 }
 
+// ListenAndServe listens on UDP port 69 and serves requests using a Server
+// with default parameters for Handler h.
 func ListenAndServe(h Handler) error {
-	l, err := net.ListenPacket("udp4", ":69")
+	return NewServer(h).ListenAndServe()
+}
+
+// ListenAndServe listens on the UDP address srv.Addr and serves requests.
+// It is a shorthand for opening the socket and passing it to Serve.
+// If srv.Addr is empty, ":69" is used. The address may be an IPv4 or an IPv6
+// address, such as "[::]:69". If it has no host, requests are served over
+// both IPv4 and IPv6 where the system supports it. See Listening for running
+// with reduced privileges after binding port 69.
+func (srv *Server) ListenAndServe() error {
+	addr := srv.Addr
+	if addr == "" {
+		addr = defaultAddr
+	}
+
+	l, err := net.ListenPacket("udp", addr)
 	if err != nil {
 		return err
 	}
 
-	return Serve(l, h)
+	defer func() {
+		// This is called from an anonymous function to make errcheck happy.
+		_ = l.Close()
+	}()
+
+	if srv.Listening != nil {
+		if err := srv.Listening(l); err != nil {
+			return err
+		}
+	}
+
+	return srv.Serve(l)
 }
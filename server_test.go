@@ -0,0 +1,996 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// addrHandler records the peer address passed to the Handler.
+type addrHandler struct {
+	addr chan net.Addr
+}
+
+func (h addrHandler) ReadFile(ctx context.Context, peer net.Addr, filename string) (ReadCloser, error) {
+	h.addr <- peer
+	return nil, os.ErrNotExist
+}
+
+func (h addrHandler) WriteFile(ctx context.Context, peer net.Addr, filename string) (WriteCloser, error) {
+	h.addr <- peer
+	return nil, os.ErrPermission
+}
+
+// bufHandler serves reads from data and writes to w.
+type bufHandler struct {
+	data []byte
+	w    io.Writer
+}
+
+func (h bufHandler) ReadFile(ctx context.Context, peer net.Addr, filename string) (ReadCloser, error) {
+	return &rcBuffer{bytes.NewReader(h.data)}, nil
+}
+
+func (h bufHandler) WriteFile(ctx context.Context, peer net.Addr, filename string) (WriteCloser, error) {
+	return &wcBuffer{h.w}, nil
+}
+
+// testClient is a bare UDP socket used to exchange packets with a server.
+type testClient struct {
+	net.PacketConn
+
+	t    *testing.T
+	addr net.Addr // The address of the server.
+	b    bytes.Buffer
+}
+
+func newTestClient(t *testing.T, addr net.Addr) *testClient {
+	c, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testClient{PacketConn: c, t: t, addr: addr}
+}
+
+func (c *testClient) write(p packet) {
+	c.b.Reset()
+	if err := packetToWire(p, &c.b); err != nil {
+		c.t.Fatal(err)
+	}
+
+	if _, err := c.WriteTo(c.b.Bytes(), c.addr); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *testClient) read() (packet, net.Addr) {
+	buf := make([]byte, 65536)
+	if err := c.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		c.t.Fatal(err)
+	}
+
+	n, addr, err := c.ReadFrom(buf)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	p, err := packetFromWire(bytes.NewBuffer(buf[:n]))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	return p, addr
+}
+
+func listenTest(t *testing.T, h Handler) net.PacketConn {
+	l, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		_ = Serve(l, h)
+	}()
+
+	return l
+}
+
+func TestServePeerAddr(t *testing.T) {
+	h := addrHandler{addr: make(chan net.Addr, 1)}
+	l := listenTest(t, h)
+	defer l.Close()
+
+	for _, p := range []packet{
+		&packetRRQ{packetXRQ{filename: "file", mode: modeOCTET}},
+		&packetWRQ{packetXRQ{filename: "file", mode: modeOCTET}},
+	} {
+		c := newTestClient(t, l.LocalAddr())
+		c.write(p)
+
+		px, _ := c.read()
+		assert.IsType(t, &packetERROR{}, px)
+
+		addr := <-h.addr
+		assert.IsType(t, &net.UDPAddr{}, addr)
+		assert.Equal(t, c.LocalAddr().String(), addr.String())
+		c.Close()
+	}
+}
+
+func TestServeReadRequest(t *testing.T) {
+	h := bufHandler{data: []byte("hello world\n")}
+	l := listenTest(t, h)
+	defer l.Close()
+
+	c := newTestClient(t, l.LocalAddr())
+	defer c.Close()
+
+	c.write(&packetRRQ{packetXRQ{filename: "file", mode: modeOCTET}})
+
+	// The reply is sent from a new transfer ID.
+	px, addr := c.read()
+	assert.Equal(t, &packetDATA{blockNr: 1, data: []byte("hello world\n")}, px)
+	assert.NotEqual(t, l.LocalAddr().String(), addr.String())
+
+	c.addr = addr
+	c.write(&packetACK{blockNr: 1})
+}
+
+func TestServeWriteRequest(t *testing.T) {
+	srv := NewServer(bufHandler{w: ioutil.Discard})
+	srv.DefaultBlksize = 8
+
+	l, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		_ = srv.Serve(l)
+	}()
+
+	c := newTestClient(t, l.LocalAddr())
+	defer c.Close()
+
+	c.write(&packetWRQ{packetXRQ{filename: "file", mode: modeOCTET}})
+
+	px, addr := c.read()
+	assert.Equal(t, &packetACK{blockNr: 0}, px)
+	c.addr = addr
+
+	c.write(&packetDATA{blockNr: 1, data: []byte("01234567")})
+	px, _ = c.read()
+	assert.Equal(t, &packetACK{blockNr: 1}, px)
+
+	c.write(&packetDATA{blockNr: 2, data: []byte("89")})
+	px, _ = c.read()
+	assert.Equal(t, &packetACK{blockNr: 2}, px)
+}
+
+func TestServerShutdown(t *testing.T) {
+	srv := NewServer(bufHandler{data: []byte("hello world\n")})
+	srv.DefaultTimeout = time.Second // Limits the time spent dallying.
+
+	l, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(l)
+	}()
+
+	c := newTestClient(t, l.LocalAddr())
+	defer c.Close()
+
+	// Start a session, but don't acknowledge its DATA packet yet.
+	c.write(&packetRRQ{packetXRQ{filename: "file", mode: modeOCTET}})
+	_, addr := c.read()
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- srv.Shutdown(context.Background())
+	}()
+
+	// Shutdown waits for the session to finish.
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("Shutdown returned early: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	c.addr = addr
+	c.write(&packetACK{blockNr: 1})
+
+	assert.Nil(t, <-shutdownErr)
+	assert.Equal(t, ErrServerClosed, <-serveErr)
+
+	// The server can no longer be used.
+	assert.Equal(t, ErrServerClosed, srv.Serve(l))
+}
+
+func TestServerShutdownDeadline(t *testing.T) {
+	srv := NewServer(bufHandler{data: []byte("hello world\n")})
+
+	l, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(l)
+	}()
+
+	c := newTestClient(t, l.LocalAddr())
+	defer c.Close()
+
+	// Start a session that doesn't finish before the deadline.
+	c.write(&packetRRQ{packetXRQ{filename: "file", mode: modeOCTET}})
+	_, _ = c.read()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	assert.Equal(t, context.DeadlineExceeded, srv.Shutdown(ctx))
+	assert.Equal(t, ErrServerClosed, <-serveErr)
+}
+
+func TestServerMaxConcurrentSessions(t *testing.T) {
+	srv := NewServer(bufHandler{data: []byte("hello world\n")})
+	srv.DefaultTimeout = time.Second // Limits the time spent dallying.
+	srv.MaxConcurrentSessions = 2
+
+	l, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		_ = srv.Serve(l)
+	}()
+
+	var clients []*testClient
+	for i := 0; i < 4; i++ {
+		c := newTestClient(t, l.LocalAddr())
+		defer c.Close()
+
+		c.write(&packetRRQ{packetXRQ{filename: "file", mode: modeOCTET}})
+		clients = append(clients, c)
+	}
+
+	// The first requests start a session; sessions are not acknowledged yet
+	// and remain active.
+	for _, c := range clients[:2] {
+		px, addr := c.read()
+		assert.IsType(t, &packetDATA{}, px)
+		c.addr = addr
+	}
+
+	// The excess requests are answered from the listening socket.
+	for _, c := range clients[2:] {
+		px, addr := c.read()
+		assert.Equal(t, &packetERROR{errorCode: 0, errorMessage: "server busy"}, px)
+		assert.Equal(t, l.LocalAddr().String(), addr.String())
+	}
+
+	for _, c := range clients[:2] {
+		c.write(&packetACK{blockNr: 1})
+	}
+
+	// Once the sessions have finished, new requests are served again.
+	c := newTestClient(t, l.LocalAddr())
+	defer c.Close()
+
+	var px packet
+	for i := 0; i < 40; i++ {
+		c.write(&packetRRQ{packetXRQ{filename: "file", mode: modeOCTET}})
+		px, c.addr = c.read()
+		if _, ok := px.(*packetDATA); ok {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	assert.IsType(t, &packetDATA{}, px)
+	c.write(&packetACK{blockNr: 1})
+}
+
+func TestServeUnknownTransferID(t *testing.T) {
+	srv := NewServer(bufHandler{data: []byte("0123456789")})
+	srv.DefaultBlksize = 8
+
+	l, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		_ = srv.Serve(l)
+	}()
+
+	c := newTestClient(t, l.LocalAddr())
+	defer c.Close()
+
+	c.write(&packetRRQ{packetXRQ{filename: "file", mode: modeOCTET}})
+	px, addr := c.read()
+	assert.Equal(t, &packetDATA{blockNr: 1, data: []byte("01234567")}, px)
+	c.addr = addr
+
+	// A packet from another port is answered with an error.
+	stray := newTestClient(t, addr)
+	defer stray.Close()
+
+	stray.write(&packetACK{blockNr: 1})
+	px, _ = stray.read()
+	assert.Equal(t, &packetERROR{errorCode: 5, errorMessage: "Unknown transfer ID."}, px)
+
+	// The transfer is not disturbed.
+	c.write(&packetACK{blockNr: 1})
+	px, _ = c.read()
+	assert.Equal(t, &packetDATA{blockNr: 2, data: []byte("89")}, px)
+	c.write(&packetACK{blockNr: 2})
+}
+
+// strayConn is a socket that receives an ACK from stray before one from peer,
+// and fails to send anything.
+type strayConn struct {
+	net.PacketConn
+	stray, peer net.Addr
+	reads       int
+}
+
+func (c *strayConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *strayConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.reads++
+	from := c.stray
+	if c.reads > 1 {
+		from = c.peer
+	}
+
+	var buf bytes.Buffer
+	if err := packetToWire(&packetACK{blockNr: 1}, &buf); err != nil {
+		return 0, nil, err
+	}
+	return copy(b, buf.Bytes()), from, nil
+}
+
+func (c *strayConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestServeUnknownTransferIDWriteError(t *testing.T) {
+	var events []Event
+	conn := &strayConn{
+		stray: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1001},
+		peer:  &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1002},
+	}
+	r := &packetReaderImpl{
+		PacketConn: conn,
+		addr:       conn.peer,
+		buf:        make([]byte, 65536),
+		logger: LoggerFunc(func(e Event) {
+			events = append(events, e)
+		}),
+	}
+
+	// The error that fails to be sent to the stray address is logged, and
+	// the packet of the peer is read after it.
+	px, err := r.read(time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, &packetACK{blockNr: 1}, px)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, EventError, events[0].Type)
+		assert.Equal(t, conn.stray, events[0].Peer)
+		assert.EqualError(t, events[0].Err, "write failed")
+	}
+}
+
+func TestServeMalformedPacket(t *testing.T) {
+	events := make(chan Event, 16)
+	srv := NewServer(bufHandler{})
+	srv.Logger = LoggerFunc(func(e Event) {
+		events <- e
+	})
+
+	l, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		_ = srv.Serve(l)
+	}()
+
+	c := newTestClient(t, l.LocalAddr())
+	defer c.Close()
+
+	raw := []byte{0x0, 0x9, 0xde, 0xad}
+	if _, err := c.WriteTo(raw, l.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+
+	px, _ := c.read()
+	if assert.IsType(t, &packetERROR{}, px) {
+		assert.Equal(t, uint16(4), px.(*packetERROR).errorCode)
+	}
+
+	var e Event
+	for e = range events {
+		if e.Type == EventComplete {
+			break
+		}
+	}
+
+	var merr *MalformedPacketError
+	if assert.True(t, errors.As(e.Err, &merr)) {
+		assert.Equal(t, raw, merr.Raw)
+		assert.Equal(t, c.LocalAddr().String(), merr.Addr.String())
+	}
+}
+
+func TestServeUnknownTransferIDAfterOACK(t *testing.T) {
+	l := listenTest(t, bufHandler{data: []byte("0123456789")})
+	defer l.Close()
+
+	c := newTestClient(t, l.LocalAddr())
+	defer c.Close()
+
+	c.write(&packetRRQ{packetXRQ{filename: "file", mode: modeOCTET, options: map[string]string{"blksize": "8"}}})
+	px, addr := c.read()
+	assert.Equal(t, &packetOACK{options: map[string]string{"blksize": "8"}}, px)
+	c.addr = addr
+
+	// The transfer ID of the peer is the port of the request, so an ACK for
+	// the OACK from another port is rejected.
+	stray := newTestClient(t, addr)
+	defer stray.Close()
+
+	stray.write(&packetACK{blockNr: 0})
+	px, _ = stray.read()
+	assert.Equal(t, &packetERROR{errorCode: 5, errorMessage: "Unknown transfer ID."}, px)
+
+	c.write(&packetACK{blockNr: 0})
+	px, _ = c.read()
+	assert.Equal(t, &packetDATA{blockNr: 1, data: []byte("01234567")}, px)
+	c.write(&packetACK{blockNr: 1})
+	px, _ = c.read()
+	assert.Equal(t, &packetDATA{blockNr: 2, data: []byte("89")}, px)
+	c.write(&packetACK{blockNr: 2})
+}
+
+func TestServeModes(t *testing.T) {
+	var tests = []struct {
+		mode  mode
+		write bool // Whether to send a WRQ rather than an RRQ.
+		reply packet
+	}{
+		{mode: "octet", reply: &packetDATA{blockNr: 1, data: []byte("data")}},
+		{mode: "OcTeT", reply: &packetDATA{blockNr: 1, data: []byte("data")}},
+		{mode: "netascii", reply: &packetDATA{blockNr: 1, data: []byte("data")}},
+		{mode: "NETASCII", reply: &packetDATA{blockNr: 1, data: []byte("data")}},
+		{mode: "mail", reply: &packetERROR{errorCode: 4, errorMessage: "mail mode not supported"}},
+		{mode: "Mail", reply: &packetERROR{errorCode: 4, errorMessage: "mail mode not supported"}},
+		{mode: "mail", write: true, reply: &packetERROR{errorCode: 4, errorMessage: "mail mode not supported"}},
+		{mode: "MAIL", write: true, reply: &packetERROR{errorCode: 4, errorMessage: "mail mode not supported"}},
+		{mode: "binary", reply: &packetERROR{errorCode: 4, errorMessage: `invalid mode "binary"`}},
+	}
+
+	l := listenTest(t, bufHandler{data: []byte("data")})
+	defer l.Close()
+
+	for _, test := range tests {
+		c := newTestClient(t, l.LocalAddr())
+		if test.write {
+			c.write(&packetWRQ{packetXRQ{filename: "file", mode: test.mode}})
+		} else {
+			c.write(&packetRRQ{packetXRQ{filename: "file", mode: test.mode}})
+		}
+
+		px, addr := c.read()
+		assert.Equal(t, test.reply, px, string(test.mode))
+		if _, ok := px.(*packetDATA); ok {
+			c.addr = addr
+			c.write(&packetACK{blockNr: 1})
+		}
+
+		c.Close()
+	}
+}
+
+func TestServeBindReplyAddr(t *testing.T) {
+	for _, bind := range []bool{false, true} {
+		srv := NewServer(bufHandler{data: []byte("data")})
+		srv.BindReplyAddr = bind
+
+		// Any address in 127.0.0.0/8 is local, but replies to 127.0.0.1 are
+		// sent from 127.0.0.1 unless the socket is bound.
+		l, err := net.ListenPacket("udp4", "127.0.0.2:0")
+		if err != nil {
+			t.Skip("127.0.0.2 is not available:", err)
+		}
+
+		go func() {
+			_ = srv.Serve(l)
+		}()
+
+		c := newTestClient(t, l.LocalAddr())
+		c.write(&packetRRQ{packetXRQ{filename: "file", mode: modeOCTET}})
+
+		px, addr := c.read()
+		assert.Equal(t, &packetDATA{blockNr: 1, data: []byte("data")}, px)
+		if bind {
+			assert.Equal(t, "127.0.0.2", addr.(*net.UDPAddr).IP.String())
+		} else {
+			assert.Equal(t, "127.0.0.1", addr.(*net.UDPAddr).IP.String())
+		}
+
+		c.addr = addr
+		c.write(&packetACK{blockNr: 1})
+		c.Close()
+		l.Close()
+	}
+}
+
+func TestServeMalformedRequest(t *testing.T) {
+	l := listenTest(t, bufHandler{data: []byte("data")})
+	defer l.Close()
+
+	for _, raw := range [][]byte{
+		[]byte("\x00\x01file"),
+		[]byte("\x00\x01file\x00octet"),
+		[]byte("\x00\x02file\x00octet\x00blksize\x00"),
+		append(append([]byte("\x00\x01"), bytes.Repeat([]byte("a"), 1000)...), "\x00octet\x00"...),
+	} {
+		c := newTestClient(t, l.LocalAddr())
+		if _, err := c.WriteTo(raw, l.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+
+		px, _ := c.read()
+		if assert.IsType(t, &packetERROR{}, px) {
+			assert.Equal(t, uint16(4), px.(*packetERROR).errorCode)
+		}
+		c.Close()
+	}
+}
+
+func TestListenAndServeListening(t *testing.T) {
+	srv := NewServer(bufHandler{data: []byte("data")})
+	srv.Addr = "127.0.0.1:0"
+
+	listening := make(chan net.Addr)
+	proceed := make(chan struct{})
+	srv.Listening = func(l net.PacketConn) error {
+		listening <- l.LocalAddr()
+		<-proceed
+		return nil
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.ListenAndServe()
+	}()
+
+	// The socket is bound before Listening is called, but requests are only
+	// served after it returns.
+	addr := <-listening
+	c := newTestClient(t, addr)
+	defer c.Close()
+	c.write(&packetRRQ{packetXRQ{filename: "file", mode: modeOCTET}})
+
+	close(proceed)
+	px, _ := c.read()
+	assert.Equal(t, &packetDATA{blockNr: 1, data: []byte("data")}, px)
+
+	// The session is left to time out.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_ = srv.Shutdown(ctx)
+	<-done
+
+	// An error aborts ListenAndServe before anything is served.
+	srv = NewServer(bufHandler{})
+	srv.Addr = "127.0.0.1:0"
+	srv.Listening = func(l net.PacketConn) error {
+		return os.ErrPermission
+	}
+	assert.Equal(t, os.ErrPermission, srv.ListenAndServe())
+}
+
+func TestServeDuplicateRequest(t *testing.T) {
+	for _, window := range []time.Duration{0, time.Minute} {
+		var mu sync.Mutex
+		var requests int
+		h := HandlerFuncs{
+			Read: func(ctx context.Context, peer net.Addr, filename string) (ReadCloser, error) {
+				mu.Lock()
+				requests++
+				mu.Unlock()
+				return ioutil.NopCloser(bytes.NewReader([]byte("data"))), nil
+			},
+		}
+
+		clock := newFakeClock()
+		srv := NewServer(h)
+		srv.DuplicateRequestWindow = window
+		srv.clock = clock
+
+		l, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go func() {
+			_ = srv.Serve(l)
+		}()
+
+		// A request that is retransmitted right away starts a second session
+		// only if duplicates aren't detected.
+		c := newTestClient(t, l.LocalAddr())
+		c.write(&packetRRQ{packetXRQ{filename: "file", mode: modeOCTET}})
+		c.write(&packetRRQ{packetXRQ{filename: "file", mode: modeOCTET}})
+
+		px, _ := c.read()
+		assert.Equal(t, &packetDATA{blockNr: 1, data: []byte("data")}, px)
+
+		sessions := 1
+		if window == 0 {
+			sessions = 2
+			px, _ = c.read()
+			assert.Equal(t, &packetDATA{blockNr: 1, data: []byte("data")}, px)
+		}
+
+		// Once the window has passed, the request is served again.
+		if window > 0 {
+			clock.Advance(window)
+			c.write(&packetRRQ{packetXRQ{filename: "file", mode: modeOCTET}})
+			px, _ = c.read()
+			assert.Equal(t, &packetDATA{blockNr: 1, data: []byte("data")}, px)
+			sessions++
+		}
+
+		mu.Lock()
+		assert.Equal(t, sessions, requests)
+		mu.Unlock()
+
+		c.Close()
+		l.Close()
+	}
+}
+
+// wrappedConn hides the type of a PacketConn from the Server.
+type wrappedConn struct {
+	net.PacketConn
+}
+
+func TestServeListenSession(t *testing.T) {
+	peers := make(chan net.Addr, 1)
+	srv := NewServer(bufHandler{data: []byte("0123456789")})
+	srv.ListenSession = func(peer net.Addr) (net.PacketConn, error) {
+		peers <- peer
+		c, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		return wrappedConn{c}, err
+	}
+
+	l, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		_ = srv.Serve(wrappedConn{l})
+	}()
+
+	c := newTestClient(t, l.LocalAddr())
+	defer c.Close()
+
+	c.write(&packetRRQ{packetXRQ{filename: "file", mode: modeOCTET}})
+	px, addr := c.read()
+	assert.Equal(t, &packetDATA{blockNr: 1, data: []byte("0123456789")}, px)
+	assert.NotEqual(t, l.LocalAddr().String(), addr.String())
+	assert.Equal(t, c.LocalAddr().String(), (<-peers).String())
+
+	c.addr = addr
+	c.write(&packetACK{blockNr: 1})
+}
+
+func TestServeListenSessionError(t *testing.T) {
+	events := make(chan Event, 1)
+	srv := NewServer(bufHandler{data: []byte("0123456789")})
+	srv.ListenSession = func(peer net.Addr) (net.PacketConn, error) {
+		return nil, errors.New("out of sockets")
+	}
+	srv.Logger = LoggerFunc(func(e Event) {
+		events <- e
+	})
+
+	l, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		_ = srv.Serve(l)
+	}()
+
+	c := newTestClient(t, l.LocalAddr())
+	defer c.Close()
+
+	// The peer is told from the listening socket, and the cause is logged.
+	c.write(&packetRRQ{packetXRQ{filename: "file", mode: modeOCTET}})
+	px, addr := c.read()
+	assert.Equal(t, &packetERROR{errorCode: 0, errorMessage: "no socket available"}, px)
+	assert.Equal(t, l.LocalAddr().String(), addr.String())
+
+	e := <-events
+	assert.Equal(t, EventError, e.Type)
+	assert.Equal(t, c.LocalAddr().String(), e.Peer.String())
+	assert.EqualError(t, e.Err, "out of sockets")
+}
+
+func TestServeIPv6(t *testing.T) {
+	l, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+	defer l.Close()
+
+	srv := NewServer(bufHandler{data: []byte("hello world\n")})
+	srv.DefaultTimeout = time.Second // Limits the time spent dallying.
+
+	go func() {
+		_ = srv.Serve(l)
+	}()
+
+	rc, err := NewClient().Get(context.Background(), l.LocalAddr().String(), "file", WithBlksize(8))
+	if assert.Nil(t, err) {
+		data, err := ioutil.ReadAll(rc)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("hello world\n"), data)
+	}
+
+	// The peer address passed to the Handler is an IPv6 address.
+	h := addrHandler{addr: make(chan net.Addr, 1)}
+	l6 := listenTest6(t, h)
+	defer l6.Close()
+
+	_, err = NewClient().Get(context.Background(), l6.LocalAddr().String(), "file")
+	assert.IsType(t, &Error{}, err)
+
+	addr := <-h.addr
+	if assert.IsType(t, &net.UDPAddr{}, addr) {
+		assert.True(t, addr.(*net.UDPAddr).IP.Equal(net.IPv6loopback))
+	}
+}
+
+func listenTest6(t *testing.T, h Handler) net.PacketConn {
+	l, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		_ = Serve(l, h)
+	}()
+
+	return l
+}
+
+func TestServeReplySource(t *testing.T) {
+	data := bytes.Repeat([]byte{0x1}, 600)
+
+	for _, source := range []ReplySource{ReplyFromSession, ReplyFirstFromListener, ReplyFromListener} {
+		srv := NewServer(bufHandler{data: data})
+		srv.ReplySource = source
+		srv.DefaultTimeout = 50 * time.Millisecond
+
+		l, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go func() {
+			_ = srv.Serve(l)
+		}()
+
+		// The listening socket is released after every transfer, so that the
+		// next request is served too. Every transfer is followed by a dally.
+		for i := 0; i < 2; i++ {
+			time.Sleep(4 * srv.DefaultTimeout)
+
+			c := newTestClient(t, l.LocalAddr())
+			c.write(&packetRRQ{packetXRQ{filename: "file", mode: modeOCTET}})
+
+			px, addr := c.read()
+			assert.Equal(t, &packetDATA{blockNr: 1, data: data[:512]}, px)
+			assert.Equal(t, source != ReplyFromSession, addr.String() == l.LocalAddr().String(), source)
+
+			c.addr = addr
+			c.write(&packetACK{blockNr: 1})
+
+			px, addr = c.read()
+			assert.Equal(t, &packetDATA{blockNr: 2, data: data[512:]}, px)
+			assert.Equal(t, source == ReplyFromListener, addr.String() == l.LocalAddr().String(), source)
+
+			c.addr = addr
+			c.write(&packetACK{blockNr: 2})
+			c.Close()
+		}
+
+		l.Close()
+	}
+}
+
+type tracedPacket struct {
+	dir  PacketDirection
+	peer string
+	b    []byte
+}
+
+func TestServePacketTrace(t *testing.T) {
+	data := bytes.Repeat([]byte{0x1}, 600)
+
+	traced := make(chan tracedPacket, 16)
+	srv := NewServer(bufHandler{data: data})
+	srv.DefaultTimeout = 50 * time.Millisecond
+	srv.PacketTrace = func(dir PacketDirection, peer net.Addr, b []byte) {
+		traced <- tracedPacket{dir: dir, peer: peer.String(), b: append([]byte(nil), b...)}
+	}
+
+	l, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		_ = srv.Serve(l)
+	}()
+
+	c := newTestClient(t, l.LocalAddr())
+	defer c.Close()
+
+	var expected []tracedPacket
+	wire := func(dir PacketDirection, p packet) {
+		var b bytes.Buffer
+		if err := packetToWire(p, &b); err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, tracedPacket{dir: dir, peer: c.LocalAddr().String(), b: b.Bytes()})
+	}
+
+	rrq := &packetRRQ{packetXRQ{filename: "file", mode: modeOCTET}}
+	c.write(rrq)
+	wire(PacketReceived, rrq)
+
+	px, addr := c.read()
+	wire(PacketSent, px)
+	c.addr = addr
+
+	c.write(&packetACK{blockNr: 1})
+	wire(PacketReceived, &packetACK{blockNr: 1})
+	px, _ = c.read()
+	wire(PacketSent, px)
+
+	c.write(&packetACK{blockNr: 2})
+	wire(PacketReceived, &packetACK{blockNr: 2})
+
+	// Every packet is traced as it was on the wire, in order.
+	for _, e := range expected {
+		select {
+		case p := <-traced:
+			assert.Equal(t, e, p)
+		case <-time.After(5 * time.Second):
+			t.Fatal("packet not traced")
+		}
+	}
+	assert.Equal(t, "in", PacketReceived.String())
+	assert.Equal(t, "out", PacketSent.String())
+}
+
+func TestServerAllowPeer(t *testing.T) {
+	cidrs := func(ss ...string) []*net.IPNet {
+		var nets []*net.IPNet
+		for _, s := range ss {
+			_, n, err := net.ParseCIDR(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nets = append(nets, n)
+		}
+		return nets
+	}
+
+	udp := func(ip string) net.Addr {
+		return &net.UDPAddr{IP: net.ParseIP(ip), Port: 1234}
+	}
+
+	srv := NewServer(NewMemHandler())
+	assert.True(t, srv.allowPeer(udp("192.0.2.1")))
+
+	// Deny takes precedence over allow.
+	srv.AllowList = cidrs("10.0.0.0/8", "2001:db8::/32")
+	srv.DenyList = cidrs("10.0.0.13/32", "2001:db8:dead::/48")
+	for addr, allowed := range map[string]bool{
+		"10.1.2.3":          true,
+		"::ffff:10.1.2.3":   true,
+		"10.0.0.13":         false,
+		"192.0.2.1":         false,
+		"2001:db8:1::1":     true,
+		"2001:db8:dead::1":  false,
+		"2001:db9::1":       false,
+		"::1":               false,
+		"::ffff:192.0.2.13": false,
+	} {
+		assert.Equal(t, allowed, srv.allowPeer(udp(addr)), addr)
+	}
+	assert.True(t, srv.allowPeer(&net.IPAddr{IP: net.ParseIP("10.1.2.3")}))
+	assert.False(t, srv.allowPeer(pipeAddr{}))
+
+	// Without an allow list, everything that isn't denied is allowed.
+	srv.AllowList = nil
+	assert.True(t, srv.allowPeer(udp("192.0.2.1")))
+	assert.True(t, srv.allowPeer(pipeAddr{}))
+	assert.False(t, srv.allowPeer(udp("2001:db8:dead::1")))
+}
+
+// pipeAddr is an address that is not an IP address.
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+func TestServeDeniedPeer(t *testing.T) {
+	called := false
+	h := newHandlerContextWith(func(srv *Server) {
+		_, n, _ := net.ParseCIDR("0.0.0.0/32")
+		srv.DenyList = []*net.IPNet{n}
+	})
+	h.readFunc = func(_ net.Addr, _ string) (ReadCloser, error) {
+		called = true
+		return nil, os.ErrNotExist
+	}
+	h.snd <- &packetRRQ{packetXRQ{filename: "file"}}
+
+	assert.Equal(t, &packetERROR{errorCode: 2, errorMessage: "access denied"}, <-h.rcv)
+	_, ok := <-h.rcv
+	assert.False(t, ok)
+	assert.False(t, called)
+}
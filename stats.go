@@ -0,0 +1,89 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"net"
+	"time"
+)
+
+// Stats summarizes a session. It is reported when the session ends, whether
+// it completed or failed.
+type Stats struct {
+	Filename string // Empty if no request was received.
+	Peer     net.Addr
+	Write    bool // Whether the request is a write request.
+
+	Bytes       int64  // The number of data bytes transferred.
+	Digest      []byte // The digest of the data, as described at Server.Hash, if set.
+	Blocks      int    // The number of data packets transferred.
+	Retransmits int    // The number of times the server retransmitted.
+
+	// Offset is the offset in the file up to which data was transferred, that
+	// is, the offset of the ReadCloser when the transfer started plus Bytes.
+	// A download that failed can be resumed from here. It equals Bytes for
+	// write requests and for a ReadCloser that doesn't implement io.Seeker.
+	// In netascii mode, Bytes counts the converted data as it was sent, which
+	// is not the number of bytes of the file it was converted from, so Offset
+	// is not a position in the file.
+	Offset int64
+
+	Blksize  int           // The negotiated payload size per data packet.
+	Timeout  time.Duration // The negotiated time before a retransmit.
+	Duration time.Duration // The time from receiving the request to the end of the session.
+
+	Err error // The reason the session failed, or nil if it completed.
+}
+
+// stats returns the Stats of the session, given the time it started and the
+// error it ended with.
+func (s *session) stats(start time.Time, err error) Stats {
+	return Stats{
+		Filename:    s.filename,
+		Peer:        s.c.RemoteAddr(),
+		Write:       s.wrq,
+		Bytes:       s.bytes,
+		Digest:      s.sum(),
+		Blocks:      s.blocks,
+		Retransmits: s.retransmits,
+		Offset:      s.offset + s.bytes,
+		Blksize:     s.blksize,
+		Timeout:     s.timeout,
+		Duration:    s.clock.Now().Sub(start),
+		Err:         err,
+	}
+}
+
+// transferred accounts for a block of data that was transferred, that is,
+// acknowledged by the peer or written to the WriteCloser. In netascii mode,
+// the data is hashed by the conversion instead, in its local form.
+func (s *session) transferred(data []byte) {
+	s.bytes += int64(len(data))
+	s.blocks++
+	if s.digest != nil && !s.netascii {
+		s.digest.Write(data)
+	}
+}
+
+// sum returns the digest of the data transferred, or nil if it isn't hashed.
+func (s *session) sum() []byte {
+	if s.digest == nil {
+		return nil
+	}
+
+	return s.digest.Sum(nil)
+}
@@ -0,0 +1,307 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newStatsHandlerContext(retries int) (*handlerContext, chan Stats) {
+	stats := make(chan Stats, 1)
+	h := newHandlerContextWith(func(srv *Server) {
+		srv.Retries = retries
+		srv.Stats = func(st Stats) {
+			stats <- st
+		}
+	})
+
+	return h, stats
+}
+
+func TestStatsReadRequest(t *testing.T) {
+	h, stats := newStatsHandlerContext(3)
+
+	h.SetReadCloser(&rcBuffer{bytes.NewBuffer([]byte("0123456789"))})
+	h.snd <- &packetRRQ{packetXRQ{filename: "file", options: map[string]string{"blksize": "8", "timeout": "2"}}}
+	assert.IsType(t, &packetOACK{}, <-h.rcv)
+	h.snd <- &packetACK{blockNr: 0}
+
+	// Trigger a retransmission of the first DATA packet.
+	_ = <-h.rcv
+	h.snd <- ErrTimeout
+	_ = <-h.rcv
+	h.snd <- &packetACK{blockNr: 1}
+	_ = <-h.rcv
+	h.snd <- &packetACK{blockNr: 2}
+
+	// End dallying after the final ACK.
+	h.snd <- ErrTimeout
+
+	st := <-stats
+	assert.Equal(t, "file", st.Filename)
+	assert.False(t, st.Write)
+	assert.Equal(t, int64(10), st.Bytes)
+	assert.Nil(t, st.Digest)
+	assert.Equal(t, 2, st.Blocks)
+	assert.Equal(t, 1, st.Retransmits)
+	assert.Equal(t, int64(10), st.Offset)
+	assert.Equal(t, 8, st.Blksize)
+	assert.Equal(t, 2*time.Second, st.Timeout)
+	assert.True(t, st.Duration > 0)
+	assert.Nil(t, st.Err)
+}
+
+func TestStatsReadRequestOffset(t *testing.T) {
+	h, stats := newStatsHandlerContext(3)
+
+	// The Handler resumes the download at offset 4.
+	r := bytes.NewReader([]byte("0123456789"))
+	_, _ = r.Seek(4, io.SeekStart)
+	h.SetReadCloser(&rcSeeker{r})
+	h.snd <- &packetRRQ{packetXRQ{filename: "file", options: map[string]string{"tsize": "0"}}}
+
+	assert.Equal(t, &packetOACK{options: map[string]string{"tsize": "6"}}, <-h.rcv)
+	h.snd <- &packetACK{blockNr: 0}
+	assert.Equal(t, &packetDATA{blockNr: 1, data: []byte("456789")}, <-h.rcv)
+	h.snd <- &packetACK{blockNr: 1}
+
+	// End dallying after the final ACK.
+	h.snd <- ErrTimeout
+
+	st := <-stats
+	assert.Equal(t, int64(6), st.Bytes)
+	assert.Equal(t, int64(10), st.Offset)
+	assert.Nil(t, st.Err)
+}
+
+func TestStatsWriteRequest(t *testing.T) {
+	h, stats := newStatsHandlerContext(3)
+
+	h.snd <- &packetWRQ{packetXRQ{filename: "file"}}
+	_ = <-h.rcv
+	h.snd <- &packetDATA{blockNr: 1, data: []byte{0x1, 0x2}}
+	_ = <-h.rcv
+
+	st := <-stats
+	assert.True(t, st.Write)
+	assert.Equal(t, int64(2), st.Bytes)
+	assert.Equal(t, 1, st.Blocks)
+	assert.Equal(t, 0, st.Retransmits)
+	assert.Equal(t, defaultBlksize, st.Blksize)
+	assert.Equal(t, defaultTimeout, st.Timeout)
+	assert.Nil(t, st.Err)
+}
+
+func TestStatsDigest(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 10)
+	sum := sha256.Sum256(data)
+
+	newContext := func() (*handlerContext, chan Stats) {
+		stats := make(chan Stats, 1)
+		h := newHandlerContextWith(func(srv *Server) {
+			srv.Hash = sha256.New
+			srv.Stats = func(st Stats) {
+				stats <- st
+			}
+		})
+		return h, stats
+	}
+
+	// Retransmitted blocks and blocks that are sent again after a partial
+	// ACK are hashed once.
+	h, stats := newContext()
+	h.SetReadCloser(&rcBuffer{bytes.NewBuffer(data)})
+	h.Negotiate(t, map[string]string{"blksize": "16", "windowsize": "4"})
+	for i := 0; i < 4; i++ {
+		_ = <-h.rcv
+	}
+	h.snd <- ErrTimeout
+	for i := 0; i < 4; i++ {
+		_ = <-h.rcv
+	}
+	h.snd <- &packetACK{blockNr: 2}
+	for i := 0; i < 4; i++ {
+		_ = <-h.rcv
+	}
+	h.snd <- &packetACK{blockNr: 6}
+	_ = <-h.rcv
+	h.snd <- &packetACK{blockNr: 7}
+	h.snd <- ErrTimeout
+
+	st := <-stats
+	assert.Nil(t, st.Err)
+	assert.Equal(t, sum[:], st.Digest)
+
+	h, stats = newContext()
+	h.snd <- &packetWRQ{packetXRQ{filename: "file"}}
+	_ = <-h.rcv
+	h.snd <- &packetDATA{blockNr: 1, data: data}
+	_ = <-h.rcv
+
+	st = <-stats
+	assert.Nil(t, st.Err)
+	assert.Equal(t, sum[:], st.Digest)
+}
+
+func TestStatsDigestNetascii(t *testing.T) {
+	sum := sha256.Sum256([]byte("one\ntwo\n"))
+
+	newContext := func() (*handlerContext, chan Stats) {
+		stats := make(chan Stats, 1)
+		h := newHandlerContextWith(func(srv *Server) {
+			srv.Hash = sha256.New
+			srv.Stats = func(st Stats) {
+				stats <- st
+			}
+		})
+		return h, stats
+	}
+
+	// The digest is that of the file, not of the data on the network.
+	h, stats := newContext()
+	h.SetReadCloser(&rcBuffer{bytes.NewBufferString("one\ntwo\n")})
+	h.snd <- &packetRRQ{packetXRQ{filename: "file", mode: modeNETASCII}}
+	pdata := <-h.rcv
+	assert.Equal(t, &packetDATA{blockNr: 1, data: []byte("one\r\ntwo\r\n")}, pdata)
+	h.snd <- &packetACK{blockNr: 1}
+	h.snd <- ErrTimeout
+
+	st := <-stats
+	assert.Nil(t, st.Err)
+	assert.Equal(t, sum[:], st.Digest)
+
+	h, stats = newContext()
+	h.snd <- &packetWRQ{packetXRQ{filename: "file", mode: modeNETASCII}}
+	_ = <-h.rcv
+	h.snd <- &packetDATA{blockNr: 1, data: []byte("one\r\ntwo\r\n")}
+	_ = <-h.rcv
+
+	st = <-stats
+	assert.Nil(t, st.Err)
+	assert.Equal(t, sum[:], st.Digest)
+}
+
+func TestStatsFailedSession(t *testing.T) {
+	h, stats := newStatsHandlerContext(1)
+
+	h.readFunc = func(_ net.Addr, _ string) (ReadCloser, error) {
+		return nil, os.ErrNotExist
+	}
+	h.snd <- &packetRRQ{packetXRQ{filename: "missing"}}
+	_ = <-h.rcv
+
+	st := <-stats
+	assert.Equal(t, "missing", st.Filename)
+	assert.Equal(t, &TransferError{Code: 1, Message: "file does not exist", Err: os.ErrNotExist}, st.Err)
+
+	// Sessions that time out are reported as well.
+	h, stats = newStatsHandlerContext(1)
+
+	h.SetReadCloser(&rcBuffer{bytes.NewBuffer([]byte{0x1})})
+	h.snd <- &packetRRQ{packetXRQ{filename: "file"}}
+	for i := 0; i < 2; i++ {
+		_ = <-h.rcv
+		h.snd <- ErrTimeout
+	}
+
+	st = <-stats
+	assert.Equal(t, int64(0), st.Bytes)
+	assert.Equal(t, 1, st.Retransmits)
+	assert.True(t, errors.Is(st.Err, ErrTimeout))
+}
+
+func TestStatsPeerError(t *testing.T) {
+	h, stats := newStatsHandlerContext(3)
+
+	h.SetReadCloser(&rcBuffer{bytes.NewBuffer(make([]byte, 1024))})
+	h.snd <- &packetRRQ{packetXRQ{filename: "file"}}
+	_ = <-h.rcv
+
+	// The peer gives up, which ends the transfer without retransmitting.
+	h.snd <- &packetERROR{errorCode: 3, errorMessage: "disk full"}
+
+	_, ok := <-h.rcv
+	assert.False(t, ok)
+
+	st := <-stats
+	assert.Equal(t, 0, st.Retransmits)
+	assert.Equal(t, &Error{Code: 3, Message: "disk full"}, st.Err)
+}
+
+type closeCall struct {
+	filename string
+	err      error
+	closed   bool // Whether the ReadCloser was closed when OnClose was called.
+}
+
+func TestOnClose(t *testing.T) {
+	rc := &rcClosed{Reader: bytes.NewBuffer([]byte{0x1})}
+	calls := make(chan closeCall, 2)
+	newHandlerContext := func() *handlerContext {
+		return newHandlerContextWith(func(srv *Server) {
+			srv.OnClose = func(peer net.Addr, filename string, err error) {
+				calls <- closeCall{filename: filename, err: err, closed: rc.closed}
+			}
+		})
+	}
+
+	// A transfer that completes.
+	h := newHandlerContext()
+	h.SetReadCloser(rc)
+	h.snd <- &packetRRQ{packetXRQ{filename: "file"}}
+	_ = <-h.rcv
+	h.snd <- &packetACK{blockNr: 1}
+	close(h.snd)
+	_, _ = <-h.rcv
+
+	assert.Equal(t, closeCall{filename: "file", closed: true}, <-calls)
+	assert.Len(t, calls, 0)
+
+	// A request the Handler fails.
+	h = newHandlerContext()
+	h.writeFunc = func(_ net.Addr, _ string) (WriteCloser, error) {
+		return nil, os.ErrPermission
+	}
+	h.snd <- &packetWRQ{packetXRQ{filename: "file"}}
+	_ = <-h.rcv
+	_, _ = <-h.rcv
+
+	call := <-calls
+	assert.Equal(t, "file", call.filename)
+	assert.True(t, errors.Is(call.err, os.ErrPermission))
+	assert.Len(t, calls, 0)
+
+	// A packet that is not a request, which never reaches the Handler.
+	h = newHandlerContext()
+	h.snd <- &packetACK{blockNr: 1}
+	_ = <-h.rcv
+	_, _ = <-h.rcv
+
+	call = <-calls
+	assert.Equal(t, "", call.filename)
+	assert.True(t, errors.Is(call.err, errNotRequest))
+	assert.Len(t, calls, 0)
+}
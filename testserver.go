@@ -0,0 +1,74 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// TestServer is a Server on a loopback address, for use in tests of packages
+// that use TFTP. See NewTestServer.
+type TestServer struct {
+	srv  *Server
+	l    net.PacketConn
+	done chan struct{} // Closed when Serve has returned.
+	once sync.Once
+}
+
+// NewTestServer starts a Server for Handler h on a random port of 127.0.0.1.
+// The caller should call Close when done with it.
+func NewTestServer(h Handler) (*TestServer, error) {
+	l, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	ts := &TestServer{
+		srv:  NewServer(h),
+		l:    l,
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(ts.done)
+		_ = ts.srv.Serve(l)
+	}()
+
+	return ts, nil
+}
+
+// Addr returns the address the server listens on, in the form that Client
+// methods take.
+func (ts *TestServer) Addr() string {
+	return ts.l.LocalAddr().String()
+}
+
+// Close stops the server. It returns once no more requests are accepted, and
+// cancels the sessions that are still in progress, without waiting for them
+// to end. It is safe to call Close more than once.
+func (ts *TestServer) Close() {
+	ts.once.Do(func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_ = ts.srv.Shutdown(ctx)
+		_ = ts.l.Close()
+		<-ts.done
+	})
+}
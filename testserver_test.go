@@ -0,0 +1,52 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTestServer(t *testing.T) {
+	h := NewMemHandler()
+	h.SetFile("file", []byte("data"))
+
+	ts, err := NewTestServer(h)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	rc, err := NewClient().Get(context.Background(), ts.Addr(), "file")
+	if assert.Nil(t, err) {
+		b, err := ioutil.ReadAll(rc)
+		assert.Nil(t, err)
+		assert.Equal(t, "data", string(b))
+		assert.Nil(t, rc.Close())
+	}
+
+	ts.Close()
+	ts.Close()
+
+	// Requests are no longer answered.
+	cl := &Client{Timeout: 50 * time.Millisecond}
+	_, err = cl.Get(context.Background(), ts.Addr(), "file")
+	assert.NotNil(t, err)
+}
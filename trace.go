@@ -0,0 +1,114 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"context"
+	"net"
+)
+
+// The names of the spans a session is traced with. The span of the session
+// is the parent of the spans of its phases, which follow each other.
+const (
+	SpanSession   = "session"   // The whole session.
+	SpanRequest   = "request"   // Reading and parsing the request.
+	SpanNegotiate = "negotiate" // Opening the file and negotiating options.
+	SpanTransfer  = "transfer"  // Transferring the data.
+)
+
+// Span describes a timed phase of a session, for a Tracer.
+type Span struct {
+	Name     string
+	Peer     net.Addr
+	Filename string // Empty if the request has not been received yet.
+	Write    bool   // Whether the request is a write request.
+	Blocks   int    // The number of data packets transferred.
+	Bytes    int64  // The number of bytes transferred.
+	Err      error  // The error the session ended with, at the end of a span.
+}
+
+// Tracer is the interface for tracing the phases of sessions, for example
+// with a distributed tracing system. Unlike a Logger, which receives discrete
+// events, a Tracer receives spans that have a start and an end.
+type Tracer interface {
+	// StartSpan is called when the span starts, with the context of its
+	// parent. It returns the context of the span, which is passed to the
+	// Handler for the span of the session, and a function that is called
+	// with the span as it is at its end. Both are called from the goroutine
+	// of the session, so they should not block.
+	StartSpan(ctx context.Context, span Span) (context.Context, func(Span))
+}
+
+// TracerFunc is an adapter to allow the use of an ordinary function as Tracer.
+type TracerFunc func(ctx context.Context, span Span) (context.Context, func(Span))
+
+// StartSpan calls f(ctx, span).
+func (f TracerFunc) StartSpan(ctx context.Context, span Span) (context.Context, func(Span)) {
+	return f(ctx, span)
+}
+
+// span returns the span with the given name as the session currently is.
+func (s *session) span(name string, err error) Span {
+	return Span{
+		Name:     name,
+		Peer:     s.c.RemoteAddr(),
+		Filename: s.filename,
+		Write:    s.wrq,
+		Blocks:   s.blocks,
+		Bytes:    s.bytes,
+		Err:      err,
+	}
+}
+
+// trace starts the span of the session. The context of the session becomes
+// that of the span, so that spans started by the Handler are nested in it.
+func (s *session) trace() {
+	if s.tracer == nil {
+		return
+	}
+
+	s.ctx, s.endSession = s.tracer.StartSpan(s.ctx, s.span(SpanSession, nil))
+}
+
+// phase ends the span of the current phase of the session, if any, and starts
+// the span of the phase with the given name.
+func (s *session) phase(name string) {
+	if s.tracer == nil {
+		return
+	}
+
+	if s.endPhase != nil {
+		s.endPhase(s.span(s.phaseName, nil))
+	}
+
+	_, s.endPhase = s.tracer.StartSpan(s.ctx, s.span(name, nil))
+	s.phaseName = name
+}
+
+// endTrace ends the spans of the current phase and of the session with the
+// error the session ended with.
+func (s *session) endTrace(err error) {
+	if s.tracer == nil {
+		return
+	}
+
+	if s.endPhase != nil {
+		s.endPhase(s.span(s.phaseName, err))
+	}
+
+	s.endSession(s.span(SpanSession, err))
+}
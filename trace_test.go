@@ -0,0 +1,125 @@
+/*
+Copyright (c) 2015 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gotftp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingTracer records the start and end of every span.
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []string
+	ends  map[string]Span
+}
+
+type tracerContextKey struct{}
+
+func (tr *recordingTracer) StartSpan(ctx context.Context, span Span) (context.Context, func(Span)) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	tr.spans = append(tr.spans, "start "+span.Name)
+	ctx = context.WithValue(ctx, tracerContextKey{}, span.Name)
+	return ctx, func(span Span) {
+		tr.mu.Lock()
+		defer tr.mu.Unlock()
+
+		tr.spans = append(tr.spans, fmt.Sprintf("end %s %v", span.Name, span.Err))
+		if tr.ends == nil {
+			tr.ends = make(map[string]Span)
+		}
+		tr.ends[span.Name] = span
+	}
+}
+
+func TestTracer(t *testing.T) {
+	tr := &recordingTracer{}
+	h := newHandlerContextWith(func(srv *Server) {
+		srv.Tracer = tr
+	})
+
+	h.SetReadCloser(&rcBuffer{bytes.NewBuffer(make([]byte, 10))})
+	h.Negotiate(t, map[string]string{"blksize": "8"})
+	for blockNr := uint16(1); blockNr <= 2; blockNr++ {
+		<-h.rcv
+		h.snd <- &packetACK{blockNr: blockNr}
+	}
+	close(h.snd)
+
+	_, ok := <-h.rcv
+	assert.False(t, ok)
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	assert.Equal(t, []string{
+		"start session",
+		"start request",
+		"end request <nil>",
+		"start negotiate",
+		"end negotiate <nil>",
+		"start transfer",
+		"end transfer <nil>",
+		"end session <nil>",
+	}, tr.spans)
+
+	// The spans describe the session at their end.
+	assert.Equal(t, 2, tr.ends[SpanTransfer].Blocks)
+	assert.Equal(t, int64(10), tr.ends[SpanSession].Bytes)
+
+	// The Handler is passed the context of the span of the session.
+	assert.Equal(t, SpanSession, h.ctx.Value(tracerContextKey{}))
+}
+
+func TestTracerError(t *testing.T) {
+	tr := &recordingTracer{}
+	h := newHandlerContextWith(func(srv *Server) {
+		srv.Tracer = tr
+	})
+
+	h.readFunc = func(_ net.Addr, _ string) (ReadCloser, error) {
+		return nil, os.ErrNotExist
+	}
+	h.snd <- &packetRRQ{packetXRQ{filename: "file"}}
+	<-h.rcv
+
+	_, ok := <-h.rcv
+	assert.False(t, ok)
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	// The phase that failed ends with the error of the session.
+	err := "transfer aborted with error 1: file does not exist"
+	assert.Equal(t, []string{
+		"start session",
+		"start request",
+		"end request <nil>",
+		"start negotiate",
+		"end negotiate " + err,
+		"end session " + err,
+	}, tr.spans)
+}